@@ -0,0 +1,365 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/gb"
+)
+
+/*
+How a test ROM reports its result.
+*/
+type Kind int
+
+const (
+	// Blargg's tests print "Passed" or "Failed" over the link cable
+	Serial Kind = iota
+	// Mooneye tests execute LD B,B with the Fibonacci numbers 3, 5, 8, 13,
+	// 21 and 34 in B, C, D, E, H and L if they pass, or 42h in all of them
+	// if they fail
+	Registers
+	// dmg-acid2 draws a picture which must match a reference picture
+	Framebuffer
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case Serial:
+		return "blargg"
+	case Registers:
+		return "mooneye"
+	case Framebuffer:
+		return "acid2"
+	}
+	return "unknown"
+}
+
+/*
+Frames a test of each kind is given to report its result before it fails,
+at 60 frames per second. cpu_instrs takes almost a minute.
+*/
+var DefaultFrames = map[Kind]int{
+	Serial:      60 * 90,
+	Registers:   60 * 20,
+	Framebuffer: 60 * 2,
+}
+
+// Blargg's test suites reporting over the link cable
+var serialSuites = []string{"cpu_instrs", "instr_timing", "mem_timing"}
+
+// Mooneye directories of tests which can't be checked automatically
+var skippedDirectories = []string{"manual-only", "utils"}
+
+var fibonacci = []byte{3, 5, 8, 13, 21, 34}
+
+/*
+A test ROM found by Discover.
+*/
+type Test struct {
+	// Path relative to the directory searched, with forward slashes
+	Name string
+	Path string
+	Kind Kind
+	// Reference picture of a Framebuffer test
+	Reference string
+}
+
+/*
+Outcome of a test.
+*/
+type Result struct {
+	Test     Test
+	Passed   bool
+	Detail   string
+	Frames   int
+	Duration time.Duration
+	// Text the ROM printed over the link cable
+	Output string
+}
+
+/*
+Find the test ROMs in dir and its subdirectories, sorted by name:
+
+  - ROMs in a cpu_instrs, instr_timing or mem_timing directory, or named
+    so, are Blargg's tests
+  - dmg-acid2.gb is checked against dmg-acid2.png or reference-dmg.png
+    next to it
+  - every other ROM is taken as a Mooneye test, except those of the
+    manual-only and utils directories
+*/
+func Discover(dir string) ([]Test, error) {
+	var tests []Test
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			for _, skipped := range skippedDirectories {
+				if info.Name() == skipped {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".gb" && ext != ".gbc" {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		test := Test{
+			Name: filepath.ToSlash(name),
+			Path: path,
+			Kind: Registers,
+		}
+		base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		elements := strings.Split(strings.TrimSuffix(test.Name, filepath.Ext(path)), "/")
+		for _, element := range elements {
+			for _, suite := range serialSuites {
+				if element == suite {
+					test.Kind = Serial
+				}
+			}
+		}
+		if base == "dmg-acid2" {
+			test.Kind = Framebuffer
+			test.Reference = findReference(filepath.Dir(path), base)
+		}
+		tests = append(tests, test)
+		return nil
+	})
+	sort.Slice(tests, func(i, j int) bool {
+		return tests[i].Name < tests[j].Name
+	})
+	return tests, err
+}
+
+/*
+Return the path of the reference picture of a ROM, empty if there is none.
+*/
+func findReference(dir string, base string) string {
+	for _, name := range []string{base + ".png", "reference-dmg.png"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+/*
+Boot the ROM headlessly and run it until it reports its result, for at most
+the given number of frames, DefaultFrames of its kind if zero.
+*/
+func (test Test) Run(frames int) (result Result) {
+	result.Test = test
+	if frames == 0 {
+		frames = DefaultFrames[test.Kind]
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	var reference string
+	if test.Kind == Framebuffer {
+		var err error
+		if reference, err = referenceHash(test.Reference); err != nil {
+			result.Detail = err.Error()
+			return
+		}
+	}
+
+	var serial bytes.Buffer
+	var signature []byte
+	screen := new(driver.Headless)
+	core := &gb.Core{
+		FPS:           60,
+		Clock:         4194304,
+		DisplayDriver: screen,
+		Controller:    screen,
+		DrawSignal:    make(chan bool),
+		AudioDriver:   new(driver.NullAudio),
+		SerialOutput:  &serial,
+	}
+	core.OnSoftwareBreakpoint = func() {
+		if signature == nil {
+			registers := core.CPU.Registers
+			signature = []byte{registers.B, registers.C, registers.D, registers.E, byte(registers.HL >> 8), byte(registers.HL)}
+		}
+	}
+	if err := core.Init(test.Path); err != nil {
+		result.Detail = "failed to load ROM: " + err.Error()
+		return
+	}
+	// Tests must not leave saves next to the ROMs
+	core.RamPath = os.DevNull
+	defer core.Close()
+
+	var hash string
+	for result.Frames < frames {
+		if err := core.RunFrame(); err != nil {
+			result.Detail = err.Error()
+			return
+		}
+		result.Frames++
+		result.Output = serial.String()
+
+		switch test.Kind {
+		case Serial:
+			if line, ok := serialResult(result.Output); ok {
+				result.Passed = strings.HasPrefix(line, "Passed")
+				result.Detail = line
+				return
+			}
+		case Registers:
+			if signature != nil {
+				result.Passed = bytes.Equal(signature, fibonacci)
+				if bytes.Equal(signature, bytes.Repeat([]byte{0x42}, len(fibonacci))) {
+					result.Detail = "failed"
+				} else if !result.Passed {
+					result.Detail = fmt.Sprintf("unexpected registers B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X",
+						signature[0], signature[1], signature[2], signature[3], signature[4], signature[5])
+				}
+				return
+			}
+		case Framebuffer:
+			hash = framebufferHash(core)
+			if hash == reference {
+				result.Passed = true
+				return
+			}
+			if signature != nil {
+				result.Detail = fmt.Sprintf("framebuffer %.12s differs from the reference %.12s", hash, reference)
+				return
+			}
+		}
+	}
+
+	result.Detail = fmt.Sprintf("no result after %d frames", frames)
+	if test.Kind == Framebuffer {
+		result.Detail = fmt.Sprintf("framebuffer %.12s differs from the reference %.12s", hash, reference)
+	}
+	return
+}
+
+/*
+Find the complete line starting with "Passed" or "Failed" in the output of
+a Blargg test.
+*/
+func serialResult(output string) (string, bool) {
+	for _, keyword := range []string{"Failed", "Passed"} {
+		start := strings.Index(output, keyword)
+		if start < 0 {
+			continue
+		}
+		end := strings.IndexByte(output[start:], '\n')
+		if end < 0 {
+			return "", false
+		}
+		return strings.TrimSpace(output[start : start+end]), true
+	}
+	return "", false
+}
+
+/*
+SHA-1 of the screen in shades, 0 for white to 3 for black, row by row.
+*/
+func framebufferHash(core *gb.Core) string {
+	var shades [160 * 144]byte
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			pixel := core.Screen[x][y]
+			shades[y*160+x] = shade(color.RGBA{R: pixel[0], G: pixel[1], B: pixel[2], A: 0xFF})
+		}
+	}
+	sum := sha1.Sum(shades[:])
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Hash a reference picture as framebufferHash does.
+*/
+func referenceHash(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no reference picture")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	picture, err := png.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference picture: %v", err)
+	}
+	bounds := picture.Bounds()
+	if bounds.Dx() != 160 || bounds.Dy() != 144 {
+		return "", fmt.Errorf("reference picture is %dx%d, not 160x144", bounds.Dx(), bounds.Dy())
+	}
+
+	var shades [160 * 144]byte
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			shades[y*160+x] = shade(picture.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	sum := sha1.Sum(shades[:])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+Shade of a pixel by its brightness, so that our palette (FF, CC, 77, 00)
+and the one of the reference pictures (FF, AA, 55, 00) agree.
+*/
+func shade(c color.Color) byte {
+	gray := color.GrayModel.Convert(c).(color.Gray).Y
+	switch {
+	case gray > 0xE5:
+		return 0
+	case gray > 0x99:
+		return 1
+	case gray > 0x3B:
+		return 2
+	}
+	return 3
+}
+
+/*
+Write a table of the results followed by the number of tests passed.
+*/
+func WriteSummary(w io.Writer, results []Result) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "TEST\tKIND\tRESULT\tFRAMES\tTIME\tDETAIL")
+	passed := 0
+	for _, result := range results {
+		status := "FAIL"
+		if result.Passed {
+			status = "PASS"
+			passed++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\n", result.Test.Name, result.Test.Kind, status,
+			result.Frames, result.Duration.Round(time.Millisecond), result.Detail)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d passed, %d failed, %d total\n", passed, len(results)-passed, len(results))
+	return err
+}
@@ -0,0 +1,66 @@
+package conformance
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+/*
+Run the test ROMs of the directory named by GBDOTLIVE_TEST_ROMS,
+testdata/roms by default. The ROMs are not distributed with the emulator,
+the test is skipped if there are none.
+*/
+func TestConformance(t *testing.T) {
+	dir := os.Getenv("GBDOTLIVE_TEST_ROMS")
+	if dir == "" {
+		dir = "testdata/roms"
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		t.Skipf("no test ROMs in %s", dir)
+	}
+	tests, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) == 0 {
+		t.Skipf("no test ROMs in %s", dir)
+	}
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result := test.Run(0)
+			if !result.Passed {
+				t.Error(result.Detail)
+				if result.Output != "" {
+					t.Logf("serial output:\n%s", result.Output)
+				}
+			}
+		})
+	}
+}
+
+func TestSerialResult(t *testing.T) {
+	for _, c := range []struct {
+		output string
+		line   string
+		done   bool
+	}{
+		{"01-special\n\n\n", "", false},
+		{"01-special\n\n\nPass", "", false},
+		{"01-special\n\n\nPassed", "", false},
+		{"01-special\n\n\nPassed\n", "Passed", true},
+		{"cpu_instrs\n\n01:ok  02:01  \n\nFailed 1 tests.\n", "Failed 1 tests.", true},
+		{"01-special\n\nE8 E8 F8\nFailed #6\n", "Failed #6", true},
+	} {
+		line, done := serialResult(c.output)
+		if line != c.line || done != c.done {
+			t.Errorf("serialResult(%q) = %q, %v, want %q, %v", c.output, line, done, c.line, c.done)
+		}
+	}
+}
@@ -33,14 +33,10 @@ func (stream *ASCII) Run(drawSignal chan bool, onQuit func()) {
 		pixels := [160][144]bool{}
 		for y := 0; y < 144; y++ {
 			for x := 0; x < 160; x++ {
-				switch stream.pixels[x][y][0] {
-				case 255, 0xCC:
-					// White pixel
-					pixels[x][y] = true
-				default:
-					// Black pixel
-					pixels[x][y] = false
-				}
+				// Pixels brighter than the mid grey are white, this also
+				// covers the colours of Game Boy Color games
+				r, g, b := int(stream.pixels[x][y][0]), int(stream.pixels[x][y][1]), int(stream.pixels[x][y][2])
+				pixels[x][y] = (r*299+g*587+b*114)/1000 > 0xA0
 			}
 		}
 		stream.renderAscii(pixels)
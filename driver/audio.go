@@ -0,0 +1,31 @@
+package driver
+
+/*
+Receives the audio produced by the emulator.
+*/
+type AudioDriver interface {
+	// Initialize the output, sampleRate is the rate of the samples pushed by the emulator
+	Init(sampleRate int) error
+	// Queue stereo samples ranging from -1 to 1, called from the emulation loop once per frame.
+	// The slice is reused by the emulator and must not be retained.
+	Push(samples [][2]float64)
+	// Release the output
+	Close() error
+}
+
+/*
+Audio driver discarding all samples.
+*/
+type NullAudio struct {
+}
+
+func (null *NullAudio) Init(sampleRate int) error {
+	return nil
+}
+
+func (null *NullAudio) Push(samples [][2]float64) {
+}
+
+func (null *NullAudio) Close() error {
+	return nil
+}
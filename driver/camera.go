@@ -0,0 +1,190 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of the pictures taken by the Game Boy Camera sensor
+const (
+	CameraWidth  = 128
+	CameraHeight = 112
+)
+
+/*
+ImageSource supplies the pictures seen by the Game Boy Camera. Frame
+returns a CameraWidth x CameraHeight greyscale picture, or nil if there
+is nothing to see. It is called from the emulation goroutine for each
+picture the game takes.
+*/
+type ImageSource interface {
+	Frame() *image.Gray
+}
+
+/*
+Open a PNG file, or a directory of PNG files, as a camera image source.
+*/
+func NewImageSource(path string) (ImageSource, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return &PNGDirectory{Path: path}, nil
+	}
+	return &PNGFile{Path: path}, nil
+}
+
+/*
+Scale and crop an image to the camera sensor size, keeping its aspect
+ratio, and convert it to greyscale.
+*/
+func CameraFrame(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	// Largest part of the image with the aspect ratio of the sensor
+	width, height := bounds.Dx(), bounds.Dy()
+	if width*CameraHeight > height*CameraWidth {
+		width = height * CameraWidth / CameraHeight
+	} else {
+		height = width * CameraHeight / CameraWidth
+	}
+	left := bounds.Min.X + (bounds.Dx()-width)/2
+	top := bounds.Min.Y + (bounds.Dy()-height)/2
+
+	frame := image.NewGray(image.Rect(0, 0, CameraWidth, CameraHeight))
+	for y := 0; y < CameraHeight; y++ {
+		for x := 0; x < CameraWidth; x++ {
+			frame.Set(x, y, img.At(left+x*width/CameraWidth, top+y*height/CameraHeight))
+		}
+	}
+	return frame
+}
+
+func loadPNGFrame(path string) (*image.Gray, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return CameraFrame(img), nil
+}
+
+/*
+A single PNG file, reloaded whenever it is modified.
+*/
+type PNGFile struct {
+	Path string
+
+	frame   *image.Gray
+	modTime time.Time
+}
+
+func (source *PNGFile) Frame() *image.Gray {
+	stat, err := os.Stat(source.Path)
+	if err != nil || stat.ModTime().Equal(source.modTime) {
+		return source.frame
+	}
+	if frame, err := loadPNGFrame(source.Path); err == nil {
+		source.frame = frame
+		source.modTime = stat.ModTime()
+	}
+	return source.frame
+}
+
+/*
+A directory of PNG files, played in name order as a video: each picture
+taken by the game shows the next file.
+*/
+type PNGDirectory struct {
+	Path string
+
+	frames []*image.Gray
+	next   int
+}
+
+func (source *PNGDirectory) Frame() *image.Gray {
+	if source.frames == nil {
+		source.frames = []*image.Gray{}
+		files, err := ioutil.ReadDir(source.Path)
+		if err != nil {
+			return nil
+		}
+		var names []string
+		for _, file := range files {
+			if !file.IsDir() && strings.EqualFold(filepath.Ext(file.Name()), ".png") {
+				names = append(names, file.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if frame, err := loadPNGFrame(filepath.Join(source.Path, name)); err == nil {
+				source.frames = append(source.frames, frame)
+			}
+		}
+	}
+	if len(source.frames) == 0 {
+		return nil
+	}
+	frame := source.frames[source.next]
+	source.next = (source.next + 1) % len(source.frames)
+	return frame
+}
+
+/*
+The last picture uploaded, by the static server clients for instance.
+*/
+type ImageUpload struct {
+	frame *image.Gray
+	lock  sync.RWMutex
+}
+
+// Largest width and height of an uploaded image, decoding is refused above
+const MaxUploadDimension = 4096
+
+/*
+Decode an uploaded PNG image and show it to the camera. The size of the
+image is checked before decoding it, so that a small file claiming huge
+dimensions cannot make us allocate them.
+*/
+func (source *ImageUpload) Upload(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if config.Width > MaxUploadDimension || config.Height > MaxUploadDimension {
+		return fmt.Errorf("image too large: %dx%d, at most %dx%d", config.Width, config.Height, MaxUploadDimension, MaxUploadDimension)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	frame := CameraFrame(img)
+	source.lock.Lock()
+	source.frame = frame
+	source.lock.Unlock()
+	return nil
+}
+
+func (source *ImageUpload) Frame() *image.Gray {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	return source.frame
+}
@@ -2,6 +2,8 @@ package driver
 
 import (
 	"github.com/HFO4/gbc-in-cloud/util"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +19,24 @@ type ControllerDriver interface {
 type TelnetController struct {
 	inputStatus *byte
 	Keymap      [8]KeyMap
+	// Timestamp when the rewind key was last pressed
+	lastRewind    int64
+	hotkeyHandler func(Hotkey, int)
+	// Hotkeys pressed since the last frame
+	hotkeys    []Hotkey
+	hotkeyLock sync.Mutex
+}
+
+// Key held to rewind
+const telnetRewindKey = 'r'
+
+// Keys of the speed controls
+var telnetHotkeys = map[byte]Hotkey{
+	'p': HotkeyPause,
+	'n': HotkeyFrameAdvance,
+	'f': HotkeyFaster,
+	's': HotkeySlower,
+	'0': HotkeyNormalSpeed,
 }
 
 type KeyMap struct {
@@ -51,9 +71,27 @@ func (tel *TelnetController) UpdateInput() bool {
 		}
 	}
 	*tel.inputStatus = statusCopy
+
+	// The rewind key is held as long as it keeps repeating
+	if tel.hotkeyHandler != nil && timeNow-atomic.LoadInt64(&tel.lastRewind) <= 200 {
+		tel.hotkeyHandler(HotkeyRewind, 0)
+	}
+	tel.hotkeyLock.Lock()
+	hotkeys := tel.hotkeys
+	tel.hotkeys = nil
+	tel.hotkeyLock.Unlock()
+	if tel.hotkeyHandler != nil {
+		for _, hotkey := range hotkeys {
+			tel.hotkeyHandler(hotkey, 0)
+		}
+	}
 	return requestInterrupt
 }
 
+func (tel *TelnetController) SetHotkeyHandler(handler func(Hotkey, int)) {
+	tel.hotkeyHandler = handler
+}
+
 func (tel *TelnetController) NewInput(data []byte) {
 
 	/*
@@ -73,9 +111,19 @@ func (tel *TelnetController) NewInput(data []byte) {
 	}
 
 	key := data[len(data)-1]
+	timeNow := time.Now().UnixNano() / int64(time.Millisecond)
+	if key == telnetRewindKey {
+		atomic.StoreInt64(&tel.lastRewind, timeNow)
+		return
+	}
+	if hotkey, ok := telnetHotkeys[key]; ok {
+		tel.hotkeyLock.Lock()
+		tel.hotkeys = append(tel.hotkeys, hotkey)
+		tel.hotkeyLock.Unlock()
+		return
+	}
 	keyId := keyDataMap[key]
 
-	timeNow := time.Now().UnixNano() / int64(time.Millisecond)
 	tel.Keymap[keyId].LastPress = timeNow
 
 }
@@ -15,8 +15,28 @@ type LCD struct {
 
 	pixelMap *pixel.PictureData
 
-	inputStatus *byte
-	title       string
+	inputStatus   *byte
+	title         string
+	hotkeyHandler func(Hotkey, int)
+}
+
+// Function keys for the save state slots, Shift+Fn saves and Fn loads
+var stateSlotKeys = [...]pixelgl.Button{
+	pixelgl.KeyF1, pixelgl.KeyF2, pixelgl.KeyF3,
+	pixelgl.KeyF4, pixelgl.KeyF5, pixelgl.KeyF6,
+	pixelgl.KeyF7, pixelgl.KeyF8, pixelgl.KeyF9,
+}
+
+// Held to rewind
+const rewindKey = pixelgl.KeyR
+
+// Keys of the speed controls
+var speedKeys = map[pixelgl.Button]Hotkey{
+	pixelgl.KeyP: HotkeyPause,
+	pixelgl.KeyN: HotkeyFrameAdvance,
+	pixelgl.KeyF: HotkeyFaster,
+	pixelgl.KeyS: HotkeySlower,
+	pixelgl.Key0: HotkeyNormalSpeed,
 }
 
 func (lcd *LCD) Init(pixels *[160][144][3]uint8, title string) {
@@ -31,6 +51,10 @@ func (lcd *LCD) InitStatus(statusPointer *byte) {
 	lcd.inputStatus = statusPointer
 }
 
+func (lcd *LCD) SetHotkeyHandler(handler func(Hotkey, int)) {
+	lcd.hotkeyHandler = handler
+}
+
 func (lcd *LCD) UpdateInput() bool {
 	// Mapping from keys to GB index.
 	// Reference :https://github.com/Humpheh/goboy/blob/master/pkg/gbio/iopixel/pixels.go
@@ -67,9 +91,65 @@ func (lcd *LCD) UpdateInput() bool {
 	}
 
 	*lcd.inputStatus = statusCopy
+
+	if lcd.hotkeyHandler != nil {
+		shift := lcd.window.Pressed(pixelgl.KeyLeftShift) || lcd.window.Pressed(pixelgl.KeyRightShift)
+		for slot, key := range stateSlotKeys {
+			if !lcd.window.JustPressed(key) {
+				continue
+			}
+			if shift {
+				lcd.hotkeyHandler(HotkeySaveState, slot+1)
+			} else {
+				lcd.hotkeyHandler(HotkeyLoadState, slot+1)
+			}
+		}
+		if lcd.window.Pressed(rewindKey) {
+			lcd.hotkeyHandler(HotkeyRewind, 0)
+		}
+		for key, hotkey := range speedKeys {
+			if lcd.window.JustPressed(key) {
+				lcd.hotkeyHandler(hotkey, 0)
+			}
+		}
+	}
 	return requestInterrupt
 }
 
+// Tilt given by the arrow keys, in g
+const keyTilt = 0.5
+
+/*
+While the left mouse button is held, the tilt follows the position of the
+mouse relative to the window centre. Otherwise the arrow keys tilt the
+console, in addition to pressing the joypad.
+*/
+func (lcd *LCD) Tilt() (float64, float64) {
+	if lcd.window == nil {
+		return 0, 0
+	}
+	if lcd.window.Pressed(pixelgl.MouseButtonLeft) {
+		bounds := lcd.window.Bounds()
+		offset := lcd.window.MousePosition().Sub(bounds.Center())
+		// The side of the window under the mouse is lowered, window coordinates go upwards
+		return 2 * offset.X / bounds.W(), -2 * offset.Y / bounds.H()
+	}
+	var x, y float64
+	if lcd.window.Pressed(pixelgl.KeyRight) {
+		x += keyTilt
+	}
+	if lcd.window.Pressed(pixelgl.KeyLeft) {
+		x -= keyTilt
+	}
+	if lcd.window.Pressed(pixelgl.KeyDown) {
+		y += keyTilt
+	}
+	if lcd.window.Pressed(pixelgl.KeyUp) {
+		y -= keyTilt
+	}
+	return x, y
+}
+
 func (lcd *LCD) NewInput(b []byte) {
 
 }
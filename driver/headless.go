@@ -0,0 +1,168 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+Headless display and controller driver, used to run ROMs without any window.
+Input comes from a script instead of a player.
+*/
+type Headless struct {
+	pixels *[160][144][3]uint8
+
+	inputStatus *byte
+	// Scripted input events, sorted by frame
+	Script []InputEvent
+	// Index of the frame about to be emulated
+	frame int
+	next  int
+}
+
+/*
+A scripted button press or release, which takes effect before the given frame.
+*/
+type InputEvent struct {
+	Frame   int
+	Button  byte
+	Pressed bool
+}
+
+// Button names used in input scripts and their bit in the joypad status
+var ButtonMap = map[string]byte{
+	"RIGHT":  0,
+	"LEFT":   1,
+	"UP":     2,
+	"DOWN":   3,
+	"A":      4,
+	"B":      5,
+	"SELECT": 6,
+	"START":  7,
+}
+
+/*
+Load an input script. Each line holds one event:
+
+	<frame> <button> <press|release>
+
+Buttons are named as in ButtonMap, lines starting with # are ignored.
+*/
+func LoadInputScript(path string) ([]InputEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var script []InputEvent
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <frame> <button> <press|release>", lineNum)
+		}
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil || frame < 0 {
+			return nil, fmt.Errorf("line %d: invalid frame %q", lineNum, fields[0])
+		}
+		button, ok := ButtonMap[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown button %q", lineNum, fields[1])
+		}
+		var pressed bool
+		switch strings.ToLower(fields[2]) {
+		case "press":
+			pressed = true
+		case "release":
+			pressed = false
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", lineNum, fields[2])
+		}
+		script = append(script, InputEvent{Frame: frame, Button: button, Pressed: pressed})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(script, func(i, j int) bool {
+		return script[i].Frame < script[j].Frame
+	})
+	return script, nil
+}
+
+func (h *Headless) Init(pixels *[160][144][3]uint8, title string) {
+	h.pixels = pixels
+	log.Println("[Display] Initialize headless display")
+}
+
+/*
+Frames are pulled by the caller with RunFrame, so only drain draw signals
+in case the emulator is driven by its real-time loop.
+*/
+func (h *Headless) Run(drawSignal chan bool, onQuit func()) {
+	for range drawSignal {
+	}
+	onQuit()
+}
+
+func (h *Headless) InitStatus(statusPointer *byte) {
+	h.inputStatus = statusPointer
+	h.frame = 0
+	h.next = 0
+	h.applyScript()
+}
+
+/*
+Called once at the end of every frame.
+*/
+func (h *Headless) UpdateInput() bool {
+	h.frame++
+	return h.applyScript()
+}
+
+func (h *Headless) NewInput(b []byte) {
+}
+
+/*
+Apply script events up to the current frame, return whether a button was pressed.
+*/
+func (h *Headless) applyScript() bool {
+	requestInterrupt := false
+	statusCopy := *h.inputStatus
+	for ; h.next < len(h.Script) && h.Script[h.next].Frame <= h.frame; h.next++ {
+		event := h.Script[h.next]
+		if event.Pressed {
+			statusCopy = util.ClearBit(statusCopy, uint(event.Button))
+			requestInterrupt = true
+		} else {
+			statusCopy = util.SetBit(statusCopy, uint(event.Button))
+		}
+	}
+	*h.inputStatus = statusCopy
+	return requestInterrupt
+}
+
+// Render the current frame buffer as it is
+func (h *Headless) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 160, 144))
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			img.Set(x, y, color.RGBA{R: h.pixels[x][y][0], G: h.pixels[x][y][1], B: h.pixels[x][y][2], A: 0xFF})
+		}
+	}
+	return img
+}
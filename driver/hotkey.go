@@ -0,0 +1,35 @@
+package driver
+
+/*
+Emulator functions a front end can trigger besides the gamepad.
+*/
+type Hotkey int
+
+const (
+	// Save a snapshot into the given slot
+	HotkeySaveState Hotkey = iota
+	// Restore the snapshot of the given slot
+	HotkeyLoadState
+	// Go back through the rewind buffer, sent once per frame while the
+	// rewind key is held, the slot is unused
+	HotkeyRewind
+	// Pause or resume the emulator, the slot is unused as for the others
+	HotkeyPause
+	// Run a single frame while paused, pause if running
+	HotkeyFrameAdvance
+	// Step the speed up or down through 0.25x to uncapped
+	HotkeyFaster
+	HotkeySlower
+	// Back to the normal speed
+	HotkeyNormalSpeed
+)
+
+/*
+HotkeyDriver is implemented by controller drivers that offer hotkeys.
+The emulator registers its handler during initialization, drivers must
+only invoke it from inside UpdateInput so that it runs on the emulation
+goroutine between two frames.
+*/
+type HotkeyDriver interface {
+	SetHotkeyHandler(func(key Hotkey, slot int))
+}
@@ -0,0 +1,34 @@
+package driver
+
+/*
+Streaming sample rate converter using linear interpolation.
+*/
+type Resampler struct {
+	// Input samples per output sample
+	step float64
+	// Position of the next output sample after the last input sample
+	phase float64
+	last  [2]float64
+}
+
+func NewResampler(from int, to int) *Resampler {
+	return &Resampler{step: float64(from) / float64(to)}
+}
+
+/*
+Convert in and append the result to out.
+*/
+func (r *Resampler) Resample(in [][2]float64, out [][2]float64) [][2]float64 {
+	for _, sample := range in {
+		for r.phase < 1 {
+			out = append(out, [2]float64{
+				r.last[0] + (sample[0]-r.last[0])*r.phase,
+				r.last[1] + (sample[1]-r.last[1])*r.phase,
+			})
+			r.phase += r.step
+		}
+		r.phase--
+		r.last = sample
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
+	"github.com/faiface/beep/speaker"
+)
+
+// Rate of the speaker output
+const speakerSampleRate = 44100
+
+/*
+Audio driver playing the game on the local sound card.
+*/
+type Speaker struct {
+	lock      sync.Mutex
+	resampler *Resampler
+	converted [][2]float64
+
+	// Ring buffer of samples waiting to be played
+	samples [][2]float64
+	start   int
+	count   int
+}
+
+func (s *Speaker) Init(sampleRate int) error {
+	log.Println("[Sound] Initialize speaker output")
+	s.resampler = NewResampler(sampleRate, speakerSampleRate)
+	// Keep at most 250ms of latency when the emulation runs ahead
+	s.samples = make([][2]float64, speakerSampleRate/4)
+
+	sr := beep.SampleRate(speakerSampleRate)
+	if err := speaker.Init(sr, sr.N(time.Second/30)); err != nil {
+		return err
+	}
+	speaker.Play(&effects.Volume{
+		Streamer: s,
+		Base:     2,
+		Volume:   -3,
+	})
+	return nil
+}
+
+func (s *Speaker) Push(samples [][2]float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.converted = s.resampler.Resample(samples, s.converted[:0])
+	size := len(s.samples)
+	for _, sample := range s.converted {
+		if s.count == size {
+			// drop the oldest sample
+			s.start = (s.start + 1) % size
+			s.count--
+		}
+		s.samples[(s.start+s.count)%size] = sample
+		s.count++
+	}
+}
+
+/*
+Called by beep to fill the sound card buffer, silence is played once
+no sample is left.
+*/
+func (s *Speaker) Stream(out [][2]float64) (n int, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range out {
+		if s.count == 0 {
+			out[i] = [2]float64{}
+			continue
+		}
+		out[i] = s.samples[s.start]
+		s.start = (s.start + 1) % len(s.samples)
+		s.count--
+	}
+	return len(out), true
+}
+
+func (s *Speaker) Err() error {
+	return nil
+}
+
+func (s *Speaker) Close() error {
+	speaker.Clear()
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"image/draw"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
 type StaticImage struct {
@@ -19,6 +20,12 @@ type StaticImage struct {
 	inputStatus *byte
 	inputQueue  []*inputCommand
 	queueLock   sync.Mutex
+
+	tiltX, tiltY float64
+	tiltLock     sync.Mutex
+
+	rewinding     int32
+	hotkeyHandler func(Hotkey, int)
 }
 
 type inputCommand struct {
@@ -32,6 +39,10 @@ func (s *StaticImage) InitStatus(b *byte) {
 }
 
 func (s *StaticImage) UpdateInput() bool {
+	if s.hotkeyHandler != nil && atomic.LoadInt32(&s.rewinding) != 0 {
+		s.hotkeyHandler(HotkeyRewind, 0)
+	}
+
 	s.queueLock.Lock()
 	if len(s.inputQueue) == 0 {
 		s.queueLock.Unlock()
@@ -72,9 +83,8 @@ func (s *StaticImage) Init(pixels *[160][144][3]uint8, s2 string) {
 }
 
 func (s *StaticImage) Run(drawSignal chan bool, f func()) {
-	for {
-		// drawSignal was sent by the emulator
-		<-drawSignal
+	// drawSignal was sent by the emulator, it is closed when the emulator stops
+	for range drawSignal {
 		s.pixelLock.Lock()
 		if s.pixelsDirty != nil {
 			s.pixelsClean = *s.pixelsDirty
@@ -107,10 +117,13 @@ func (s *StaticImage) Render() *image.RGBA {
 				dot.R = 0x30
 				dot.G = 0x62
 				dot.B = 0x30
-			} else {
+			} else if r == 0 && g == 0 && b == 0 {
 				dot.R = 0x0f
 				dot.G = 0x38
 				dot.B = 0x0f
+			} else {
+				// Game Boy Color pixels are displayed as they are
+				dot.R, dot.G, dot.B = r, g, b
 			}
 			dot.A = 0xff
 
@@ -130,3 +143,30 @@ func (s *StaticImage) EnqueueInput(button byte) {
 	s.inputQueue = append(s.inputQueue, &inputCommand{button, 3, false})
 	s.queueLock.Unlock()
 }
+
+// Set the handler called with HotkeyRewind every frame while rewinding
+func (s *StaticImage) SetHotkeyHandler(handler func(Hotkey, int)) {
+	s.hotkeyHandler = handler
+}
+
+// Start or stop rewinding, the emulator goes back a state every frame in between
+func (s *StaticImage) SetRewinding(rewinding bool) {
+	var value int32
+	if rewinding {
+		value = 1
+	}
+	atomic.StoreInt32(&s.rewinding, value)
+}
+
+// Set the tilt of the console reported by the client, in g
+func (s *StaticImage) SetTilt(x, y float64) {
+	s.tiltLock.Lock()
+	s.tiltX, s.tiltY = x, y
+	s.tiltLock.Unlock()
+}
+
+func (s *StaticImage) Tilt() (float64, float64) {
+	s.tiltLock.Lock()
+	defer s.tiltLock.Unlock()
+	return s.tiltX, s.tiltY
+}
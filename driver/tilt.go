@@ -0,0 +1,13 @@
+package driver
+
+/*
+TiltInput is implemented by controller drivers that can tell how the
+console is tilted, for cartridges with an accelerometer (MBC7).
+
+Tilt returns the tilt on both axes in units of g, from -1 to 1: x is
+positive when the console is tilted to the right, y when it is tilted
+towards the player. It is called from the emulation goroutine.
+*/
+type TiltInput interface {
+	Tilt() (x, y float64)
+}
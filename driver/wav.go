@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"math"
+	"os"
+	"sync"
+)
+
+/*
+Audio driver recording the game into a 16bit stereo PCM WAV file.
+*/
+type WAVWriter struct {
+	Path string
+	// Sample rate of the file, 44100Hz if zero
+	SampleRate int
+
+	lock      sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	resampler *Resampler
+	converted [][2]float64
+	dataSize  uint32
+	// First write error, reported by Close
+	err error
+}
+
+// Size of the RIFF header preceding the sample data
+const wavHeaderSize = 44
+
+func (w *WAVWriter) Init(sampleRate int) error {
+	if w.SampleRate == 0 {
+		w.SampleRate = 44100
+	}
+	file, err := os.Create(w.Path)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Sound] Recording audio to %s\n", w.Path)
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.resampler = NewResampler(sampleRate, w.SampleRate)
+	// Sizes are filled in by Close
+	return w.writeHeader()
+}
+
+func (w *WAVWriter) writeHeader() error {
+	header := struct {
+		RIFF          [4]byte
+		RIFFSize      uint32
+		WAVE          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}{
+		RIFFSize:      wavHeaderSize - 8 + w.dataSize,
+		FmtSize:       16,
+		Format:        1,
+		Channels:      2,
+		SampleRate:    uint32(w.SampleRate),
+		ByteRate:      uint32(w.SampleRate) * 4,
+		BlockAlign:    4,
+		BitsPerSample: 16,
+		DataSize:      w.dataSize,
+	}
+	copy(header.RIFF[:], "RIFF")
+	copy(header.WAVE[:], "WAVE")
+	copy(header.Fmt[:], "fmt ")
+	copy(header.Data[:], "data")
+	return binary.Write(w.writer, binary.LittleEndian, &header)
+}
+
+func (w *WAVWriter) Push(samples [][2]float64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.writer == nil || w.err != nil {
+		return
+	}
+	w.converted = w.resampler.Resample(samples, w.converted[:0])
+	var frame [4]byte
+	for _, sample := range w.converted {
+		binary.LittleEndian.PutUint16(frame[0:], uint16(toPCM(sample[0])))
+		binary.LittleEndian.PutUint16(frame[2:], uint16(toPCM(sample[1])))
+		if _, err := w.writer.Write(frame[:]); err != nil {
+			w.err = err
+			return
+		}
+		w.dataSize += 4
+	}
+}
+
+func toPCM(sample float64) int16 {
+	return int16(math.Max(-1, math.Min(1, sample)) * math.MaxInt16)
+}
+
+/*
+Complete the header with the final sizes and close the file.
+*/
+func (w *WAVWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	defer func() {
+		w.file.Close()
+		w.file = nil
+		w.writer = nil
+	}()
+
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return err
+	}
+	w.writer.Reset(w.file)
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
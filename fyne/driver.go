@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"image"
 	"log"
+	"sync"
+
 	"fyne.io/fyne"
 	"fyne.io/fyne/app"
 	"fyne.io/fyne/canvas"
 	"fyne.io/fyne/driver/desktop"
 
+	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/HFO4/gbc-in-cloud/util"
 )
 
@@ -21,6 +24,17 @@ type LCD struct {
 	inputStatus *byte
 	interrupt   bool
 	title       string
+
+	shift         bool
+	rewinding     bool
+	hotkeyHandler func(driver.Hotkey, int)
+	hotkeys       []pendingHotkey
+	hotkeyLock    sync.Mutex
+}
+
+type pendingHotkey struct {
+	key  driver.Hotkey
+	slot int
 }
 
 func (lcd *LCD) Init(pixels *[160][144][3]uint8, title string) {
@@ -33,7 +47,26 @@ func (lcd *LCD) InitStatus(statusPointer *byte) {
 	lcd.inputStatus = statusPointer
 }
 
+func (lcd *LCD) SetHotkeyHandler(handler func(driver.Hotkey, int)) {
+	lcd.hotkeyHandler = handler
+}
+
 func (lcd *LCD) UpdateInput() bool {
+	// Hotkeys are queued by the key callbacks and handled here, between two frames
+	lcd.hotkeyLock.Lock()
+	hotkeys := lcd.hotkeys
+	lcd.hotkeys = nil
+	rewinding := lcd.rewinding
+	lcd.hotkeyLock.Unlock()
+	if lcd.hotkeyHandler != nil {
+		for _, hotkey := range hotkeys {
+			lcd.hotkeyHandler(hotkey.key, hotkey.slot)
+		}
+		if rewinding {
+			lcd.hotkeyHandler(driver.HotkeyRewind, 0)
+		}
+	}
+
 	if lcd.interrupt {
 		lcd.interrupt = false
 
@@ -64,10 +97,15 @@ func (lcd *LCD) draw(w, h int) image.Image {
 				lcd.screen.Pix[i] = 0x30
 				lcd.screen.Pix[i+1] = 0x62
 				lcd.screen.Pix[i+2] = 0x30
-			} else {
+			} else if r == 0 && g == 0 && b == 0 {
 				lcd.screen.Pix[i] = 0x0f
 				lcd.screen.Pix[i+1] = 0x38
 				lcd.screen.Pix[i+2] = 0x0f
+			} else {
+				// Game Boy Color pixels are displayed as they are
+				lcd.screen.Pix[i] = r
+				lcd.screen.Pix[i+1] = g
+				lcd.screen.Pix[i+2] = b
 			}
 			lcd.screen.Pix[i+3] = 0xff
 
@@ -99,7 +137,52 @@ var keyMap = map[fyne.KeyName]byte{
 	fyne.KeyDown: 3,
 }
 
+// Function keys for the save state slots, Shift+Fn saves and Fn loads
+var stateSlotKeys = map[fyne.KeyName]int{
+	fyne.KeyF1: 1, fyne.KeyF2: 2, fyne.KeyF3: 3,
+	fyne.KeyF4: 4, fyne.KeyF5: 5, fyne.KeyF6: 6,
+	fyne.KeyF7: 7, fyne.KeyF8: 8, fyne.KeyF9: 9,
+}
+
+// Held to rewind
+const rewindKey = fyne.KeyR
+
+// Keys of the speed controls
+var speedKeys = map[fyne.KeyName]driver.Hotkey{
+	fyne.KeyP: driver.HotkeyPause,
+	fyne.KeyN: driver.HotkeyFrameAdvance,
+	fyne.KeyF: driver.HotkeyFaster,
+	fyne.KeyS: driver.HotkeySlower,
+	fyne.Key0: driver.HotkeyNormalSpeed,
+}
+
 func (lcd *LCD) buttonDown(ev *fyne.KeyEvent) {
+	if ev.Name == desktop.KeyShiftLeft || ev.Name == desktop.KeyShiftRight {
+		lcd.shift = true
+		return
+	}
+	if ev.Name == rewindKey {
+		lcd.hotkeyLock.Lock()
+		lcd.rewinding = true
+		lcd.hotkeyLock.Unlock()
+		return
+	}
+	if slot, ok := stateSlotKeys[ev.Name]; ok {
+		hotkey := pendingHotkey{driver.HotkeyLoadState, slot}
+		if lcd.shift {
+			hotkey.key = driver.HotkeySaveState
+		}
+		lcd.hotkeyLock.Lock()
+		lcd.hotkeys = append(lcd.hotkeys, hotkey)
+		lcd.hotkeyLock.Unlock()
+		return
+	}
+	if key, ok := speedKeys[ev.Name]; ok {
+		lcd.hotkeyLock.Lock()
+		lcd.hotkeys = append(lcd.hotkeys, pendingHotkey{key, 0})
+		lcd.hotkeyLock.Unlock()
+		return
+	}
 
 	var statusCopy byte
 	statusCopy = *lcd.inputStatus
@@ -112,6 +195,16 @@ func (lcd *LCD) buttonDown(ev *fyne.KeyEvent) {
 }
 
 func (lcd *LCD) buttonUp(ev *fyne.KeyEvent) {
+	if ev.Name == desktop.KeyShiftLeft || ev.Name == desktop.KeyShiftRight {
+		lcd.shift = false
+		return
+	}
+	if ev.Name == rewindKey {
+		lcd.hotkeyLock.Lock()
+		lcd.rewinding = false
+		lcd.hotkeyLock.Unlock()
+		return
+	}
 
 	var statusCopy byte
 	statusCopy = *lcd.inputStatus
@@ -0,0 +1,115 @@
+package gb
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Largest gzip stream unpacked, a tar archive holds a ROM and its headers
+const maxUnpackedSize = 2 * maxPatchedROMSize
+
+/*
+Read r up to limit bytes, a small archive may unpack to gigabytes.
+*/
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("archive content larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+/*
+Unpack a ROM stored in a zip, gzip or tar.gz archive. Archives are told by
+their content rather than their name, the first .gb or .gbc entry is used.
+Data which isn't an archive is returned as is.
+*/
+func unpackROM(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return unpackZip(data)
+	case bytes.HasPrefix(data, []byte{0x1F, 0x8B}):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		unpacked, err := readLimited(reader, maxUnpackedSize)
+		if err != nil {
+			return nil, err
+		}
+		if isTar(unpacked) {
+			return unpackTar(unpacked)
+		}
+		if len(unpacked) > maxPatchedROMSize {
+			return nil, fmt.Errorf("archive content larger than %d bytes", maxPatchedROMSize)
+		}
+		log.Println("[Core] ROM unpacked from gzip archive")
+		return unpacked, nil
+	case isTar(data):
+		return unpackTar(data)
+	}
+	return data, nil
+}
+
+func isROMName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".gb" || ext == ".gbc"
+}
+
+/*
+Tar archives have the "ustar" magic in the header of their first entry.
+*/
+func isTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+func unpackZip(data []byte) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !isROMName(file.Name) {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		log.Println("[Core] ROM unpacked from zip archive:", file.Name)
+		return readLimited(reader, maxPatchedROMSize)
+	}
+	return nil, errors.New("no .gb or .gbc file in zip archive")
+}
+
+func unpackTar(data []byte) ([]byte, error) {
+	archive := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, errors.New("no .gb or .gbc file in tar archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !header.FileInfo().Mode().IsRegular() || !isROMName(header.Name) {
+			continue
+		}
+		log.Println("[Core] ROM unpacked from tar archive:", header.Name)
+		return readLimited(archive, maxPatchedROMSize)
+	}
+}
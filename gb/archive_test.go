@@ -0,0 +1,78 @@
+package gb
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func gzipData(data []byte) []byte {
+	var out bytes.Buffer
+	writer := gzip.NewWriter(&out)
+	writer.Write(data)
+	writer.Close()
+	return out.Bytes()
+}
+
+func zipData(name string, data []byte) []byte {
+	var out bytes.Buffer
+	writer := zip.NewWriter(&out)
+	file, _ := writer.Create(name)
+	file.Write(data)
+	writer.Close()
+	return out.Bytes()
+}
+
+func tarData(name string, data []byte) []byte {
+	var out bytes.Buffer
+	writer := tar.NewWriter(&out)
+	writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+	writer.Write(data)
+	writer.Close()
+	return out.Bytes()
+}
+
+func TestUnpackROM(t *testing.T) {
+	rom := bytes.Repeat([]byte{0x12, 0x34}, 0x4000)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"raw", rom},
+		{"gzip", gzipData(rom)},
+		{"zip", zipData("game.gb", rom)},
+		{"tar", tarData("game.gbc", rom)},
+		{"tar.gz", gzipData(tarData("game.gb", rom))},
+	} {
+		got, err := unpackROM(c.data)
+		if err != nil || !bytes.Equal(got, rom) {
+			t.Errorf("%s: unpackROM = %d bytes, %v, want the ROM", c.name, len(got), err)
+		}
+	}
+	// A tar.gz archive of the largest ROM is larger than the ROM itself
+	if got, err := unpackROM(gzipData(tarData("game.gb", make([]byte, maxPatchedROMSize)))); err != nil || len(got) != maxPatchedROMSize {
+		t.Errorf("largest: unpackROM = %d bytes, %v, want %d bytes", len(got), err, maxPatchedROMSize)
+	}
+	if _, err := unpackROM(zipData("readme.txt", rom)); err == nil {
+		t.Error("unpackROM of a zip archive without ROM succeeded, want an error")
+	}
+}
+
+func TestUnpackROMTooLarge(t *testing.T) {
+	huge := make([]byte, maxPatchedROMSize+1)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"gzip", gzipData(huge)},
+		{"zip", zipData("game.gb", huge)},
+		{"tar.gz", gzipData(tarData("game.gb", huge))},
+		{"gzip bomb", gzipData(make([]byte, 2*maxUnpackedSize))},
+	} {
+		if _, err := unpackROM(c.data); err == nil {
+			t.Errorf("%s: unpackROM of a too large ROM succeeded, want an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package gb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// Sizes of the DMG and CGB boot ROM images
+const (
+	dmgBootROMSize = 0x100
+	cgbBootROMSize = 0x900
+)
+
+/*
+Load the boot ROM image. Its size tells which hardware is emulated,
+a CGB boot ROM also runs DMG games, in DMG compatibility mode.
+*/
+func (core *Core) loadBootROM() error {
+	data, err := ioutil.ReadFile(core.BootROMPath)
+	if err != nil {
+		return err
+	}
+	switch len(data) {
+	case dmgBootROMSize:
+		core.CGBHardware = false
+	case cgbBootROMSize:
+		core.CGBHardware = true
+	default:
+		return fmt.Errorf("boot ROM must be %d (DMG) or %d (CGB) bytes, got %d", dmgBootROMSize, cgbBootROMSize, len(data))
+	}
+	log.Printf("[Core] Boot ROM loaded, CGB hardware: %t\n", core.CGBHardware)
+	core.bootROM = data
+	core.BootROMMapped = true
+	// The CGB boot ROM itself uses CGB registers
+	core.CGBMode = core.CGBHardware
+	return nil
+}
+
+/*
+Whether a read from the given address is served by the boot ROM. The CGB
+boot ROM is mapped at 0000-00FF and 0200-08FF, the cartridge header at
+0100-01FF stays visible.
+*/
+func (core *Core) isBootROMAddress(address uint16) bool {
+	if !core.BootROMMapped {
+		return false
+	}
+	return address < 0x100 || (len(core.bootROM) == cgbBootROMSize && address >= 0x200 && address < cgbBootROMSize)
+}
+
+/*
+Reset the CPU and the I/O registers to their power on state, the boot ROM
+sets them up itself.
+*/
+func (core *Core) powerOn() {
+	core.CPU.Registers = Registers{}
+	core.CPU.Flags = Flags{}
+	for address := 0xFF01; address < 0xFF80; address++ {
+		core.Memory.MainMemory[address] = 0
+	}
+	core.Memory.MainMemory[0xFF07] = 0xF8
+	core.Memory.MainMemory[0xFF0F] = 0xE0
+	core.Memory.MainMemory[0xFFFF] = 0
+	core.Timer.SystemCounter = 0
+	// Powering the APU off clears its registers
+	core.Sound.Write(0xFF26, 0)
+}
+
+/*
+FF50 - BOOT - Writing a non-zero value unmaps the boot ROM.
+
+On CGB hardware, KEY0 (FF4C) written by the boot ROM tells whether the
+game runs in CGB mode or in DMG compatibility mode, where the colour
+palettes set up by the boot ROM colourise the monochrome palettes.
+*/
+func (core *Core) unmapBootROM() {
+	core.BootROMMapped = false
+	if core.CGBHardware {
+		core.CGBMode = core.Memory.MainMemory[0xFF4C]&0x0C != 0x04
+	}
+	log.Printf("[Core] Boot ROM unmapped, CGB mode: %t\n", core.CGBMode)
+}
@@ -0,0 +1,57 @@
+package gb
+
+/*
+Bus replaces the memory map of the Gameboy: when Core.Bus is set, every
+memory access of the CPU goes to it instead of the cartridge, VRAM, WRAM
+and IO registers.
+*/
+type Bus interface {
+	Read(address uint16) byte
+	Write(address uint16, data byte)
+}
+
+/*
+A memory access seen by a bus.
+*/
+type BusAccess struct {
+	Address uint16
+	Data    byte
+	Write   bool
+}
+
+/*
+Bus of 64KB of RAM, every address reads what was last written there.
+*/
+type FlatRAM struct {
+	Data [0x10000]byte
+	// Accesses are appended to Accesses while Record is set
+	Record   bool
+	Accesses []BusAccess
+}
+
+func (ram *FlatRAM) Read(address uint16) byte {
+	data := ram.Data[address]
+	if ram.Record {
+		ram.Accesses = append(ram.Accesses, BusAccess{Address: address, Data: data})
+	}
+	return data
+}
+
+func (ram *FlatRAM) Write(address uint16, data byte) {
+	ram.Data[address] = data
+	if ram.Record {
+		ram.Accesses = append(ram.Accesses, BusAccess{Address: address, Data: data, Write: true})
+	}
+}
+
+/*
+Create a core with only a CPU, wired to the bus, to embed the CPU or test
+it. There is no cartridge, graphics, sound or timer: instructions are
+executed with ExecuteOPCode or ExecuteNextOPCode, Step and RunFrame can't
+be used.
+*/
+func NewBusCore(bus Bus) *Core {
+	core := &Core{Bus: bus}
+	core.initCB()
+	return core
+}
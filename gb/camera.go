@@ -0,0 +1,189 @@
+package gb
+
+import (
+	"image"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+====================================
+
+	POCKET CAMERA
+
+The Game Boy Camera mapper has 128KBytes of RAM and the registers of a
+M64282FP image sensor, mapped at A000-A07F when bit 4 of the RAM bank
+number is set:
+
+	A000  Bit 0 - Start capture, reads 1 while capturing
+	A001  Bit 7 - N, Bit 5-6 - VH edge mode, Bit 0-4 - Gain
+	A002  Exposure time, high byte
+	A003  Exposure time, low byte
+	A004  Bit 4-6 - Edge enhancement ratio, Bit 3 - Invert, Bit 0-2 - Reference voltage
+	A005  Zero point calibration
+	A006-A035  4x4 dithering matrix, 3 thresholds for each pixel
+
+Only A000 can be read, the other registers read 00h. A capture writes
+the 128x112 picture as 16x14 tiles at A100-AEFF of RAM bank 0.
+
+Pictures come from an image source instead of a real sensor, so the gain,
+the reference voltages and the invert flag of the analog side are not
+emulated. Captures complete immediately.
+*/
+type PocketCamera struct {
+	rom            []byte
+	CurrentROMBank byte
+	RAMBank        []byte
+	CurrentRAMBank byte
+	EnableRAM      bool
+	// Whether the sensor registers are mapped at A000-BFFF
+	RegistersMapped bool
+	Registers       [0x36]byte
+
+	source driver.ImageSource
+}
+
+const (
+	// The camera always has 128KBytes of RAM, whatever its header says
+	cameraRAMSize = 0x20000
+	// Exposure time showing the source pictures with their original brightness
+	cameraNeutralExposure = 0x1000
+	// Offset of the picture in RAM bank 0
+	cameraPictureOffset = 0x100
+)
+
+// Edge enhancement ratios in quarters: 0.5, 0.75, 1, 1.25, 2, 3, 4, 5
+var cameraEdgeRatios = [8]int{2, 3, 4, 5, 8, 12, 16, 20}
+
+func (mbc *PocketCamera) ReadRomBank(address uint16) byte {
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
+}
+
+func (mbc *PocketCamera) ReadRom(address uint16) byte {
+	return readRomBank(mbc.rom, 0, address)
+}
+
+/*
+The RAM can be read even when it is not enabled, enabling it only allows
+writing.
+*/
+func (mbc *PocketCamera) ReadRamBank(address uint16) byte {
+	if mbc.RegistersMapped {
+		if address&0x7F == 0 {
+			return mbc.Registers[0] & 0x7
+		}
+		return 0x00
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
+}
+
+func (mbc *PocketCamera) WriteRamBank(address uint16, data byte) {
+	if mbc.RegistersMapped {
+		register := address & 0x7F
+		if register >= uint16(len(mbc.Registers)) {
+			return
+		}
+		mbc.Registers[register] = data
+		if register == 0 && util.TestBit(data, 0) {
+			mbc.capture()
+			mbc.Registers[0] = util.ClearBit(mbc.Registers[0], 0)
+		}
+		return
+	}
+	if mbc.EnableRAM {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
+	}
+}
+
+func (mbc *PocketCamera) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		/*
+			0000-1FFF - RAM Write Enable (Write Only)
+		*/
+		mbc.EnableRAM = val&0xF == 0xA
+	} else if (address >= 0x2000) && (address < 0x4000) {
+		/*
+			2000-3FFF - ROM Bank Number (Write Only)
+				6bit ROM bank number, writing 00h maps bank 00h.
+		*/
+		mbc.CurrentROMBank = val & 0x3F
+	} else if (address >= 0x4000) && (address < 0x6000) {
+		/*
+			4000-5FFF - RAM Bank Number (Write Only)
+				Bit 0-3 select the RAM bank, setting bit 4 maps the
+				sensor registers instead.
+		*/
+		mbc.RegistersMapped = util.TestBit(val, 4)
+		mbc.CurrentRAMBank = val & 0xF
+	}
+}
+
+func (mbc *PocketCamera) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
+}
+
+func (mbc *PocketCamera) RAM() []byte {
+	return mbc.RAMBank
+}
+
+/*
+Take a picture from the image source, process it like the sensor does
+and store it into RAM bank 0.
+*/
+func (mbc *PocketCamera) capture() {
+	var frame *image.Gray
+	if mbc.source != nil {
+		frame = mbc.source.Frame()
+	}
+	exposure := int(mbc.Registers[2])<<8 | int(mbc.Registers[3])
+	sensor := func(x, y int) int {
+		if frame == nil {
+			return 0
+		}
+		x = clampInt(x, 0, driver.CameraWidth-1)
+		y = clampInt(y, 0, driver.CameraHeight-1)
+		return int(frame.GrayAt(x, y).Y) * exposure / cameraNeutralExposure
+	}
+	// 2D edge enhancement, when N is set and both VH bits are set
+	edge := mbc.Registers[1]&0xE0 == 0xE0
+	ratio := cameraEdgeRatios[(mbc.Registers[4]>>4)&0x7]
+
+	for y := 0; y < driver.CameraHeight; y++ {
+		for x := 0; x < driver.CameraWidth; x++ {
+			value := sensor(x, y)
+			if edge {
+				value += (4*value - sensor(x-1, y) - sensor(x+1, y) - sensor(x, y-1) - sensor(x, y+1)) * ratio / 4
+			}
+
+			// Brighter than more thresholds of the pixel's matrix entry means a lighter colour
+			thresholds := mbc.Registers[6+((y&3)*4+(x&3))*3:]
+			colour := 0
+			for i := 2; i >= 0; i-- {
+				if value < int(thresholds[i]) {
+					colour = 3 - i
+				}
+			}
+
+			offset := cameraPictureOffset + ((y/8)*16+x/8)*16 + (y&7)*2
+			bit := uint(7 - x&7)
+			mbc.RAMBank[offset] = mbc.RAMBank[offset]&^(1<<bit) | byte(colour&1)<<bit
+			mbc.RAMBank[offset+1] = mbc.RAMBank[offset+1]&^(1<<bit) | byte(colour>>1)<<bit
+		}
+	}
+}
+
+func clampInt(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+/*
+		POCKET CAMERA  END
+	====================================
+*/
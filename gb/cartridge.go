@@ -2,8 +2,11 @@ package gb
 
 import (
 	"bufio"
+	"bytes"
+	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/HFO4/gbc-in-cloud/util"
 )
@@ -23,7 +26,7 @@ import (
 0Fh  MBC3+TIMER+BATTERY       FDh  BANDAI TAMA5
 10h  MBC3+TIMER+RAM+BATTERY   FEh  HuC3
 11h  MBC3                     FFh  HuC1+RAM+BATTERY
-12h  MBC3+RAM
+12h  MBC3+RAM                 22h  MBC7+SENSOR+RUMBLE+RAM+BATTERY
 */
 var cartridgeTypeMap = map[byte]string{
 	byte(0x00): "ROM ONLY",
@@ -51,6 +54,7 @@ var cartridgeTypeMap = map[byte]string{
 	byte(0x1C): "MBC5+RUMBLE",
 	byte(0x1D): "MBC5+RUMBLE+RAM",
 	byte(0x1E): "MBC5+RUMBLE+RAM+BATTERY",
+	byte(0x22): "MBC7+SENSOR+RUMBLE+RAM+BATTERY",
 	byte(0xFC): "POCKET CAMERA",
 	byte(0xFD): "BANDAI TAMA5",
 	byte(0xFE): "HuC3",
@@ -64,7 +68,7 @@ ROM bank number is linked to the ROM Size byte (0148).
 
 0x00 means no bank required.
 */
-var RomBankMap = map[byte]uint8{
+var RomBankMap = map[byte]uint16{
 	byte(0x00): 2,
 	byte(0x01): 4,
 	byte(0x02): 8,
@@ -72,6 +76,8 @@ var RomBankMap = map[byte]uint8{
 	byte(0x04): 32,
 	byte(0x05): 64,
 	byte(0x06): 128,
+	byte(0x07): 256,
+	byte(0x08): 512,
 	byte(0x52): 72,
 	byte(0x53): 80,
 	byte(0x54): 96,
@@ -89,11 +95,15 @@ var RamBankMap = map[byte]uint8{
 	byte(0x01): 1,
 	byte(0x02): 1,
 	byte(0x03): 4,
+	byte(0x04): 16,
+	byte(0x05): 8,
 }
 
 type Cartridge struct {
 	Props *CartridgeProps
 	MBC   MBC
+	// ROM data, shared with the MBC
+	rom []byte
 }
 
 /*
@@ -102,8 +112,10 @@ Cartridge props
 type CartridgeProps struct {
 	MBCType   string
 	ROMLength int
-	ROMBank   uint8
+	ROMBank   uint16
 	RAMBank   uint8
+	// CRC32 of the whole ROM, used to match save states with their game
+	Checksum uint32
 }
 
 type MBC interface {
@@ -112,40 +124,67 @@ type MBC interface {
 	ReadRamBank(uint16) byte
 	WriteRamBank(uint16, byte)
 	HandleBanking(uint16, byte)
-	SaveRam(string)
+	SaveRam(string) error
+	// The external RAM, or the EEPROM of MBC7 cartridges, nil if there is none
+	RAM() []byte
+}
+
+/*
+Read a byte from a 16KByte ROM bank. Bank numbers wrap around the ROM size,
+as the upper bank number bits are not connected on smaller ROMs.
+*/
+func readRomBank(rom []byte, bank int, address uint16) byte {
+	return rom[(bank*0x4000+int(address&0x3FFF))%len(rom)]
+}
+
+/*
+Offset of an A000-BFFF address in the external RAM. Bank numbers wrap
+around the RAM size, and a 2KByte RAM is mirrored all over the bank.
+*/
+func ramOffset(ram []byte, bank int, address uint16) int {
+	return (bank*0x2000 + int(address&0x1FFF)) % len(ram)
 }
 
 /*
 ====================================
 Single ROM without MBC
+
+ROM+RAM cartridges (types 08h and 09h) add up to 8KBytes of RAM at
+A000-BFFF, enabled like the RAM of MBC1 by writing 0Ah to 0000-1FFF.
 */
 type MBCRom struct {
 	// ROM data
 	rom []byte
 	// Current ROM-Bank number
 	CurrentROMBank byte
-	RAMBank        [0x8000]byte
+	RAMBank        []byte
 	// Current RAM-Bank number
 	CurrentRAMBank byte
 	EnableRAM      bool
+	// Whether the RAM is battery buffered, type 09h
+	battery bool
 }
 
 /*
 *
 Read a byte from RAM bank.
-In ROM only cartridge, RAM is not supported.
+Without RAM, or while it is disabled, reads return FFh.
 */
 func (mbc *MBCRom) ReadRamBank(address uint16) byte {
-	return byte(0x00)
+	if !mbc.EnableRAM || len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
 }
 
 /*
 *
 Write a byte from RAM bank.
-In ROM only cartridge, RAM is not supported.
 */
 func (mbc *MBCRom) WriteRamBank(address uint16, data byte) {
-
+	if mbc.EnableRAM && len(mbc.RAMBank) > 0 {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
+	}
 }
 
 /*
@@ -154,7 +193,7 @@ Read a byte from ROM bank.
 In ROM only cartridge, ROM banking is not supported.
 */
 func (mbc *MBCRom) ReadRomBank(address uint16) byte {
-	return mbc.rom[address]
+	return readRomBank(mbc.rom, 1, address)
 }
 
 /*
@@ -162,13 +201,24 @@ func (mbc *MBCRom) ReadRomBank(address uint16) byte {
 Read a byte from raw rom via address
 */
 func (mbc *MBCRom) ReadRom(address uint16) byte {
-	return mbc.rom[address]
+	return readRomBank(mbc.rom, 0, address)
 }
 
 func (mbc *MBCRom) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		mbc.EnableRAM = val&0xF == 0xA
+	}
 }
 
-func (mbc *MBCRom) SaveRam(path string) {
+func (mbc *MBCRom) SaveRam(path string) error {
+	if !mbc.battery {
+		return nil
+	}
+	return writeRamFile(path, mbc.RAMBank)
+}
+
+func (mbc *MBCRom) RAM() []byte {
+	return mbc.RAMBank
 }
 
 /*	Single ROM without MBC  END
@@ -181,12 +231,35 @@ func (mbc *MBCRom) SaveRam(path string) {
 	MBC1
 */
 type MBC1 struct {
-	rom            []byte
+	rom     []byte
+	RAMBank []byte
+	// BANK1 register, lower 5 bits of the ROM bank number
 	CurrentROMBank byte
-	RAMBank        []byte
+	// BANK2 register, RAM bank number or upper 2 bits of the ROM bank number
 	CurrentRAMBank byte
 	EnableRAM      bool
-	ROMBankingMode bool
+	// Mode 1, BANK2 also applies to 0000-3FFF and to the RAM
+	RAMBankingMode bool
+	// MBC1M multicart, BANK2 is wired to bit 4-5 of the ROM bank number
+	multicart bool
+}
+
+/*
+MBC1M multicarts are 1MByte cartridges holding several games, each of them
+has its own header at the start of a 256KByte block.
+*/
+func isMBC1Multicart(rom []byte) bool {
+	return len(rom) == 0x100000 && bytes.Equal(rom[0x104:0x134], rom[0x40104:0x40134])
+}
+
+/*
+Bit of the ROM bank number BANK2 is wired to.
+*/
+func (mbc *MBC1) bank2Shift() uint {
+	if mbc.multicart {
+		return 4
+	}
+	return 5
 }
 
 /*
@@ -198,8 +271,11 @@ type MBC1 struct {
 	125 banks.
 */
 func (mbc *MBC1) ReadRomBank(address uint16) byte {
-	newAddress := uint32(address - 0x4000)
-	return mbc.rom[newAddress+uint32(mbc.CurrentROMBank)*0x4000]
+	bank1 := mbc.CurrentROMBank
+	if mbc.multicart {
+		bank1 &= 0xF
+	}
+	return readRomBank(mbc.rom, int(mbc.CurrentRAMBank)<<mbc.bank2Shift()|int(bank1), address)
 }
 
 /*
@@ -212,19 +288,39 @@ A000-BFFF - RAM Bank 00-03, if any (Read/Write)
 	8KByte (at A000-BFFF), and 32KByte (in form of four 8K banks at A000-BFFF).
 */
 func (mbc *MBC1) ReadRamBank(address uint16) byte {
-	newAddress := uint32(address - 0xA000)
-	return mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)]
+	if !mbc.EnableRAM || len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, mbc.ramBank(), address)]
 }
 
 func (mbc *MBC1) WriteRamBank(address uint16, data byte) {
-	if mbc.EnableRAM {
-		newAddress := uint32(address - 0xA000)
-		mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)] = data
+	if mbc.EnableRAM && len(mbc.RAMBank) > 0 {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, mbc.ramBank(), address)] = data
+	}
+}
+
+/*
+Only RAM bank 00h can be used in mode 0.
+*/
+func (mbc *MBC1) ramBank() int {
+	if mbc.RAMBankingMode {
+		return int(mbc.CurrentRAMBank)
 	}
+	return 0
 }
 
+/*
+0000-3FFF - ROM Bank 00 (Read Only)
+
+	In mode 1, BANK2 also selects the bank mapped here: 00h, 20h, 40h or 60h
+	(00h, 10h, 20h or 30h on MBC1M multicarts).
+*/
 func (mbc *MBC1) ReadRom(address uint16) byte {
-	return mbc.rom[address]
+	if mbc.RAMBankingMode {
+		return readRomBank(mbc.rom, int(mbc.CurrentRAMBank)<<mbc.bank2Shift(), address)
+	}
+	return readRomBank(mbc.rom, 0, address)
 }
 
 func (mbc *MBC1) HandleBanking(address uint16, val byte) {
@@ -264,12 +360,7 @@ func (mbc *MBC1) HandleBanking(address uint16, val byte) {
 				from 00-03h, or to specify the upper two bits (Bit 5-6) of the
 				ROM Bank number, depending on the current ROM/RAM Mode. (See below.)
 		*/
-		if mbc.ROMBankingMode {
-			mbc.DoChangeHiRomBank(val)
-		} else {
-			mbc.DoRAMBankChange(val)
-		}
-
+		mbc.DoRAMBankChange(val)
 	} else if (address >= 0x6000) && (address < 0x8000) {
 		/*
 			6000-7FFF - ROM/RAM Mode Select (Write Only)
@@ -286,32 +377,14 @@ func (mbc *MBC1) HandleBanking(address uint16, val byte) {
 }
 
 func (mbc *MBC1) DoRamBankEnable(address uint16, val byte) {
-	testData := val & 0xF
-	if testData == 0xA {
-		mbc.EnableRAM = true
-	} else if testData == 0x0 {
-		mbc.EnableRAM = false
-	}
+	mbc.EnableRAM = val&0xF == 0xA
 }
 
 func (mbc *MBC1) DoChangeLoROMBank(val byte) {
-	lower5 := val & 31
-	mbc.CurrentROMBank &= 224
-	mbc.CurrentROMBank |= lower5
+	// 00h is translated to 01h before the unused upper bits are discarded
+	mbc.CurrentROMBank = val & 0x1F
 	if mbc.CurrentROMBank == 0 {
-		mbc.CurrentROMBank++
-	}
-}
-
-func (mbc *MBC1) DoChangeHiRomBank(val byte) {
-	// turn off the upper 3 bits of the current rom
-	mbc.CurrentROMBank &= 31
-
-	// turn off the lower 5 bits of the data
-	val &= 224
-	mbc.CurrentROMBank |= val
-	if mbc.CurrentROMBank == 0 {
-		mbc.CurrentROMBank++
+		mbc.CurrentROMBank = 1
 	}
 }
 
@@ -320,19 +393,15 @@ func (mbc *MBC1) DoRAMBankChange(val byte) {
 }
 
 func (mbc *MBC1) DoChangeROMRAMMode(val byte) {
-	newData := val & 0x1
-	if newData == 0 {
-		mbc.ROMBankingMode = true
-	} else {
-		mbc.ROMBankingMode = false
-	}
-	if mbc.ROMBankingMode {
-		mbc.CurrentRAMBank = 0
-	}
+	mbc.RAMBankingMode = util.TestBit(val, 0)
 }
 
-func (mbc *MBC1) SaveRam(path string) {
-	writeRamFile(path, mbc.RAMBank)
+func (mbc *MBC1) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
+}
+
+func (mbc *MBC1) RAM() []byte {
+	return mbc.RAMBank
 }
 
 /*
@@ -348,37 +417,57 @@ func (mbc *MBC1) SaveRam(path string) {
 type MBC2 struct {
 	rom            []byte
 	CurrentROMBank byte
-	RAMBank        []byte
-	CurrentRAMBank byte
-	EnableRAM      bool
-	ROMBankingMode bool
+	// Built-in 512x4bits RAM, only the lower 4 bits of each byte are used
+	RAMBank   []byte
+	EnableRAM bool
 }
 
+// Size of the MBC2 built-in RAM
+const mbc2RAMSize = 0x200
+
 func (mbc *MBC2) ReadRomBank(address uint16) byte {
-	newAddress := uint32(address - 0x4000)
-	return mbc.rom[newAddress+uint32(mbc.CurrentROMBank)*0x4000]
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
 }
 
+/*
+A000-A1FF - 512x4bits RAM, built-in into the MBC2 chip (Read/Write)
+
+	The MBC2 doesn't support external RAM, instead it includes 512x4 bits of
+	built-in RAM (in the MBC2 chip itself). Only the lower 4 bits of the "bytes"
+	in this memory area are used, the upper 4 bits read as 1. The RAM is
+	mirrored all over A000-BFFF.
+*/
 func (mbc *MBC2) ReadRamBank(address uint16) byte {
-	newAddress := uint32(address - 0xA000)
-	return mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)]
+	if !mbc.EnableRAM {
+		return 0xFF
+	}
+	return mbc.RAMBank[address&(mbc2RAMSize-1)] | 0xF0
 }
 
 func (mbc *MBC2) WriteRamBank(address uint16, data byte) {
 	if mbc.EnableRAM {
-		newAddress := uint32(address - 0xA000)
-		mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)] = data
+		mbc.RAMBank[address&(mbc2RAMSize-1)] = data & 0xF
 	}
 }
 
 func (mbc *MBC2) ReadRom(address uint16) byte {
-	return mbc.rom[address]
+	return readRomBank(mbc.rom, 0, address)
 }
+
+/*
+0000-3FFF - RAM Enable and ROM Bank Number (Write Only)
+
+	Bit 8 of the address selects the register being written: if it is
+	cleared the value controls the RAM enable, otherwise it selects the
+	ROM bank. Both registers are mirrored all over 0000-3FFF.
+*/
 func (mbc *MBC2) HandleBanking(address uint16, val byte) {
-	// do RAM enabling
-	if address < 0x2000 {
+	if address >= 0x4000 {
+		return
+	}
+	if !util.TestBit(byte(address>>8), 0) {
 		/*
-			0000-1FFF - RAM Enable (Write Only)
+			RAM Enable
 				The least significant bit of the upper address byte must be zero
 				to enable/disable cart RAM. For example the following addresses can be
 				used to enable/disable cart RAM: 0000-00FF, 0200-02FF, 0400-04FF, ...,
@@ -388,77 +477,33 @@ func (mbc *MBC2) HandleBanking(address uint16, val byte) {
 
 		*/
 		mbc.DoRamBankEnable(address, val)
-	} else if (address >= 0x2000) && (address < 0x4000) {
+	} else {
 		/*
-			2000-3FFF - ROM Bank Number (Write Only)
+			ROM Bank Number
 				Writing a value (XXXXBBBB - X = Don't cares, B = bank select bits)
 				into 2000-3FFF area will select an appropriate ROM bank at 4000-7FFF.
 		*/
 		mbc.DoChangeLoROMBank(val)
-
-	} else if (address >= 0x4000) && (address < 0x6000) {
-		if mbc.ROMBankingMode {
-			mbc.DoChangeHiRomBank(val)
-		} else {
-			mbc.DoRAMBankChange(val)
-		}
-
-	} else if (address >= 0x6000) && (address < 0x8000) {
-		mbc.DoChangeROMRAMMode(val)
 	}
 }
 
 func (mbc *MBC2) DoRamBankEnable(address uint16, val byte) {
-
-	if util.TestBit(byte(address&0xFF), 4) == true {
-		return
-	}
-
-	testData := val & 0xF
-	if testData == 0xA {
-		mbc.EnableRAM = true
-	} else if testData == 0x0 {
-		mbc.EnableRAM = false
-	}
+	mbc.EnableRAM = val&0xF == 0xA
 }
 
 func (mbc *MBC2) DoChangeLoROMBank(val byte) {
 	mbc.CurrentROMBank = val & 0xF
 	if mbc.CurrentROMBank == 0 {
-		mbc.CurrentROMBank++
+		mbc.CurrentROMBank = 1
 	}
 }
 
-func (mbc *MBC2) DoChangeHiRomBank(val byte) {
-	// turn off the upper 3 bits of the current rom
-	mbc.CurrentROMBank &= 31
-
-	// turn off the lower 5 bits of the data
-	val &= 224
-	mbc.CurrentROMBank |= val
-	if mbc.CurrentROMBank == 0 {
-		mbc.CurrentROMBank++
-	}
+func (mbc *MBC2) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
 }
 
-func (mbc *MBC2) DoRAMBankChange(val byte) {
-	mbc.CurrentRAMBank = val & 0x3
-}
-
-func (mbc *MBC2) DoChangeROMRAMMode(val byte) {
-	newData := val & 0x1
-	if newData == 0 {
-		mbc.ROMBankingMode = true
-	} else {
-		mbc.ROMBankingMode = false
-	}
-	if mbc.ROMBankingMode {
-		mbc.CurrentRAMBank = 0
-	}
-}
-
-func (mbc *MBC2) SaveRam(path string) {
-	writeRamFile(path, mbc.RAMBank)
+func (mbc *MBC2) RAM() []byte {
+	return mbc.RAMBank
 }
 
 /*
@@ -478,40 +523,50 @@ type MBC3 struct {
 	CurrentRAMBank byte
 	EnableRAM      bool
 
-	rtc        []byte
-	latchedRtc []byte
-	latched    bool
+	// Whether the cartridge has the real time clock (MBC3+TIMER)
+	hasRTC bool
+	RTC    RTC
+	// RTC registers 08h-0Ch as of the last latch
+	LatchedRTC [5]byte
+	// Last value written to the latch register, the clock is latched on a 00h->01h sequence
+	LatchValue byte
 }
 
 func (mbc *MBC3) ReadRomBank(address uint16) byte {
-	newAddress := uint32(address - 0x4000)
-	return mbc.rom[newAddress+uint32(mbc.CurrentROMBank)*0x4000]
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
 }
 
 func (mbc *MBC3) ReadRamBank(address uint16) byte {
-	if mbc.CurrentRAMBank >= 0x4 {
-		if mbc.latched {
-			return mbc.latchedRtc[mbc.CurrentRAMBank]
+	if !mbc.EnableRAM {
+		return 0xFF
+	}
+	if mbc.CurrentRAMBank >= 0x08 {
+		// Reading the RTC registers always returns the latched time
+		if !mbc.hasRTC || mbc.CurrentRAMBank > 0x0C {
+			return 0xFF
 		}
-		return mbc.rtc[mbc.CurrentRAMBank]
+		return mbc.LatchedRTC[mbc.CurrentRAMBank-0x08]
 	}
-	newAddress := uint32(address - 0xA000)
-	return mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)]
+	if len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
 }
 
 func (mbc *MBC3) WriteRamBank(address uint16, data byte) {
 	if mbc.EnableRAM {
-		if mbc.CurrentRAMBank >= 0x4 {
-			mbc.rtc[mbc.CurrentRAMBank] = data
-		} else {
-			newAddress := uint32(address - 0xA000)
-			mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)] = data
+		if mbc.CurrentRAMBank >= 0x08 {
+			if mbc.hasRTC {
+				mbc.RTC.write(mbc.CurrentRAMBank, data, time.Now().Unix())
+			}
+		} else if len(mbc.RAMBank) > 0 {
+			mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
 		}
 	}
 }
 
 func (mbc *MBC3) ReadRom(address uint16) byte {
-	return mbc.rom[address]
+	return readRomBank(mbc.rom, 0, address)
 }
 func (mbc *MBC3) HandleBanking(address uint16, val byte) {
 	if address < 0x2000 {
@@ -559,47 +614,41 @@ func (mbc *MBC3) HandleBanking(address uint16, val byte) {
 }
 
 func (mbc *MBC3) DoRamBankEnable(address uint16, val byte) {
-	testData := val & 0xA
-	if testData != 0 {
-		mbc.EnableRAM = true
-	} else if testData == 0x0 {
-		mbc.EnableRAM = false
-	}
+	mbc.EnableRAM = val&0xF == 0xA
 }
 
 func (mbc *MBC3) DoChangeLoROMBank(val byte) {
-	lower5 := val & 0x7F
-	mbc.CurrentROMBank = lower5
-	mbc.CurrentROMBank |= lower5
+	mbc.CurrentROMBank = val & 0x7F
 	if mbc.CurrentROMBank == 0x00 {
-		mbc.CurrentROMBank++
+		mbc.CurrentROMBank = 1
 	}
 }
 
-func (mbc *MBC3) DoChangeHiRomBank(val byte) {
-	// turn off the upper 3 bits of the current rom
-	mbc.CurrentROMBank &= 31
-
-	// turn off the lower 5 bits of the data
-	val &= 224
-	mbc.CurrentROMBank |= val
-}
-
 func (mbc *MBC3) DoRAMBankChange(val byte) {
-	mbc.CurrentRAMBank = val
+	mbc.CurrentRAMBank = val & 0xF
 }
 
 func (mbc *MBC3) DoChangeROMRAMMode(val byte) {
-	if val == 0x1 {
-		mbc.latched = false
-	} else if val == 0x0 {
-		mbc.latched = true
-		copy(mbc.rtc, mbc.latchedRtc)
+	if mbc.LatchValue == 0x00 && val == 0x01 {
+		mbc.RTC.update(time.Now().Unix())
+		mbc.LatchedRTC = mbc.RTC.registers()
+	}
+	mbc.LatchValue = val
+}
+
+/*
+The RTC state is saved after the RAM, in the 48 bytes footer format
+used by most emulators.
+*/
+func (mbc *MBC3) SaveRam(path string) error {
+	if !mbc.hasRTC {
+		return writeRamFile(path, mbc.RAMBank)
 	}
+	return writeRamFile(path, append(append([]byte{}, mbc.RAMBank...), mbc.RTC.footer(mbc.LatchedRTC, time.Now().Unix())...))
 }
 
-func (mbc *MBC3) SaveRam(path string) {
-	writeRamFile(path, mbc.RAMBank)
+func (mbc *MBC3) RAM() []byte {
+	return mbc.RAMBank
 }
 
 /*
@@ -619,31 +668,33 @@ type MBC5 struct {
 	RAMBank          []byte
 	CurrentRAMBank   byte
 	EnableRAM        bool
+	// Whether the cartridge has a rumble motor, driven by bit 3 of the RAM bank register
+	rumble bool
 }
 
 func (mbc *MBC5) ReadRomBank(address uint16) byte {
-	newAddress := uint32(address - 0x4000)
-	romBank := uint32(mbc.CurrentROMBankLo)
+	romBank := int(mbc.CurrentROMBankLo)
 	if mbc.CurrentROMBankHi {
 		romBank += 0x100
 	}
-	return mbc.rom[newAddress+romBank*0x4000]
+	return readRomBank(mbc.rom, romBank, address)
 }
 
 func (mbc *MBC5) ReadRamBank(address uint16) byte {
-	newAddress := uint32(address - 0xA000)
-	return mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)]
+	if !mbc.EnableRAM || len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
 }
 
 func (mbc *MBC5) WriteRamBank(address uint16, data byte) {
-	if mbc.EnableRAM {
-		newAddress := uint32(address - 0xA000)
-		mbc.RAMBank[newAddress+(uint32(mbc.CurrentRAMBank)*0x2000)] = data
+	if mbc.EnableRAM && len(mbc.RAMBank) > 0 {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
 	}
 }
 
 func (mbc *MBC5) ReadRom(address uint16) byte {
-	return mbc.rom[address]
+	return readRomBank(mbc.rom, 0, address)
 }
 func (mbc *MBC5) HandleBanking(address uint16, val byte) {
 	if address < 0x2000 {
@@ -681,12 +732,8 @@ func (mbc *MBC5) HandleBanking(address uint16, val byte) {
 }
 
 func (mbc *MBC5) DoRamBankEnable(address uint16, val byte) {
-	testData := val & 0xA
-	if testData != 0 {
-		mbc.EnableRAM = true
-	} else if testData == 0x0 {
-		mbc.EnableRAM = false
-	}
+	// Unlike MBC1, MBC5 checks all 8 bits
+	mbc.EnableRAM = val == 0x0A
 }
 
 func (mbc *MBC5) DoChangeLoROMBank(val byte) {
@@ -694,15 +741,24 @@ func (mbc *MBC5) DoChangeLoROMBank(val byte) {
 }
 
 func (mbc *MBC5) DoChangeHiRomBank(val byte) {
-	mbc.CurrentROMBankHi = val > 0x0
+	mbc.CurrentROMBankHi = util.TestBit(val, 0)
 }
 
 func (mbc *MBC5) DoRAMBankChange(val byte) {
-	mbc.CurrentRAMBank = val
+	if mbc.rumble {
+		// Bit 3 drives the rumble motor instead of selecting a RAM bank
+		mbc.CurrentRAMBank = val & 0x7
+		return
+	}
+	mbc.CurrentRAMBank = val & 0xF
+}
+
+func (mbc *MBC5) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
 }
 
-func (mbc *MBC5) SaveRam(path string) {
-	writeRamFile(path, mbc.RAMBank)
+func (mbc *MBC5) RAM() []byte {
+	return mbc.RAMBank
 }
 
 /*
@@ -713,11 +769,11 @@ func (mbc *MBC5) SaveRam(path string) {
 /*
 Read cartridge data from file
 */
-func (core *Core) readRomFile(romPath string) []byte {
+func (core *Core) readRomFile(romPath string) ([]byte, error) {
 	return readDataFile(romPath, false)
 }
 
-func readDataFile(path string, ram bool) []byte {
+func readDataFile(path string, ram bool) ([]byte, error) {
 	name := "rom"
 	if ram {
 		name = "ram"
@@ -726,42 +782,59 @@ func readDataFile(path string, ram bool) []byte {
 	romFile, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) && ram {
-			return nil
+			return nil, nil
 		}
 
-		log.Fatal(err)
+		return nil, err
 	}
 	defer romFile.Close()
 
 	stats, statsErr := romFile.Stat()
 	if statsErr != nil {
-		log.Fatal(statsErr)
+		return nil, statsErr
 	}
 	var size int64 = stats.Size()
 	bytes := make([]byte, size)
 
 	bufReader := bufio.NewReader(romFile)
-	_, err = bufReader.Read(bytes)
+	_, err = io.ReadFull(bufReader, bytes)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Println("[Core]", size, "Bytes", name, "loaded")
-	return bytes
+	return bytes, nil
 }
 
-func (core *Core) readRamFile(ramPath string) []byte {
+func (core *Core) readRamFile(ramPath string) ([]byte, error) {
 	return readDataFile(ramPath, true)
 }
 
-func writeRamFile(ramPath string, data []byte) {
+/*
+Fit the RAM loaded from the save file to the RAM size of the cartridge,
+older versions always saved 32KBytes regardless of the cartridge.
+*/
+func fitRamData(data []byte, size int) []byte {
+	ram := make([]byte, size)
+	copy(ram, data)
+	return ram
+}
+
+func writeRamFile(ramPath string, data []byte) error {
 	ramFile, err := os.Create(ramPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer ramFile.Close()
 
 	bufWriter := bufio.NewWriter(ramFile)
 	size, err := bufWriter.Write(data)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err = bufWriter.Flush(); err != nil {
+		return err
 	}
 	log.Printf("[Core] %d Bytes ram written\n", size)
+	return nil
 }
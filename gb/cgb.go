@@ -0,0 +1,175 @@
+package gb
+
+import (
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+CGB colour palette memory.
+
+	FF68 - BCPS/BGPI - Background Palette Index
+	FF69 - BCPD/BGPD - Background Palette Data
+	FF6A - OCPS/OBPI - Sprite Palette Index
+	FF6B - OCPD/OBPD - Sprite Palette Data
+
+The palette memory holds 8 palettes of 4 colours, each colour is stored
+as two bytes in little endian RGB555:
+
+	Bit 0-4   Red Intensity   (00-1F)
+	Bit 5-9   Green Intensity (00-1F)
+	Bit 10-14 Blue Intensity  (00-1F)
+*/
+type ColourPalette struct {
+	Data [64]byte
+	// Bit 0-5 of the index register
+	Index byte
+	// Bit 7 of the index register, increment Index after each write to the data register
+	AutoIncrement bool
+}
+
+func (palette *ColourPalette) readIndex() byte {
+	res := palette.Index | 0x40
+	if palette.AutoIncrement {
+		res |= 0x80
+	}
+	return res
+}
+
+func (palette *ColourPalette) writeIndex(val byte) {
+	palette.Index = val & 0x3F
+	palette.AutoIncrement = util.TestBit(val, 7)
+}
+
+func (palette *ColourPalette) readData() byte {
+	return palette.Data[palette.Index]
+}
+
+func (palette *ColourPalette) writeData(val byte) {
+	palette.Data[palette.Index] = val
+	if palette.AutoIncrement {
+		palette.Index = (palette.Index + 1) & 0x3F
+	}
+}
+
+/*
+Get the 24bit colour of a colour number in one of the 8 palettes.
+*/
+func (palette *ColourPalette) Colour(number byte, colourNum byte) [3]uint8 {
+	offset := (number&0x7)*8 + (colourNum&0x3)*2
+	raw := uint16(palette.Data[offset]) | uint16(palette.Data[offset+1])<<8
+	return [3]uint8{
+		expandColour(raw & 0x1F),
+		expandColour((raw >> 5) & 0x1F),
+		expandColour((raw >> 10) & 0x1F),
+	}
+}
+
+// Scale a 5bit colour intensity to 8bit
+func expandColour(val uint16) uint8 {
+	return uint8(val<<3 | val>>2)
+}
+
+/*
+CGB VRAM DMA transfer.
+
+	FF51 - HDMA1 - New DMA Source, High
+	FF52 - HDMA2 - New DMA Source, Low
+	FF53 - HDMA3 - New DMA Destination, High
+	FF54 - HDMA4 - New DMA Destination, Low
+	FF55 - HDMA5 - New DMA Length/Mode/Start
+*/
+type HDMA struct {
+	Source      uint16
+	Destination uint16
+	// Remaining blocks of 16 bytes minus 1
+	Length byte
+	// Whether an H-Blank DMA is in progress
+	Active bool
+}
+
+/*
+Handle writes to FF55. Bit 7 selects the transfer mode:
+
+	0 - General Purpose DMA, all data is transferred at once
+	1 - H-Blank DMA, 16 bytes are transferred at every H-Blank
+
+Writing bit 7 cleared while an H-Blank DMA is active stops it.
+*/
+func (core *Core) startHDMA(val byte) {
+	if core.HDMA.Active && !util.TestBit(val, 7) {
+		core.HDMA.Active = false
+		return
+	}
+	core.HDMA.Length = val & 0x7F
+	if util.TestBit(val, 7) {
+		core.HDMA.Active = true
+		return
+	}
+	for core.transferHDMABlock() {
+	}
+}
+
+/*
+Read FF55: the remaining length, bit 7 is cleared while an H-Blank DMA is active.
+0xFF means the transfer is complete.
+*/
+func (core *Core) readHDMA() byte {
+	if core.HDMA.Active {
+		return core.HDMA.Length
+	}
+	return core.HDMA.Length | 0x80
+}
+
+/*
+Called when the LCD enters H-Blank.
+*/
+func (core *Core) hblankHDMA() {
+	if core.HDMA.Active {
+		core.HDMA.Active = core.transferHDMABlock()
+	}
+}
+
+/*
+Copy a block of 16 bytes into the current VRAM bank, return whether there are blocks left.
+*/
+func (core *Core) transferHDMABlock() bool {
+	for i := uint16(0); i < 0x10; i++ {
+		data := core.readMemory(core.HDMA.Source + i)
+		core.Memory.VRAM[core.Memory.VRAMBank][(core.HDMA.Destination+i)&0x1FFF] = data
+	}
+	core.HDMA.Source += 0x10
+	core.HDMA.Destination = (core.HDMA.Destination + 0x10) & 0x1FF0
+	// The CPU is stopped for 8 cycles per block in normal speed mode
+	core.stallCycles += 8 * (core.SpeedMultiple + 1)
+
+	core.HDMA.Length--
+	return core.HDMA.Length != 0xFF
+}
+
+/*
+FF4D - KEY1 - CGB Mode Only - Prepare Speed Switch
+
+	Bit 7: Current Speed     (0=Normal, 1=Double) (Read Only)
+	Bit 0: Prepare Speed Switch (0=No, 1=Prepare) (Read/Write)
+*/
+func (core *Core) readKey1() byte {
+	res := byte(0x7E)
+	if core.SpeedMultiple == 1 {
+		res |= 0x80
+	}
+	if core.prepareSpeedSwitch {
+		res |= 0x01
+	}
+	return res
+}
+
+/*
+Execute the speed switch prepared in KEY1, triggered by the STOP instruction.
+*/
+func (core *Core) switchSpeed() {
+	if !core.CGBMode || !core.prepareSpeedSwitch {
+		return
+	}
+	core.prepareSpeedSwitch = false
+	core.SpeedMultiple ^= 1
+}
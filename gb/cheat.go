@@ -0,0 +1,225 @@
+package gb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type CheatType int
+
+const (
+	// Game Genie codes replace bytes read from the ROM
+	GameGenie CheatType = iota
+	// GameShark codes write to the RAM on every frame
+	GameShark
+)
+
+type Cheat struct {
+	// Code as entered, upper case
+	Code    string
+	Type    CheatType
+	Address uint16
+	Value   byte
+	// Game Genie codes with a compare value only replace a matching byte,
+	// which tells apart the ROM banks mapped at the same address
+	Compare    byte
+	HasCompare bool
+	// GameShark RAM bank, 01h for the bank currently mapped
+	Bank byte
+}
+
+/*
+Cheats grouped for the emulation loop. A new table replaces the current one
+whenever cheats are changed, so that reading it doesn't need a lock.
+*/
+type cheatTable struct {
+	all       []Cheat
+	gameGenie map[uint16][]Cheat
+	gameShark []Cheat
+}
+
+/*
+Parse a Game Genie or GameShark code:
+
+	Game Genie  ABC-DEF or ABC-DEF-GHI
+	            AB is the new value, the address is (F xor Fh)CDE. The
+	            optional compare value is GI rotated right twice, xor BAh.
+	GameShark   ABCDEFGH
+	            AB is the RAM bank, CD the value and GHEF the address.
+*/
+func ParseCheat(code string) (Cheat, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	cheat := Cheat{Code: code}
+	parts := strings.Split(code, "-")
+	digits := strings.Join(parts, "")
+	value, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return cheat, fmt.Errorf("invalid cheat code: %s", code)
+	}
+
+	switch {
+	case len(parts) == 1 && len(digits) == 8:
+		cheat.Type = GameShark
+		cheat.Bank = byte(value >> 24)
+		cheat.Value = byte(value >> 16)
+		cheat.Address = uint16(value>>8)&0xFF | uint16(value)<<8
+		if cheat.Address < 0x8000 {
+			// Writing to the ROM would switch banks instead
+			return cheat, fmt.Errorf("GameShark code outside of the RAM: %s", code)
+		}
+	case (len(parts) == 2 || len(parts) == 3) && len(digits) == len(parts)*3:
+		for _, part := range parts {
+			if len(part) != 3 {
+				return cheat, fmt.Errorf("invalid Game Genie code: %s", code)
+			}
+		}
+		if len(parts) == 3 {
+			// Drop GHI, H is not used
+			compare := byte(value>>4)&0xF0 | byte(value)&0xF
+			cheat.Compare = (compare>>2 | compare<<6) ^ 0xBA
+			cheat.HasCompare = true
+			value >>= 12
+		}
+		cheat.Type = GameGenie
+		cheat.Value = byte(value >> 16)
+		cheat.Address = uint16(value>>4)&0x0FFF | uint16(^value&0xF)<<12
+		if cheat.Address >= 0x8000 {
+			return cheat, fmt.Errorf("Game Genie code outside of the ROM: %s", code)
+		}
+	default:
+		return cheat, fmt.Errorf("invalid cheat code: %s", code)
+	}
+	return cheat, nil
+}
+
+/*
+Add a Game Genie or GameShark code, it takes effect right away and stays
+active until it is removed.
+*/
+func (core *Core) AddCheat(code string) error {
+	cheat, err := ParseCheat(code)
+	if err != nil {
+		return err
+	}
+	core.updateCheats(func(cheats []Cheat) []Cheat {
+		for _, c := range cheats {
+			if c.Code == cheat.Code {
+				return cheats
+			}
+		}
+		return append(cheats, cheat)
+	})
+	log.Println("[Cheat] Code added:", cheat.Code)
+	return nil
+}
+
+/*
+Remove a code added by AddCheat.
+*/
+func (core *Core) RemoveCheat(code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	found := false
+	core.updateCheats(func(cheats []Cheat) []Cheat {
+		var res []Cheat
+		for _, c := range cheats {
+			if c.Code == code {
+				found = true
+			} else {
+				res = append(res, c)
+			}
+		}
+		return res
+	})
+	if !found {
+		return errors.New("no such cheat code: " + code)
+	}
+	log.Println("[Cheat] Code removed:", code)
+	return nil
+}
+
+/*
+Remove all codes.
+*/
+func (core *Core) ClearCheats() {
+	core.updateCheats(func([]Cheat) []Cheat {
+		return nil
+	})
+}
+
+/*
+Return the active codes.
+*/
+func (core *Core) Cheats() []Cheat {
+	if table := core.cheatTable(); table != nil {
+		return append([]Cheat{}, table.all...)
+	}
+	return nil
+}
+
+func (core *Core) cheatTable() *cheatTable {
+	table, _ := core.cheats.Load().(*cheatTable)
+	return table
+}
+
+func (core *Core) updateCheats(update func([]Cheat) []Cheat) {
+	core.cheatLock.Lock()
+	defer core.cheatLock.Unlock()
+	var current []Cheat
+	if table := core.cheatTable(); table != nil {
+		current = append(current, table.all...)
+	}
+	table := &cheatTable{
+		all:       update(current),
+		gameGenie: map[uint16][]Cheat{},
+	}
+	for _, cheat := range table.all {
+		if cheat.Type == GameGenie {
+			table.gameGenie[cheat.Address] = append(table.gameGenie[cheat.Address], cheat)
+		} else {
+			table.gameShark = append(table.gameShark, cheat)
+		}
+	}
+	core.cheats.Store(table)
+}
+
+/*
+Replace a byte read from the ROM according to the Game Genie codes.
+*/
+func (core *Core) readROMCheat(address uint16, value byte) byte {
+	table := core.cheatTable()
+	if table == nil {
+		return value
+	}
+	for _, cheat := range table.gameGenie[address] {
+		if !cheat.HasCompare || cheat.Compare == value {
+			return cheat.Value
+		}
+	}
+	return value
+}
+
+/*
+Write the GameShark codes to the RAM, done at V-Blank like the real device.
+Bank 9xh selects the CGB WRAM bank x for D000-DFFF, any other bank writes
+to the memory currently mapped.
+*/
+func (core *Core) applyGameShark() {
+	table := core.cheatTable()
+	if table == nil {
+		return
+	}
+	for _, cheat := range table.gameShark {
+		if cheat.Bank&0xF0 == 0x90 && cheat.Address >= 0xD000 && cheat.Address <= 0xDFFF {
+			bank := int(cheat.Bank & 0x7)
+			if bank == 0 {
+				bank = 1
+			}
+			core.Memory.WRAM[bank][cheat.Address-0xD000] = cheat.Value
+		} else {
+			core.writeMemory(cheat.Address, cheat.Value)
+		}
+	}
+}
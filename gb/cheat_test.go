@@ -0,0 +1,42 @@
+package gb
+
+import "testing"
+
+func TestParseCheat(t *testing.T) {
+	for _, c := range []struct {
+		code string
+		want Cheat
+	}{
+		// Address (Bh xor Fh)A17h
+		{"00A-17B", Cheat{Code: "00A-17B", Type: GameGenie, Address: 0x4A17, Value: 0x00}},
+		// Compare C9h rotated right twice is 72h, xor BAh
+		{"00A-17B-C49", Cheat{Code: "00A-17B-C49", Type: GameGenie, Address: 0x4A17, Value: 0x00, Compare: 0xC8, HasCompare: true}},
+		{" 3e9-a1f-e6e ", Cheat{Code: "3E9-A1F-E6E", Type: GameGenie, Address: 0x09A1, Value: 0x3E, Compare: 0x01, HasCompare: true}},
+		{"C3F-FFE", Cheat{Code: "C3F-FFE", Type: GameGenie, Address: 0x1FFF, Value: 0xC3}},
+		// Address GHEF, little endian
+		{"010238CD", Cheat{Code: "010238CD", Type: GameShark, Address: 0xCD38, Value: 0x02, Bank: 0x01}},
+		{"91FF05DA", Cheat{Code: "91FF05DA", Type: GameShark, Address: 0xDA05, Value: 0xFF, Bank: 0x91}},
+	} {
+		got, err := ParseCheat(c.code)
+		if err != nil || got != c.want {
+			t.Errorf("ParseCheat(%q) = %+v, %v, want %+v", c.code, got, err, c.want)
+		}
+	}
+
+	for _, code := range []string{
+		"",
+		"XYZ-123",
+		"12-345",
+		"123-456-78",
+		"0000",
+		"0123456789",
+		// F000h, outside of the ROM
+		"000-000",
+		// 4000h, outside of the RAM
+		"01FF0040",
+	} {
+		if cheat, err := ParseCheat(code); err == nil {
+			t.Errorf("ParseCheat(%q) = %+v, want an error", code, cheat)
+		}
+	}
+}
@@ -1,7 +1,15 @@
 package gb
 
 import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HFO4/gbc-in-cloud/driver"
@@ -39,12 +47,14 @@ type Core struct {
 	*/
 
 	//Screen pixel data
-	Screen     [160][144][3]uint8
-	ScanLineBG [160]bool
+	Screen [160][144][3]uint8
+	PPU    PPU
 	//Display driver
 	DisplayDriver driver.DisplayDriver
 	// Signal to tell display driver to draw
 	DrawSignal chan bool
+	// Set when the LCD enters V-Blank
+	frameDone bool
 
 	/*
 	  +++++++++++++++++++++++++++
@@ -57,25 +67,71 @@ type Core struct {
 	Clock int
 	//in CBG mode, clock might change to twice as original
 	SpeedMultiple int
+	//Speed switch requested via KEY1, executed by STOP
+	prepareSpeedSwitch bool
+	//Cycles the CPU is stopped by a VRAM DMA transfer
+	stallCycles int
+
+	/*
+	  +++++++++++++++++++++++++++
+	  +    Gameboy Color only   +
+	  +++++++++++++++++++++++++++
+	*/
+	//Whether the cartridge runs in CGB mode
+	CGBMode bool
+	//Whether the emulated hardware is a Gameboy Color, DMG games are then colourised by the boot ROM
+	CGBHardware bool
+	//Background and sprite colour palettes
+	BGPalette  ColourPalette
+	OBJPalette ColourPalette
+	//VRAM DMA transfer
+	HDMA HDMA
 
 	/*
 	  ++++++++++++++++++++++++++
 	  +  Development options   +
 	  ++++++++++++++++++++++++++
 	*/
-	//Debug mode
+	//Debug mode, the debugger reads commands from the terminal
 	Debug bool
-	//Commands num to be executed in DEBUG mode
-	DebugControl uint16
-
-	StepExe int
+	//Debugger attached to the emulator, nil if none
+	debugger *Debugger
+	//Instruction logger, nil if none
+	tracer *Tracer
 
 	/*
 	  ++++++++++++++++++++++++++
 	  +      Other options     +
 	  ++++++++++++++++++++++++++
 	*/
-	ToggleSound bool
+	// Audio output, audio is discarded if nil
+	AudioDriver driver.AudioDriver
+	// Pictures seen by the Pocket Camera, it sees black if nil
+	Camera driver.ImageSource
+	// States kept for rewinding, rewind is off if 0
+	RewindLength int
+	// Frames between two states kept for rewinding
+	RewindInterval int
+	rewind         *rewindBuffer
+	// Whether the rewind hotkey was held since the last frame
+	rewinding bool
+	// Speed, pause and frame advance of Run
+	speed speedControl
+	// Memory seen by the CPU in place of the memory map, see Bus
+	Bus Bus
+	// Copy of the bytes sent over the link cable as master, for test ROMs
+	// printing their results there
+	SerialOutput io.Writer
+	// Active Game Genie and GameShark codes, a *cheatTable
+	cheats    atomic.Value
+	cheatLock sync.Mutex
+	// Path of an IPS, UPS or BPS patch applied to the ROM, a patch named after the ROM is used if empty
+	PatchPath string
+	// Path of the boot ROM image, the game starts right away if empty
+	BootROMPath string
+	// Whether the boot ROM is mapped over the cartridge ROM
+	BootROMMapped bool
+	bootROM       []byte
 	/*
 		Timer
 	*/
@@ -83,65 +139,257 @@ type Core struct {
 	Exit      bool
 	GameTitle string
 	RamPath   string
+	// Stops the loop saving the cartridge RAM, nil if it isn't running
+	saveLoopStop chan bool
+
+	// Fatal error which stopped the emulation
+	err error
+	// Called from the emulation loop when it stops because of an error
+	OnError func(error)
+	// Called before LD B,B is executed, test ROMs and debuggers use it as a
+	// breakpoint
+	OnSoftwareBreakpoint func()
+}
+
+// CPU cycles of a complete screen refresh
+const FrameCycles = 70224
+
+// Initialize emulator with a ROM file, which may be zipped or gzipped
+func (core *Core) Init(romPath string) error {
+	romData, err := core.readRomFile(romPath)
+	if err != nil {
+		return err
+	}
+	return core.InitWithData(romPath, romData)
 }
 
-type Timer struct {
-	TimerCounter    int
-	DividerRegister int
-	ScanlineCounter int
+/*
+Initialize emulator with a ROM read from r, for ROMs which are not stored
+in a file. The name is used as the ROM path: the save file and the save
+states are stored next to it.
+*/
+func (core *Core) InitWithReader(name string, r io.Reader) error {
+	romData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return core.InitWithData(name, romData)
 }
 
-// Initialize emulator
-func (core *Core) Init(romPath string) {
+/*
+Initialize emulator with a ROM held in memory, see InitWithReader.
+*/
+func (core *Core) InitWithData(name string, romData []byte) error {
 	core.SpeedMultiple = 0
-	core.Timer.TimerCounter = 0
-	core.Timer.DividerRegister = 0
+	core.prepareSpeedSwitch = false
+	core.HDMA = HDMA{Length: 0xFF}
+	core.initTimer()
 	core.JoypadStatus = 0xFF
 	core.SerialByte = 0xFF
 	core.Serial.Receive = make(chan byte)
 
-	core.initRom(romPath)
+	if err := core.initRom(name, romData); err != nil {
+		return err
+	}
+	core.err = nil
+	core.BootROMMapped = false
+	if core.BootROMPath != "" {
+		if err := core.loadBootROM(); err != nil {
+			return err
+		}
+	}
 	core.initMemory()
+	core.initPPU()
 	core.initCPU()
+	if core.BootROMMapped {
+		core.powerOn()
+	}
 	core.initCB()
+	core.rewind = nil
+	if core.RewindLength > 0 {
+		core.rewind = newRewindBuffer(core.RewindLength, core.RewindInterval)
+	}
 	core.Controller.InitStatus(&core.JoypadStatus)
+	if hotkey, ok := core.Controller.(driver.HotkeyDriver); ok {
+		hotkey.SetHotkeyHandler(core.handleHotkey)
+	}
+	if mbc, ok := core.Cartridge.MBC.(*MBC7); ok {
+		if tilt, ok := core.Controller.(driver.TiltInput); ok {
+			mbc.tilt = tilt
+		}
+	}
+	if mbc, ok := core.Cartridge.MBC.(*PocketCamera); ok {
+		mbc.source = core.Camera
+	}
 	core.DisplayDriver.Init(&core.Screen, core.GameTitle)
 
 	/*
-		If debug mode is ON, we set the DebugControl to 0x0100,
-		where the ROM code was firstly executed.
+		If debug mode is ON, the debugger stops before the first instruction
+		and reads commands from the terminal.
 	*/
 	if core.Debug {
-		core.DebugControl = 0x0100
+		debugger := core.AttachDebugger()
+		debugger.Pause()
+		debugger.AttachTerminal(os.Stdin, os.Stdout)
 	}
 
-	if core.ToggleSound {
-		core.Sound.Init()
+	if core.AudioDriver == nil {
+		core.AudioDriver = &driver.NullAudio{}
+	}
+	if err := core.AudioDriver.Init(SoundSampleRate); err != nil {
+		log.Println("[Warning] Failed to init audio output,", err)
 	}
+	return nil
 }
 
 // Start the emulation loop
 func (core *Core) Run() {
 	// Execution interval depends on the FPS
-	ticker := time.NewTicker(time.Second / time.Duration(core.FPS))
+	interval := time.Second / time.Duration(core.FPS)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// A crashing game must only stop its own emulator
+	defer func() {
+		if r := recover(); r != nil {
+			core.fail(fmt.Errorf("emulator panic: %v", r))
+			core.stop()
+		}
+	}()
+
+	// Frames owed by slow motion
+	budget := 0.0
 	for range ticker.C {
-		core.Update()
+		speed, paused, advance := core.speedState()
+		switch {
+		case core.rewindIfHeld():
+			core.serveDebugger()
+			core.RenderScreen()
+		case advance:
+			core.runToVBlank()
+			core.RenderScreen()
+		case paused:
+			core.serveDebugger()
+		case speed == SpeedUncapped:
+			// Run until the next tick is due, only the last frame is drawn
+			start := time.Now()
+			core.runUpdate()
+			for time.Since(start) < interval && core.err == nil {
+				core.runUpdate()
+			}
+			core.RenderScreen()
+		default:
+			/*
+				Fast-forward runs several updates per tick, slow motion
+				runs one every few ticks. Only the last one is drawn so
+				that the display driver isn't flooded.
+			*/
+			budget += speed
+			if budget >= 1 {
+				for ; budget >= 1 && core.err == nil; budget-- {
+					core.runUpdate()
+				}
+				core.RenderScreen()
+			}
+		}
+		if core.err != nil {
+			core.stop()
+			return
+		}
 		// Check controller input interrupt
 		if core.Controller.UpdateInput() {
 			core.RequestInterrupt(4)
 		}
 		// Check exit signal
 		if core.Exit {
+			if err := core.Close(); err != nil {
+				log.Println("[Memory] Failed to save cartridge RAM:", err)
+			}
 			close(core.DrawSignal)
 			return
 		}
 	}
 }
 
+/*
+Record a fatal emulation error, the running loop stops after
+the current instruction.
+*/
+func (core *Core) fail(err error) {
+	if core.err == nil {
+		core.err = err
+	}
+}
+
+/*
+Return the error which stopped the emulation, if any.
+*/
+func (core *Core) Err() error {
+	return core.err
+}
+
+/*
+Stop the emulation loop because of an error, report it and release the display driver.
+*/
+func (core *Core) stop() {
+	log.Println("[Core] Emulation stopped:", core.err)
+	core.stopSaveLoop()
+	if core.OnError != nil {
+		core.OnError(core.err)
+	}
+	close(core.DrawSignal)
+}
+
+/*
+Handle hotkeys sent by the controller driver.
+*/
+func (core *Core) handleHotkey(key driver.Hotkey, slot int) {
+	var err error
+	switch key {
+	case driver.HotkeySaveState:
+		err = core.SaveStateSlot(slot)
+	case driver.HotkeyLoadState:
+		err = core.LoadStateSlot(slot)
+	case driver.HotkeyRewind:
+		core.rewinding = true
+	case driver.HotkeyPause:
+		if core.Paused() {
+			core.Resume()
+		} else {
+			core.Pause()
+		}
+		core.logSpeed()
+	case driver.HotkeyFrameAdvance:
+		core.AdvanceFrame()
+	case driver.HotkeyFaster:
+		core.Faster()
+		core.logSpeed()
+	case driver.HotkeySlower:
+		core.Slower()
+		core.logSpeed()
+	case driver.HotkeyNormalSpeed:
+		core.SetSpeed(1)
+		core.logSpeed()
+	}
+	if err != nil {
+		log.Printf("[Core] Hotkey failed for slot %d: %s\n", slot, err)
+	}
+}
+
 /*
 Render a frame.
 */
 func (core *Core) Update() {
+	if !core.rewindIfHeld() {
+		core.runUpdate()
+	}
+	core.RenderScreen()
+}
+
+/*
+Run the cycles of an update without drawing them.
+*/
+func (core *Core) runUpdate() {
 	cyclesThisUpdate := 0
 
 	/*
@@ -149,24 +397,95 @@ func (core *Core) Update() {
 		we need to execute `Clock / FPS` cycles. Some Gameboy Color games might
 		use double speed mode, under these, `SpeedMultiple` will be set to `1`.
 	*/
-	for cyclesThisUpdate < ((core.SpeedMultiple+1)*core.Clock)/core.FPS {
-		cycles := 4
+	for cyclesThisUpdate < ((core.SpeedMultiple+1)*core.Clock)/core.FPS && core.err == nil {
+		cyclesThisUpdate += core.Step()
+	}
+	core.flushAudio()
+}
 
-		/*
-			Check whether CPU is halted, when this happen, only an interrupt
-			can stop halting.
-		*/
-		if !core.CPU.Halt {
-			cycles = core.ExecuteNextOPCode()
+/*
+Run the emulator until the next V-Blank starts, then check controller input
+and return. Unlike Update, the display driver is not signaled, so no driver
+goroutine is required to drain DrawSignal. While the LCD is off, one frame
+worth of cycles is executed instead, and while the rewind hotkey is held
+the emulator goes back a state instead. A returned error means the
+emulation can not go on.
+*/
+func (core *Core) RunFrame() error {
+	if !core.rewindIfHeld() {
+		core.runToVBlank()
+	}
+	if core.Controller.UpdateInput() {
+		core.RequestInterrupt(4)
+	}
+	return core.err
+}
+
+/*
+Run the emulator until the next V-Blank starts, or for a frame worth of
+cycles while the LCD is off.
+*/
+func (core *Core) runToVBlank() {
+	core.frameDone = false
+	cyclesThisFrame := 0
+	for !core.frameDone && core.err == nil {
+		cyclesThisFrame += core.Step()
+		if !core.IsLCDEnabled() && cyclesThisFrame >= (core.SpeedMultiple+1)*FrameCycles {
+			break
+		}
+	}
+	core.flushAudio()
+}
+
+/*
+Hand the samples produced by the APU over to the audio driver.
+*/
+func (core *Core) flushAudio() {
+	core.AudioDriver.Push(core.Sound.samples)
+	core.Sound.samples = core.Sound.samples[:0]
+}
+
+/*
+Run n frames as fast as possible.
+*/
+func (core *Core) RunFrames(n int) error {
+	for i := 0; i < n; i++ {
+		if err := core.RunFrame(); err != nil {
+			return err
 		}
-		cyclesThisUpdate += cycles
-		core.UpdateTimers(cycles)
-		core.UpdateGraphics(cycles)
-		cyclesThisUpdate += core.Interrupt()
-		core.UpdateIO(cycles)
+	}
+	return nil
+}
 
+/*
+Execute a single instruction, then update timers, graphics, interrupts
+and serial IO accordingly. Return the CPU cycles used.
+*/
+func (core *Core) Step() int {
+	cycles := 4
+	if core.debugger != nil {
+		core.debugger.beforeStep()
 	}
-	core.RenderScreen()
+
+	/*
+		Check whether CPU is halted, when this happen, only an interrupt
+		can stop halting.
+	*/
+	if !core.CPU.Halt {
+		cycles = core.ExecuteNextOPCode()
+	}
+	cycles += core.stallCycles
+	core.stallCycles = 0
+	core.UpdateTimers(cycles)
+	// The LCD runs at the same speed in double speed mode
+	core.UpdateGraphics(cycles >> uint(core.SpeedMultiple))
+	core.Sound.Update(cycles >> uint(core.SpeedMultiple))
+	interruptCycles := core.Interrupt()
+	core.UpdateIO(cycles)
+	if core.rewind != nil && core.rewind.due {
+		core.rewind.capture(core)
+	}
+	return cycles + interruptCycles
 }
 
 func (core *Core) UpdateIO(cycles int) {
@@ -215,7 +534,7 @@ func (core *Core) Interrupt() int {
 			  Bit 4: Joypad   Interrupt Request (INT 60h)  (1=Request)
 
 		*/
-		req := core.ReadMemory(0xFF0F)
+		req := core.readMemory(0xFF0F)
 		/*
 			FFFF - IE - Interrupt Enable (R/W)
 			  Bit 0: V-Blank  Interrupt Enable  (INT 40h)  (1=Enable)
@@ -224,7 +543,7 @@ func (core *Core) Interrupt() int {
 			  Bit 3: Serial   Interrupt Enable  (INT 58h)  (1=Enable)
 			  Bit 4: Joypad   Interrupt Enable  (INT 60h)  (1=Enable)
 		*/
-		enabled := core.ReadMemory(0xFFFF)
+		enabled := core.readMemory(0xFFFF)
 		if req > 0 {
 			/*
 
@@ -257,9 +576,9 @@ func (core *Core) DoInterrupt(id int) {
 	core.CPU.Flags.InterruptMaster = false
 	core.CPU.Halt = false
 
-	req := core.ReadMemory(0xFF0F)
+	req := core.readMemory(0xFF0F)
 	req = util.ClearBit(req, uint(id))
-	core.WriteMemory(0xFF0F, req)
+	core.writeMemory(0xFF0F, req)
 	// We must save the current execution address by pushing it onto the stack
 	core.StackPush(core.CPU.Registers.PC)
 
@@ -283,28 +602,7 @@ func (core *Core) DoInterrupt(id int) {
 	case 4:
 		core.CPU.Registers.PC = 0x60
 	default:
-		log.Fatalf("Unknown Interrupt: %d", id)
-	}
-}
-
-/*
-Check and update timers.
-*/
-func (core *Core) UpdateTimers(cycles int) {
-	core.DoDividerRegister(cycles)
-	if core.IsClockEnabled() {
-		core.Timer.TimerCounter += cycles
-		if core.Timer.TimerCounter >= core.GetClockFreqCount() {
-			// reset m_TimerTracer to the correct value
-			core.SetClockFreq()
-			// timer about to overflow
-			if core.ReadMemory(0xFF05) == 255 {
-				core.WriteMemory(0xFF05, core.ReadMemory(0xFF06))
-				core.RequestInterrupt(2)
-			} else {
-				core.WriteMemory(0xFF05, core.ReadMemory(0xFF05)+1)
-			}
-		}
+		core.fail(fmt.Errorf("unknown interrupt: %d", id))
 	}
 }
 
@@ -313,82 +611,76 @@ Request an Interrupt.
 */
 func (core *Core) RequestInterrupt(id int) {
 	//Read the present Interrupt Flag
-	req := core.ReadMemory(0xFF0F)
+	req := core.readMemory(0xFF0F)
 	req = util.SetBit(req, uint(id))
-	core.WriteMemory(0xFF0F, req)
+	core.writeMemory(0xFF0F, req)
 }
 
 /*
-Update divider register.
-This register is incremented at rate of 16384Hz (~16779Hz on SGB).
-In CGB Double Speed Mode it is incremented twice as fast, ie. at 32768Hz.
+Read a ROM file the way the emulator loads it: unpacked from its archive,
+with the patch at patchPath applied, or the patch named after the ROM if
+patchPath is empty.
 */
-func (core *Core) DoDividerRegister(cycles int) {
-	core.Timer.DividerRegister += cycles
-	if core.Timer.DividerRegister >= 255 {
-		core.Timer.DividerRegister = 0
-		core.Memory.MainMemory[0xFF04]++
+func LoadROM(romPath string, patchPath string) ([]byte, error) {
+	romData, err := readDataFile(romPath, false)
+	if err != nil {
+		return nil, err
 	}
+	romData, _, err = prepareROM(romPath, romData, patchPath)
+	return romData, err
 }
 
 /*
-Reset clock frequency.
+Unpack the ROM and apply its patch, return the path of the patch applied,
+if any.
 */
-func (core *Core) SetClockFreq() {
-	core.Timer.TimerCounter = 0
-}
-
-/*
-Check whether clock is enabled.
-*/
-func (core *Core) IsClockEnabled() bool {
-	if core.ReadMemory(0xFF07)&0x04 == 0x04 {
-		return true
+func prepareROM(romPath string, romData []byte, patchPath string) ([]byte, string, error) {
+	romData, err := unpackROM(romData)
+	if err != nil {
+		return nil, "", err
 	}
-	return false
-}
-
-/*
-Get clock frequency sign specified in TAC register.
-*/
-func (core *Core) GetClockFreq() byte {
-	return core.ReadMemory(0xFF07) & 0x3
-}
-
-/*
-		Get clock frequency sign according to clock frequency sign in TAC register.
-		FF07 - TAC - Timer Control (R/W)
-		  Bit 2    - Timer Stop  (0=Stop, 1=Start)
-		  Bits 1-0 - Input Clock Select
-	             00:   4096 Hz    (~4194 Hz SGB)
-	             01: 262144 Hz  (~268400 Hz SGB)
-	             10:  65536 Hz   (~67110 Hz SGB)
-	             11:  16384 Hz   (~16780 Hz SGB)
-*/
-func (core *Core) GetClockFreqCount() int {
-	switch core.GetClockFreq() {
-	case 0:
-		return 1024
-	case 1:
-		return 16
-	case 2:
-		return 64
-	case 3:
-		return 256
-	default:
-		return 1024
+	if patchPath == "" {
+		patchPath = findPatch(romPath)
+	}
+	if patchPath != "" {
+		if romData, err = applyPatchFile(romData, patchPath); err != nil {
+			return nil, "", err
+		}
 	}
+	return romData, patchPath, nil
 }
 
 /*
 Initialize Cartridge, load rom file and decode rom props
 */
-func (core *Core) initRom(romPath string) {
+func (core *Core) initRom(romPath string, romData []byte) error {
 	core.RamPath = romPath + ".sav"
-	romData := core.readRomFile(romPath)
-	ramData := core.readRamFile(core.RamPath)
-	if ramData == nil {
-		ramData = make([]byte, 0x8000)
+	romData, patchPath, err := prepareROM(romPath, romData, core.PatchPath)
+	if err != nil {
+		return err
+	}
+	if patchPath != "" {
+		// Patched games don't share the saves of the original game
+		core.RamPath = patchPath + ".sav"
+	}
+	// The cartridge header ends at 014F
+	if len(romData) < 0x150 {
+		return fmt.Errorf("ROM file too small: %d bytes", len(romData))
+	}
+	ramData, err := core.readRamFile(core.RamPath)
+	if err != nil {
+		return err
+	}
+
+	/*
+		MMM01 multicarts boot into the menu stored in the last 32KByte of the ROM,
+		its header describes the whole cartridge.
+	*/
+	header := romData
+	if len(romData) >= 0x10000 {
+		if menu := romData[len(romData)-0x8000:]; menu[0x147] >= 0x0B && menu[0x147] <= 0x0D {
+			header = menu
+		}
 	}
 
 	/*
@@ -400,16 +692,18 @@ func (core *Core) initRom(romPath string) {
 		had the fantastic idea to reduce it to 11 characters only. The new meaning of the
 		ex-title bytes is described below.
 	*/
-	log.Printf("[Cartridge] Game title: %s\n", string(romData[0x134:0x143]))
-	core.GameTitle = string(romData[0x134:0x143])
+	log.Printf("[Cartridge] Game title: %s\n", string(header[0x134:0x143]))
+	core.GameTitle = string(header[0x134:0x143])
 	/*
 		0143 - CGB Flag
 
 		80h - Game supports CGB functions, but works on old gameboys also.
 		C0h - Game works on CGB only (physically the same as 80h).
 	*/
-	isCGB := (romData[0x143] == 0x80 || romData[0x143] == 0xC0)
+	isCGB := (header[0x143] == 0x80 || header[0x143] == 0xC0)
 	log.Printf("[Cartridge] CGB mode: %t\n", isCGB)
+	core.CGBMode = isCGB
+	core.CGBHardware = isCGB
 
 	/*
 		0147 - Cartridge Type
@@ -417,17 +711,57 @@ func (core *Core) initRom(romPath string) {
 		Specifies which Memory Bank Controller (if any) is used in the cartridge,
 		and if further external hardware exists in the cartridge.
 	*/
-	CartridgeType := romData[0x147]
+	CartridgeType := header[0x147]
 	if _, ok := cartridgeTypeMap[CartridgeType]; !ok {
-		log.Fatalf("[Cartridge] Unknown cartridge type: %x\n", CartridgeType)
+		return fmt.Errorf("unknown cartridge type: %x", CartridgeType)
 	}
 	log.Printf("[Cartridge] Cartridge type: %s\n", cartridgeTypeMap[CartridgeType])
 
+	/*
+		Get rom bank number according to ROM Size byte (0148)
+		Specifies the ROM Size of the cartridge. Typically calculated as "32KB shl N".
+		  00h -  32KByte (no ROM banking) - here we set the bank number to 2
+		  01h -  64KByte (4 banks)
+		  02h - 128KByte (8 banks)
+		  03h - 256KByte (16 banks)
+		  04h - 512KByte (32 banks)
+		  05h -   1MByte (64 banks)  - only 63 banks used by MBC1
+		  06h -   2MByte (128 banks) - only 125 banks used by MBC1
+		  07h -   4MByte (256 banks)
+		  08h -   8MByte (512 banks)
+		  52h - 1.1MByte (72 banks)
+		  53h - 1.2MByte (80 banks)
+		  54h - 1.5MByte (96 banks)
+	*/
+	romBanks, ok := RomBankMap[header[0x148]]
+	if !ok {
+		return fmt.Errorf("unknown ROM size byte: %x", header[0x148])
+	}
+
+	/*
+		Get ram bank number according to RAM Size byte (0149)
+		Specifies the size of the external RAM in the cartridge (if any).
+		  00h - None		(0 banks of 8KBytes each)
+		  01h - 2 KBytes	(1 banks of 8KBytes each)
+		  02h - 8 KBytes	(1 banks of 8KBytes each)
+		  03h - 32 KBytes 	(4 banks of 8KBytes each)
+		  04h - 128 KBytes	(16 banks of 8KBytes each)
+		  05h - 64 KBytes	(8 banks of 8KBytes each)
+	*/
+	ramBanks, ok := RamBankMap[header[0x149]]
+	if !ok {
+		return fmt.Errorf("unknown RAM size byte: %x", header[0x149])
+	}
+	ramSize := int(ramBanks) * 0x2000
+	if header[0x149] == 0x01 {
+		ramSize = 0x800
+	}
+
 	/*
 		Init Cartridge struct according to cartridge type
 	*/
 	switch CartridgeType {
-	case 0x00, 0x08, 0x09, 0x0B, 0x0C, 0x0D:
+	case 0x00, 0x08, 0x09:
 		core.Cartridge.MBC = &MBCRom{
 			rom: romData,
 			//Specify which ROM bank is currently loaded into internal memory address 0x4000-0x7FFF.
@@ -435,7 +769,9 @@ func (core *Core) initRom(romPath string) {
 			//it should be at least 1. We need to initialize this variable on emulator load to 1.
 			CurrentROMBank: 1,
 			//Specify which RAM bank is currently loaded into internal memory address 0xA000-0xBFFF.
-			CurrentRAMBank: 1,
+			CurrentRAMBank: 0,
+			RAMBank:        fitRamData(ramData, ramSize),
+			battery:        CartridgeType == 0x09,
 		}
 		core.Cartridge.Props = &CartridgeProps{
 			MBCType:   "rom",
@@ -446,7 +782,8 @@ func (core *Core) initRom(romPath string) {
 			rom:            romData,
 			CurrentROMBank: 1,
 			CurrentRAMBank: 0,
-			RAMBank:        ramData,
+			RAMBank:        fitRamData(ramData, ramSize),
+			multicart:      isMBC1Multicart(romData),
 		}
 		core.Cartridge.MBC = MBC
 		core.Cartridge.Props = &CartridgeProps{
@@ -457,8 +794,7 @@ func (core *Core) initRom(romPath string) {
 		MBC := &MBC2{
 			rom:            romData,
 			CurrentROMBank: 1,
-			CurrentRAMBank: 0,
-			RAMBank:        ramData,
+			RAMBank:        fitRamData(ramData, mbc2RAMSize),
 		}
 		core.Cartridge.MBC = MBC
 		core.Cartridge.Props = &CartridgeProps{
@@ -470,8 +806,17 @@ func (core *Core) initRom(romPath string) {
 			rom:            romData,
 			CurrentROMBank: 1,
 			CurrentRAMBank: 0,
-			RAMBank:        ramData,
+			hasRTC:         CartridgeType == 0x0F || CartridgeType == 0x10,
+			RTC:            RTC{LastUpdate: time.Now().Unix()},
 		}
+		if MBC.hasRTC {
+			ram, footer := splitSaveFooter(ramData, rtcFooterSize, rtcShortFooterSize)
+			if footer != nil {
+				MBC.RTC.loadFooter(footer, &MBC.LatchedRTC)
+				ramData = ram
+			}
+		}
+		MBC.RAMBank = fitRamData(ramData, ramSize)
 		core.Cartridge.MBC = MBC
 		core.Cartridge.Props = &CartridgeProps{
 			MBCType:   "MBC3",
@@ -480,51 +825,95 @@ func (core *Core) initRom(romPath string) {
 	case 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E:
 		MBC := &MBC5{
 			rom:              romData,
-			CurrentROMBankLo: 0,
+			CurrentROMBankLo: 1,
 			CurrentROMBankHi: false,
-			RAMBank:          ramData,
+			RAMBank:          fitRamData(ramData, ramSize),
+			rumble:           CartridgeType >= 0x1C,
 		}
 		core.Cartridge.MBC = MBC
 		core.Cartridge.Props = &CartridgeProps{
 			MBCType:   "MBC5",
 			ROMLength: len(romData),
 		}
+	case 0x22:
+		MBC := &MBC7{
+			rom:            romData,
+			CurrentROMBank: 1,
+			AccelX:         accelCentre,
+			AccelY:         accelCentre,
+		}
+		// 93LC66 cartridges have a 512 bytes EEPROM, there is no header field telling it
+		if len(ramData) == 2*mbc7EEPROMSize {
+			MBC.EEPROM.Data = ramData
+		} else {
+			MBC.EEPROM.Data = bytes.Repeat([]byte{0xFF}, mbc7EEPROMSize)
+			copy(MBC.EEPROM.Data, ramData)
+		}
+		MBC.EEPROM.DO = true
+		core.Cartridge.MBC = MBC
+		core.Cartridge.Props = &CartridgeProps{
+			MBCType:   "MBC7",
+			ROMLength: len(romData),
+		}
+	case 0x0B, 0x0C, 0x0D:
+		MBC := &MMM01{
+			rom:     romData,
+			RAMBank: fitRamData(ramData, ramSize),
+		}
+		core.Cartridge.MBC = MBC
+		core.Cartridge.Props = &CartridgeProps{
+			MBCType:   "MMM01",
+			ROMLength: len(romData),
+		}
+	case 0xFC:
+		MBC := &PocketCamera{
+			rom:            romData,
+			CurrentROMBank: 1,
+			RAMBank:        fitRamData(ramData, cameraRAMSize),
+		}
+		core.Cartridge.MBC = MBC
+		core.Cartridge.Props = &CartridgeProps{
+			MBCType:   "POCKET CAMERA",
+			ROMLength: len(romData),
+		}
+	case 0xFE:
+		MBC := &HuC3{
+			rom:            romData,
+			CurrentROMBank: 1,
+			RTC:            HuC3RTC{LastUpdate: time.Now().Unix()},
+		}
+		ram, footer := splitSaveFooter(ramData, huc3FooterSize)
+		if footer != nil {
+			MBC.RTC.loadFooter(footer)
+			ramData = ram
+		}
+		MBC.RAMBank = fitRamData(ramData, ramSize)
+		core.Cartridge.MBC = MBC
+		core.Cartridge.Props = &CartridgeProps{
+			MBCType:   "HuC3",
+			ROMLength: len(romData),
+		}
+	case 0xFF:
+		MBC := &HuC1{
+			rom:            romData,
+			CurrentROMBank: 1,
+			RAMBank:        fitRamData(ramData, ramSize),
+		}
+		core.Cartridge.MBC = MBC
+		core.Cartridge.Props = &CartridgeProps{
+			MBCType:   "HuC1",
+			ROMLength: len(romData),
+		}
 	default:
-		log.Fatal("[Cartridge] Unsupported MBC type")
+		return fmt.Errorf("unsupported MBC type: %s", cartridgeTypeMap[CartridgeType])
 	}
 
-	/*
-		Get rom bank number according to ROM Size byte (0148)
-		Specifies the ROM Size of the cartridge. Typically calculated as "32KB shl N".
-		  00h -  32KByte (no ROM banking) - here we set the bank number to 2
-		  01h -  64KByte (4 banks)
-		  02h - 128KByte (8 banks)
-		  03h - 256KByte (16 banks)
-		  04h - 512KByte (32 banks)
-		  05h -   1MByte (64 banks)  - only 63 banks used by MBC1
-		  06h -   2MByte (128 banks) - only 125 banks used by MBC1
-		  07h -   4MByte (256 banks)
-		  52h - 1.1MByte (72 banks)
-		  53h - 1.2MByte (80 banks)
-		  54h - 1.5MByte (96 banks)
-	*/
-	if _, ok := RomBankMap[romData[0x148]]; !ok {
-		log.Fatalf("[Cartridge] Unknown ROM size byte : %x\n", romData[0x148])
-	}
-	core.Cartridge.Props.ROMBank = RomBankMap[romData[0x148]]
-	log.Printf("[Cartridge] ROM bank number: %d (%dKBytes)\n", core.Cartridge.Props.ROMBank, core.Cartridge.Props.ROMBank*16)
+	core.Cartridge.rom = romData
+	core.Cartridge.Props.ROMBank = romBanks
+	core.Cartridge.Props.Checksum = crc32.ChecksumIEEE(romData)
+	log.Printf("[Cartridge] ROM bank number: %d (%dKBytes)\n", core.Cartridge.Props.ROMBank, int(core.Cartridge.Props.ROMBank)*16)
+	core.Cartridge.Props.RAMBank = ramBanks
+	log.Printf("[Cartridge] RAM size: %d KBytes\n", ramSize/0x400)
 
-	/*
-		Get rom bank number according to ROM Size byte (0149)
-		Specifies the size of the external RAM in the cartridge (if any).
-		  00h - None		(0 banks of 8KBytes each)
-		  01h - 2 KBytes	(1 banks of 8KBytes each)
-		  02h - 8 KBytes	(1 banks of 8KBytes each)
-		  03h - 32 KBytes 	(4 banks of 8KBytes each)
-	*/
-	if _, ok := RamBankMap[romData[0x149]]; !ok {
-		log.Fatalf("[Cartridge] Unknown RAM size byte : %x\n", romData[0x149])
-	}
-	core.Cartridge.Props.RAMBank = RamBankMap[romData[0x148]]
-	log.Printf("[Cartridge] RAM bank number: %d (%dKBytes)\n", core.Cartridge.Props.RAMBank, core.Cartridge.Props.RAMBank*8)
+	return nil
 }
@@ -85,55 +85,53 @@ func (core *Core) initCPU() {
 	core.CPU.Registers.PC = 0x0100
 	core.CPU.Registers.SP = 0xFFFE
 
+	/*
+		The CGB BIOS leaves different values, games check A=$11
+		to detect Gameboy Color hardware.
+		AF=$1180
+		BC=$0000
+		DE=$FF56
+		HL=$000D
+	*/
+	if core.CGBMode {
+		core.CPU.Flags.HalfCarry = false
+		core.CPU.Flags.Carry = false
+		core.CPU.Registers.A = 0x11
+		core.CPU.Registers.F = 0x80
+		core.CPU.Registers.C = 0x00
+		core.CPU.Registers.D = 0xFF
+		core.CPU.Registers.E = 0x56
+		core.CPU.Registers.HL = 0x000D
+	}
+
 }
 
 /*
 	Execute the next  OPCode and return used CPU clock
 */
 func (core *Core) ExecuteNextOPCode() int {
+	if core.tracer != nil {
+		core.tracer.trace(core)
+	}
 	opcode := core.ReadMemory(core.CPU.Registers.PC)
+	if opcode == 0x40 && core.OnSoftwareBreakpoint != nil {
+		core.OnSoftwareBreakpoint()
+	}
 	core.CPU.Registers.PC++
 	return core.ExecuteOPCode(opcode)
 }
 
-/*
-	Break execution and print register/dump memory information for debug purpose.
-*/
-func (core *Core) Break(code byte) {
-	af := core.CPU.getAF()
-	bc := core.CPU.getBC()
-	de := core.CPU.getDE()
-	hl := core.CPU.Registers.HL
-	sp := core.CPU.Registers.SP
-	pc := core.CPU.Registers.PC - 1
-	lcdc := core.Memory.MainMemory[0xFF40]
-	IF := core.Memory.MainMemory[0xFF0F]
-	IE := core.Memory.MainMemory[0xFFFF]
-	core.Memory.Dump("memory.dump")
-	log.Printf("[Debug] \n\033[34m[OP:%s]\nAF:%04X  BC:%04X  DE:%04X  HL:%04X  SP:%04X\nPC:%04X  LCDC:%02X  IF:%02X    IE:%02X    IME:%t\nLCD:%X \033[0m", OPCodeFunctionMap[code].OP, af, bc, de, hl, sp, pc, lcdc, IF, IE, core.CPU.Flags.InterruptMaster, core.DebugControl)
-}
-
 /*
 	Execute given OPCode and return used CPU clock
 */
 func (core *Core) ExecuteOPCode(code byte) int {
 	if OPCodeFunctionMap[code].Clock != 0 {
-		if core.DebugControl == core.CPU.Registers.PC-1 && core.Debug {
-			core.Break(code)
-			_, err := fmt.Scanf("%X", &core.DebugControl)
-			if err != nil {
-				core.CPU.Registers.PC = 0
-			}
-		}
 		var extCycles int
 		extCycles = OPCodeFunctionMap[code].Func(core)
 		return OPCodeFunctionMap[code].Clock + extCycles
 	} else {
-		if core.Debug {
-			core.Break(code)
-		}
-		log.Fatalf("Unable to resolve OPCode:%X   PC:%X\n", code, core.CPU.Registers.PC-1)
-		return 0
+		core.fail(fmt.Errorf("unable to resolve OPCode:%X   PC:%X", code, core.CPU.Registers.PC-1))
+		return 4
 	}
 }
 
@@ -0,0 +1,913 @@
+package gb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+Debugger stops the emulation before an instruction is executed, when a
+breakpoint or a watchpoint is hit, a step is done or it is paused, and keeps
+it stopped until it is resumed. The emulation goroutine is blocked while the
+debugger is stopped, it then only runs the functions given to Do.
+
+Frontends run on their own goroutine and use the debugger through Do: the
+terminal one, see AttachTerminal and debuggerHelp for its commands, and remote
+ones speaking the JSON protocol of the remote package.
+*/
+type Debugger struct {
+	core *Core
+
+	// PC breakpoints
+	Breakpoints map[uint16]bool
+	Watchpoints []Watchpoint
+
+	// Functions to run on the emulation goroutine and how many are waiting
+	requests chan func()
+	pending  int32
+	// Whether the emulation is stopped
+	stopped bool
+	// Called when the emulation stops or resumes
+	listeners    map[int]func(DebugEvent)
+	nextListener int
+	listenerLock sync.Mutex
+
+	// Stop before the next instruction
+	paused bool
+	// Instructions left to execute before stopping
+	steps int
+	// Step over: stop when PC gets back to overPC with the same stack
+	stepOver bool
+	overPC   uint16
+	overSP   uint16
+	// Run to return: stop once a return pops the stack above finishSP
+	finishing bool
+	finishSP  uint16
+	// Opcode of the instruction being executed
+	lastOpcode byte
+	// Watchpoint hit by the instruction being executed
+	hit string
+	// Addresses of the last instructions executed
+	history []uint16
+}
+
+/*
+Watchpoint stops the emulation after an instruction reads or writes an
+address between Start and End, both included.
+*/
+type Watchpoint struct {
+	Start uint16
+	End   uint16
+	Read  bool
+	Write bool
+}
+
+/*
+DebugEvent is sent to listeners when the emulation stops or resumes.
+*/
+type DebugEvent struct {
+	Stopped bool
+	// Why the emulation stopped: "Paused", "Step", "Breakpoint at $0150"...
+	Reason string
+	PC     uint16
+}
+
+/*
+RegisterState holds the registers of the CPU, as seen by the debugger.
+*/
+type RegisterState struct {
+	AF   uint16
+	BC   uint16
+	DE   uint16
+	HL   uint16
+	SP   uint16
+	PC   uint16
+	IME  bool
+	Halt bool
+}
+
+// Number of executed instructions shown before PC
+const debuggerHistory = 3
+
+// How long Do waits for the emulation goroutine to take a function
+const debuggerTimeout = time.Second
+
+const debuggerHelp = `Commands, addresses and values are hexadecimal, counts are decimal:
+  c, continue              Resume the emulation
+  p, pause                 Stop the emulation before the next instruction
+  s, step [count]          Execute one or count instructions
+  n, next                  Execute one instruction, running calls until they return
+  f, finish                Run until the current function returns
+  b, break ADDR            Stop before executing the instruction at ADDR
+  d, delete [ADDR]         Remove the breakpoint at ADDR, or all breakpoints
+  w, watch ADDR[-END] [r|w|rw]
+                           Stop after the memory is read and/or written (default rw)
+  u, unwatch [ADDR[-END]]  Remove a watchpoint, or all watchpoints
+  i, info                  List breakpoints and watchpoints
+  r, regs                  Show the registers
+  set REG VALUE            Set A, B, C, D, E, F, H, L, AF, BC, DE, HL, SP or PC
+  x ADDR [count]           Show count bytes of memory (default 64)
+  write ADDR VALUE...      Write bytes to memory, as the CPU would
+  l, disasm [ADDR] [count] Disassemble count instructions (default 10)
+  dump FILE                Save the whole address space, 0000-FFFF, to FILE
+  q, quit                  Stop the emulator
+  h, help                  Show this help`
+
+/*
+Attach a debugger to the emulator, or return the one already attached. It
+must be done before the emulation loop is started.
+*/
+func (core *Core) AttachDebugger() *Debugger {
+	if core.debugger == nil {
+		core.debugger = &Debugger{
+			core:        core,
+			Breakpoints: map[uint16]bool{},
+			requests:    make(chan func()),
+			listeners:   map[int]func(DebugEvent){},
+		}
+	}
+	return core.debugger
+}
+
+/*
+Return the debugger attached to the emulator, nil if none.
+*/
+func (core *Core) Debugger() *Debugger {
+	return core.debugger
+}
+
+/*
+Run f on the emulation goroutine, between two instructions or while the
+emulation is stopped, and wait for it to return. Other goroutines must only
+use the debugger and the emulator this way. Returns an error if the
+emulation loop isn't running.
+*/
+func (debugger *Debugger) Do(f func()) error {
+	done := make(chan bool)
+	request := func() {
+		defer close(done)
+		f()
+	}
+	atomic.AddInt32(&debugger.pending, 1)
+	defer atomic.AddInt32(&debugger.pending, -1)
+	select {
+	case debugger.requests <- request:
+	case <-time.After(debuggerTimeout):
+		return errors.New("the emulator is not running")
+	}
+	<-done
+	return nil
+}
+
+/*
+Call listener when the emulation stops or resumes, until the returned
+function is called. The listener runs on the emulation goroutine: it must
+not block and must not call Do.
+*/
+func (debugger *Debugger) Listen(listener func(DebugEvent)) func() {
+	debugger.listenerLock.Lock()
+	defer debugger.listenerLock.Unlock()
+	id := debugger.nextListener
+	debugger.nextListener++
+	debugger.listeners[id] = listener
+	return func() {
+		debugger.listenerLock.Lock()
+		defer debugger.listenerLock.Unlock()
+		delete(debugger.listeners, id)
+	}
+}
+
+/*
+Whether anyone listens to the debugger, a terminal or a remote client.
+*/
+func (debugger *Debugger) Debugging() bool {
+	debugger.listenerLock.Lock()
+	defer debugger.listenerLock.Unlock()
+	return len(debugger.listeners) > 0
+}
+
+func (debugger *Debugger) notify(event DebugEvent) {
+	debugger.listenerLock.Lock()
+	defer debugger.listenerLock.Unlock()
+	for _, listener := range debugger.listeners {
+		listener(event)
+	}
+}
+
+/*
+Run the functions given to Do, if any.
+*/
+func (debugger *Debugger) serve() {
+	for {
+		select {
+		case request := <-debugger.requests:
+			request()
+		default:
+			return
+		}
+	}
+}
+
+/*
+Run the functions given to Do while no instruction is executed, as Run is
+paused or rewinding.
+*/
+func (core *Core) serveDebugger() {
+	if core.debugger != nil {
+		core.debugger.serve()
+	}
+}
+
+/*
+Whether the emulation is stopped.
+*/
+func (debugger *Debugger) Stopped() bool {
+	return debugger.stopped
+}
+
+/*
+Stop the emulation before the next instruction, if it is running.
+*/
+func (debugger *Debugger) Pause() {
+	if !debugger.stopped {
+		debugger.paused = true
+	}
+}
+
+/*
+Resume the emulation.
+*/
+func (debugger *Debugger) Continue() {
+	debugger.stopped = false
+}
+
+/*
+Execute count instructions, then stop.
+*/
+func (debugger *Debugger) Step(count int) {
+	debugger.steps = count
+	debugger.stopped = false
+}
+
+/*
+Execute one instruction, calls and RSTs are run until they return.
+*/
+func (debugger *Debugger) Next() {
+	cpu := &debugger.core.CPU
+	opcode := debugger.read(cpu.Registers.PC)
+	if opcode == 0xCD || opcode&0xE7 == 0xC4 || opcode&0xC7 == 0xC7 {
+		_, length := Disassemble(debugger.read, cpu.Registers.PC)
+		debugger.stepOver = true
+		debugger.overPC = cpu.Registers.PC + uint16(length)
+		debugger.overSP = cpu.Registers.SP
+	} else {
+		debugger.steps = 1
+	}
+	debugger.stopped = false
+}
+
+/*
+Run until the current function returns.
+*/
+func (debugger *Debugger) Finish() {
+	debugger.finishing = true
+	debugger.finishSP = debugger.core.CPU.Registers.SP
+	debugger.stopped = false
+}
+
+/*
+Called before every step of the emulation, run the functions given to Do
+and stop if needed. Only a pause stops a halted CPU, as no instruction is
+executed.
+*/
+func (debugger *Debugger) beforeStep() {
+	if atomic.LoadInt32(&debugger.pending) > 0 {
+		debugger.serve()
+	}
+	cpu := &debugger.core.CPU
+	if cpu.Halt {
+		if debugger.paused {
+			debugger.stop("Paused")
+		}
+		return
+	}
+	pc := cpu.Registers.PC
+
+	reason := ""
+	if debugger.hit != "" {
+		reason = debugger.hit
+		debugger.hit = ""
+	} else if debugger.paused {
+		reason = "Paused"
+	} else if debugger.Breakpoints[pc] {
+		reason = fmt.Sprintf("Breakpoint at $%04X", pc)
+	} else if debugger.steps > 0 {
+		debugger.steps--
+		if debugger.steps == 0 {
+			reason = "Step"
+		}
+	} else if debugger.stepOver && pc == debugger.overPC && cpu.Registers.SP >= debugger.overSP {
+		reason = "Step"
+	} else if debugger.finishing && isReturn(debugger.lastOpcode) && cpu.Registers.SP > debugger.finishSP {
+		reason = "Returned"
+	}
+
+	if reason != "" {
+		debugger.stop(reason)
+		if cpu.Halt {
+			return
+		}
+		// Registers may have been changed while stopped
+		pc = cpu.Registers.PC
+	}
+
+	debugger.history = append(debugger.history, pc)
+	if len(debugger.history) > debuggerHistory {
+		debugger.history = debugger.history[1:]
+	}
+	debugger.lastOpcode = debugger.read(pc)
+}
+
+func isReturn(opcode byte) bool {
+	switch opcode {
+	case 0xC9, 0xD9, 0xC0, 0xC8, 0xD0, 0xD8:
+		return true
+	}
+	return false
+}
+
+/*
+Called on every memory access of the CPU, remember the first watchpoint hit.
+*/
+func (debugger *Debugger) access(address uint16, value byte, write bool) {
+	if debugger.hit != "" {
+		return
+	}
+	for _, watchpoint := range debugger.Watchpoints {
+		if address < watchpoint.Start || address > watchpoint.End {
+			continue
+		}
+		if write && watchpoint.Write {
+			debugger.hit = fmt.Sprintf("Watchpoint: $%02X written to $%04X", value, address)
+		} else if !write && watchpoint.Read {
+			debugger.hit = fmt.Sprintf("Watchpoint: $%02X read from $%04X", value, address)
+		}
+		if debugger.hit != "" {
+			if len(debugger.history) > 0 {
+				debugger.hit += fmt.Sprintf(" by the instruction at $%04X", debugger.history[len(debugger.history)-1])
+			}
+			return
+		}
+	}
+}
+
+/*
+Stop the emulation: tell the listeners, then run the functions given to Do
+until one resumes it.
+*/
+func (debugger *Debugger) stop(reason string) {
+	debugger.paused = false
+	debugger.steps = 0
+	debugger.stepOver = false
+	debugger.finishing = false
+	debugger.stopped = true
+	debugger.notify(DebugEvent{Stopped: true, Reason: reason, PC: debugger.core.CPU.Registers.PC})
+	for debugger.stopped {
+		(<-debugger.requests)()
+	}
+	debugger.notify(DebugEvent{PC: debugger.core.CPU.Registers.PC})
+}
+
+/*
+Read commands from in and write their results to out, on a new goroutine,
+until the input ends. The debugger then stops stopping and the emulation
+goes on.
+*/
+func (debugger *Debugger) AttachTerminal(in io.Reader, out io.Writer) {
+	cancel := debugger.Listen(func(event DebugEvent) {
+		if event.Stopped {
+			fmt.Fprint(out, event.Reason+"\n"+debugger.registers()+debugger.context()+"(debug) ")
+		}
+	})
+	go func() {
+		defer cancel()
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			var output string
+			var stopped bool
+			err := debugger.Do(func() {
+				output = debugger.Execute(scanner.Text())
+				stopped = debugger.stopped
+			})
+			if err != nil {
+				fmt.Fprintln(out, err)
+				return
+			}
+			if stopped {
+				output += "(debug) "
+			}
+			fmt.Fprint(out, output)
+		}
+		debugger.Do(func() {
+			debugger.Breakpoints = map[uint16]bool{}
+			debugger.Watchpoints = nil
+			debugger.stopped = false
+		})
+	}()
+}
+
+/*
+Read memory without hitting watchpoints.
+*/
+func (debugger *Debugger) read(address uint16) byte {
+	return debugger.core.readMemory(address)
+}
+
+func (debugger *Debugger) write(address uint16, value byte) {
+	debugger.core.writeMemory(address, value)
+}
+
+/*
+Run a command and return its output.
+*/
+func (debugger *Debugger) Execute(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return ""
+	}
+	core := debugger.core
+	cpu := &core.CPU
+
+	switch args[0] {
+	case "c", "continue":
+		debugger.Continue()
+		return ""
+	case "p", "pause":
+		debugger.Pause()
+		return ""
+	case "s", "step":
+		count := 1
+		if len(args) > 1 {
+			var err error
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 1 {
+				return "Invalid count: " + args[1] + "\n"
+			}
+		}
+		debugger.Step(count)
+		return ""
+	case "n", "next":
+		debugger.Next()
+		return ""
+	case "f", "finish":
+		debugger.Finish()
+		return ""
+	case "b", "break":
+		if len(args) < 2 {
+			return "Usage: break ADDR\n"
+		}
+		address, err := parseHex16(args[1])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		debugger.Breakpoints[address] = true
+		return fmt.Sprintf("Breakpoint at $%04X\n", address)
+	case "d", "delete":
+		if len(args) < 2 {
+			debugger.Breakpoints = map[uint16]bool{}
+			return "All breakpoints removed\n"
+		}
+		address, err := parseHex16(args[1])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		if !debugger.Breakpoints[address] {
+			return fmt.Sprintf("No breakpoint at $%04X\n", address)
+		}
+		delete(debugger.Breakpoints, address)
+		return fmt.Sprintf("Breakpoint at $%04X removed\n", address)
+	case "w", "watch":
+		if len(args) < 2 {
+			return "Usage: watch ADDR[-END] [r|w|rw]\n"
+		}
+		watchpoint := Watchpoint{Read: true, Write: true}
+		var err error
+		if watchpoint.Start, watchpoint.End, err = parseRange(args[1]); err != nil {
+			return err.Error() + "\n"
+		}
+		if len(args) > 2 {
+			watchpoint.Read = strings.Contains(args[2], "r")
+			watchpoint.Write = strings.Contains(args[2], "w")
+		}
+		debugger.Watchpoints = append(debugger.Watchpoints, watchpoint)
+		return "Watchpoint " + watchpoint.String() + "\n"
+	case "u", "unwatch":
+		if len(args) < 2 {
+			debugger.Watchpoints = nil
+			return "All watchpoints removed\n"
+		}
+		start, end, err := parseRange(args[1])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		var watchpoints []Watchpoint
+		for _, watchpoint := range debugger.Watchpoints {
+			if watchpoint.Start != start || watchpoint.End != end {
+				watchpoints = append(watchpoints, watchpoint)
+			}
+		}
+		if len(watchpoints) == len(debugger.Watchpoints) {
+			return "No such watchpoint\n"
+		}
+		debugger.Watchpoints = watchpoints
+		return "Watchpoint removed\n"
+	case "i", "info":
+		return debugger.info()
+	case "r", "regs":
+		return debugger.registers()
+	case "set":
+		if len(args) < 3 {
+			return "Usage: set REG VALUE\n"
+		}
+		value, err := parseHex16(args[2])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		if err := debugger.SetRegister(strings.ToUpper(args[1]), value); err != nil {
+			return err.Error() + "\n"
+		}
+		return debugger.registers()
+	case "x":
+		if len(args) < 2 {
+			return "Usage: x ADDR [count]\n"
+		}
+		address, err := parseHex16(args[1])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		count := 0x40
+		if len(args) > 2 {
+			if count, err = strconv.Atoi(args[2]); err != nil || count < 1 {
+				return "Invalid count: " + args[2] + "\n"
+			}
+		}
+		return debugger.memory(address, count)
+	case "write":
+		if len(args) < 3 {
+			return "Usage: write ADDR VALUE...\n"
+		}
+		address, err := parseHex16(args[1])
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		for i, arg := range args[2:] {
+			value, err := parseHex(arg)
+			if err != nil || value > 0xFF {
+				return "Invalid byte: " + arg + "\n"
+			}
+			debugger.write(address+uint16(i), byte(value))
+		}
+		return debugger.memory(address, len(args)-2)
+	case "l", "disasm":
+		address := cpu.Registers.PC
+		count := 10
+		var err error
+		if len(args) > 1 {
+			if address, err = parseHex16(args[1]); err != nil {
+				return err.Error() + "\n"
+			}
+		}
+		if len(args) > 2 {
+			if count, err = strconv.Atoi(args[2]); err != nil || count < 1 {
+				return "Invalid count: " + args[2] + "\n"
+			}
+		}
+		return debugger.disassemble(address, count)
+	case "dump":
+		if len(args) < 2 {
+			return "Usage: dump FILE\n"
+		}
+		data := make([]byte, 0x10000)
+		for address := range data {
+			data[address] = debugger.read(uint16(address))
+		}
+		if err := ioutil.WriteFile(args[1], data, 0644); err != nil {
+			return err.Error() + "\n"
+		}
+		return "Memory saved to " + args[1] + "\n"
+	case "q", "quit":
+		core.Exit = true
+		debugger.Breakpoints = map[uint16]bool{}
+		debugger.Watchpoints = nil
+		debugger.Continue()
+		return ""
+	case "h", "help":
+		return debuggerHelp + "\n"
+	}
+	return "Unknown command: " + args[0] + ", type help for the list of commands\n"
+}
+
+func (watchpoint Watchpoint) String() string {
+	access := ""
+	if watchpoint.Read {
+		access += "r"
+	}
+	if watchpoint.Write {
+		access += "w"
+	}
+	if watchpoint.Start == watchpoint.End {
+		return fmt.Sprintf("$%04X (%s)", watchpoint.Start, access)
+	}
+	return fmt.Sprintf("$%04X-$%04X (%s)", watchpoint.Start, watchpoint.End, access)
+}
+
+func (debugger *Debugger) info() string {
+	var res bytes.Buffer
+	res.WriteString("Breakpoints:\n")
+	for address := 0; address <= 0xFFFF; address++ {
+		if debugger.Breakpoints[uint16(address)] {
+			fmt.Fprintf(&res, "  $%04X\n", address)
+		}
+	}
+	res.WriteString("Watchpoints:\n")
+	for _, watchpoint := range debugger.Watchpoints {
+		fmt.Fprintf(&res, "  %s\n", watchpoint)
+	}
+	return res.String()
+}
+
+func (debugger *Debugger) registers() string {
+	core := debugger.core
+	cpu := &core.CPU
+	flags := ""
+	for i, name := range "ZNHC" {
+		if util.TestBit(cpu.Registers.F, uint(7-i)) {
+			flags += string(name)
+		} else {
+			flags += "-"
+		}
+	}
+	return fmt.Sprintf("AF:%04X  BC:%04X  DE:%04X  HL:%04X  SP:%04X  PC:%04X  F:%s  IME:%t  HALT:%t\nLCDC:%02X  STAT:%02X  LY:%02X  IF:%02X  IE:%02X\n",
+		cpu.getAF(), cpu.getBC(), cpu.getDE(), cpu.Registers.HL, cpu.Registers.SP, cpu.Registers.PC, flags,
+		cpu.Flags.InterruptMaster, cpu.Halt,
+		core.Memory.MainMemory[0xFF40], core.Memory.MainMemory[0xFF41], core.Memory.MainMemory[0xFF44],
+		core.Memory.MainMemory[0xFF0F], core.Memory.MainMemory[0xFFFF])
+}
+
+/*
+Return the registers of the CPU.
+*/
+func (debugger *Debugger) Registers() RegisterState {
+	cpu := &debugger.core.CPU
+	return RegisterState{
+		AF:   cpu.getAF(),
+		BC:   cpu.getBC(),
+		DE:   cpu.getDE(),
+		HL:   cpu.Registers.HL,
+		SP:   cpu.Registers.SP,
+		PC:   cpu.Registers.PC,
+		IME:  cpu.Flags.InterruptMaster,
+		Halt: cpu.Halt,
+	}
+}
+
+/*
+Set a register by name: A, B, C, D, E, F, H, L, AF, BC, DE, HL, SP or PC.
+*/
+func (debugger *Debugger) SetRegister(name string, value uint16) error {
+	cpu := &debugger.core.CPU
+	registers := map[string]*byte{
+		"A": &cpu.Registers.A, "B": &cpu.Registers.B, "C": &cpu.Registers.C,
+		"D": &cpu.Registers.D, "E": &cpu.Registers.E, "F": &cpu.Registers.F,
+	}
+	if register, ok := registers[name]; ok {
+		if value > 0xFF {
+			return fmt.Errorf("value too large for %s: $%X", name, value)
+		}
+		*register = byte(value)
+	} else {
+		switch name {
+		case "H":
+			debugger.core.setH(byte(value))
+		case "L":
+			debugger.core.setL(byte(value))
+		case "AF":
+			cpu.setAF(value)
+		case "BC":
+			cpu.setBC(value)
+		case "DE":
+			cpu.setDE(value)
+		case "HL":
+			cpu.Registers.HL = value
+		case "SP":
+			cpu.Registers.SP = value
+		case "PC":
+			cpu.Registers.PC = value
+		default:
+			return fmt.Errorf("unknown register: %s", name)
+		}
+	}
+	// The lower 4 bits of F are always zero, the flags follow F
+	cpu.Registers.F &= 0xF0
+	cpu.Flags.Zero = util.TestBit(cpu.Registers.F, 7)
+	cpu.Flags.Sub = util.TestBit(cpu.Registers.F, 6)
+	cpu.Flags.HalfCarry = util.TestBit(cpu.Registers.F, 5)
+	cpu.Flags.Carry = util.TestBit(cpu.Registers.F, 4)
+	return nil
+}
+
+func (debugger *Debugger) memory(address uint16, count int) string {
+	var res bytes.Buffer
+	for i := 0; i < count; i++ {
+		current := address + uint16(i)
+		if i%16 == 0 {
+			if i > 0 {
+				res.WriteString("\n")
+			}
+			fmt.Fprintf(&res, "%04X:", current)
+		}
+		fmt.Fprintf(&res, " %02X", debugger.read(current))
+	}
+	res.WriteString("\n")
+	return res.String()
+}
+
+/*
+Memory banks which can be read and written whether they are mapped or not:
+
+	rom    16KByte ROM banks
+	sram   8KByte external RAM banks, the EEPROM of MBC7 cartridges
+	vram   8KByte VRAM banks, 0-1
+	wram   4KByte WRAM banks, 0-7, bank 0 is always mapped at C000
+
+Addresses are taken modulo the bank size, so either offsets in the bank or
+the addresses the bank is mapped at can be given. ReadBank and WriteBank
+access the address space as the CPU sees it when the region is empty.
+*/
+func (debugger *Debugger) bank(region string, bank int) ([]byte, error) {
+	core := debugger.core
+	var memory []byte
+	size := 0
+	switch region {
+	case "rom":
+		memory, size = core.Cartridge.rom, 0x4000
+	case "sram":
+		memory, size = core.Cartridge.MBC.RAM(), 0x2000
+	case "vram":
+		if bank >= 0 && bank < len(core.Memory.VRAM) {
+			return core.Memory.VRAM[bank][:], nil
+		}
+	case "wram":
+		if bank >= 0 && bank < len(core.Memory.WRAM) {
+			return core.Memory.WRAM[bank][:], nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown memory region: %s", region)
+	}
+	if size > len(memory) {
+		// 2KByte RAMs, MBC2 and MBC7
+		size = len(memory)
+	}
+	if bank < 0 || size == 0 || (bank+1)*size > len(memory) {
+		return nil, fmt.Errorf("no %s bank %d", region, bank)
+	}
+	return memory[bank*size : (bank+1)*size], nil
+}
+
+/*
+Read count bytes of a memory bank, see bank for the regions.
+*/
+func (debugger *Debugger) ReadBank(region string, bank int, address uint16, count int) ([]byte, error) {
+	if region == "" {
+		if count < 0 || int(address)+count > 0x10000 {
+			return nil, errors.New("read past the end of the address space")
+		}
+		data := make([]byte, count)
+		for i := range data {
+			data[i] = debugger.read(address + uint16(i))
+		}
+		return data, nil
+	}
+	memory, err := debugger.bank(region, bank)
+	if err != nil {
+		return nil, err
+	}
+	offset := int(address) % len(memory)
+	if count < 0 || offset+count > len(memory) {
+		return nil, fmt.Errorf("read past the end of %s bank %d", region, bank)
+	}
+	return append([]byte{}, memory[offset:offset+count]...), nil
+}
+
+/*
+Write bytes to a memory bank directly, without going through the mapper.
+With an empty region, the bytes are written as the CPU would.
+*/
+func (debugger *Debugger) WriteBank(region string, bank int, address uint16, data []byte) error {
+	if region == "" {
+		if int(address)+len(data) > 0x10000 {
+			return errors.New("write past the end of the address space")
+		}
+		for i, value := range data {
+			debugger.write(address+uint16(i), value)
+		}
+		return nil
+	}
+	memory, err := debugger.bank(region, bank)
+	if err != nil {
+		return err
+	}
+	offset := int(address) % len(memory)
+	if offset+len(data) > len(memory) {
+		return fmt.Errorf("write past the end of %s bank %d", region, bank)
+	}
+	copy(memory[offset:], data)
+	return nil
+}
+
+func (debugger *Debugger) disassemble(address uint16, count int) string {
+	var res bytes.Buffer
+	for i := 0; i < count; i++ {
+		res.WriteString(debugger.instruction(address))
+		_, length := Disassemble(debugger.read, address)
+		address += uint16(length)
+	}
+	return res.String()
+}
+
+/*
+One disassembled instruction with its bytes, PC is marked with an arrow.
+*/
+func (debugger *Debugger) instruction(address uint16) string {
+	text, length := Disassemble(debugger.read, address)
+	data := ""
+	for i := 0; i < length; i++ {
+		data += fmt.Sprintf("%02X ", debugger.read(address+uint16(i)))
+	}
+	marker := "  "
+	if address == debugger.core.CPU.Registers.PC {
+		marker = "=>"
+	}
+	return fmt.Sprintf("%s %04X  %-9s %s\n", marker, address, data, text)
+}
+
+/*
+The last instructions executed and the next ones.
+*/
+func (debugger *Debugger) context() string {
+	var res bytes.Buffer
+	for _, address := range debugger.history {
+		res.WriteString(debugger.instruction(address))
+	}
+	res.WriteString(debugger.disassemble(debugger.core.CPU.Registers.PC, 5))
+	return res.String()
+}
+
+func parseHex(text string) (int, error) {
+	text = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(text), "$"), "0x")
+	value, err := strconv.ParseUint(text, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", text)
+	}
+	return int(value), nil
+}
+
+func parseHex16(text string) (uint16, error) {
+	value, err := parseHex(text)
+	if err != nil {
+		return 0, err
+	}
+	if value > 0xFFFF {
+		return 0, fmt.Errorf("invalid address: %s", text)
+	}
+	return uint16(value), nil
+}
+
+/*
+Parse ADDR or START-END.
+*/
+func parseRange(text string) (uint16, uint16, error) {
+	parts := strings.SplitN(text, "-", 2)
+	start, err := parseHex16(parts[0])
+	if err != nil || len(parts) == 1 {
+		return start, start, err
+	}
+	end, err := parseHex16(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid range: %s", text)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,54 @@
+package gb
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Disassemble the instruction at the given address, read is used to fetch its
+bytes. Return the instruction text and its length in bytes.
+
+The text is the OP string of the instruction with its operands filled in:
+d8, d16, a16 are immediate values, a8 is an address in FF00-FFFF and r8 is
+a signed offset, shown as the jump target for JR. Opcodes the CPU doesn't
+know are shown as a data byte.
+*/
+func Disassemble(read func(uint16) byte, address uint16) (string, int) {
+	code := read(address)
+	if code == 0xCB {
+		return CBOPName(read(address + 1)), 2
+	}
+	unit := OPCodeFunctionMap[code]
+	if unit.Clock == 0 {
+		return fmt.Sprintf("DB $%02X", code), 1
+	}
+	op := unit.OP
+	d8 := read(address + 1)
+	d16 := uint16(read(address+2))<<8 | uint16(d8)
+	switch {
+	case strings.Contains(op, "d16"):
+		return strings.Replace(op, "d16", fmt.Sprintf("$%04X", d16), 1), 3
+	case strings.Contains(op, "a16"):
+		return strings.Replace(op, "a16", fmt.Sprintf("$%04X", d16), 1), 3
+	case strings.Contains(op, "d8"):
+		return strings.Replace(op, "d8", fmt.Sprintf("$%02X", d8), 1), 2
+	case strings.Contains(op, "a8"):
+		return strings.Replace(op, "a8", fmt.Sprintf("$FF%02X", d8), 1), 2
+	case strings.HasPrefix(op, "JR"):
+		target := address + 2 + uint16(int8(d8))
+		return strings.Replace(op, "r8", fmt.Sprintf("$%04X", target), 1), 2
+	case strings.Contains(op, "r8"):
+		// ADD SP,r8 and LD HL,SP+r8
+		offset := fmt.Sprintf("+$%02X", d8)
+		if int8(d8) < 0 {
+			offset = fmt.Sprintf("-$%02X", -int(int8(d8)))
+		}
+		op = strings.Replace(op, "+r8", "r8", 1)
+		if !strings.HasSuffix(op, "SPr8") {
+			offset = strings.TrimPrefix(offset, "+")
+		}
+		return strings.Replace(op, "r8", offset, 1), 2
+	}
+	return op, 1
+}
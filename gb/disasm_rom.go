@@ -0,0 +1,386 @@
+package gb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+Disassemble a whole ROM, bank by bank, into RGBDS assembly.
+
+Code is told apart from data by following the program from the entry
+point and the interrupt vectors in use through jumps, calls and RSTs,
+every byte never reached is written as data. Banks are switched at run time, so
+the bank a jump to 4000-7FFF lands in is guessed: the bank last written to
+2000-3FFF with LD A,d8 and LD (a16),A on the way there, the bank of the
+jump itself, or bank 1 for ROMs without MBC. Jumps through registers,
+JP (HL) and jump tables, can't be followed.
+
+The data may be an archive, as for Init.
+*/
+func DisassembleROM(data []byte, out io.Writer) error {
+	rom, err := unpackROM(data)
+	if err != nil {
+		return err
+	}
+	if len(rom) < 0x150 {
+		return fmt.Errorf("ROM file too small: %d bytes", len(rom))
+	}
+	d := &romDisassembler{
+		rom:     rom,
+		banks:   (len(rom) + 0x3FFF) / 0x4000,
+		start:   make([]bool, len(rom)),
+		code:    make([]bool, len(rom)),
+		labels:  map[int]string{},
+		targets: map[int]int{},
+	}
+	for address, name := range romVectors {
+		// Unused interrupt vectors are filled with 00h or FFh
+		if address == 0x100 || address >= 0x40 && rom[address] != 0x00 && rom[address] != 0xFF {
+			d.labels[address] = name
+			d.trace(0, uint16(address))
+		}
+	}
+	for len(d.queue) > 0 {
+		next := d.queue[0]
+		d.queue = d.queue[1:]
+		d.trace(next.bank, next.address)
+	}
+
+	writer := bufio.NewWriter(out)
+	title := ""
+	for _, c := range rom[0x134:0x143] {
+		if c < 0x20 || c > 0x7E {
+			break
+		}
+		title += string(c)
+	}
+	fmt.Fprintf(writer, "; Disassembled by gbdotlive\n; Title: %s\n; ROM banks: %d\n", title, d.banks)
+	for bank := 0; bank < d.banks; bank++ {
+		d.writeBank(writer, bank)
+	}
+	return writer.Flush()
+}
+
+// Names of the RST and interrupt vectors and of the entry point
+var romVectors = map[int]string{
+	0x00: "RST_00", 0x08: "RST_08", 0x10: "RST_10", 0x18: "RST_18",
+	0x20: "RST_20", 0x28: "RST_28", 0x30: "RST_30", 0x38: "RST_38",
+	0x40: "VBlankInterrupt", 0x48: "LCDCInterrupt", 0x50: "TimerInterrupt",
+	0x58: "SerialInterrupt", 0x60: "JoypadInterrupt", 0x100: "Boot",
+}
+
+type romDisassembler struct {
+	rom   []byte
+	banks int
+	// Whether each byte of the ROM starts an instruction, or is part of one
+	start []bool
+	code  []bool
+	// Labels by ROM offset
+	labels map[int]string
+	// ROM offset of the target of each branch instruction, by ROM offset
+	targets map[int]int
+	// Code left to trace
+	queue []romAddress
+}
+
+type romAddress struct {
+	bank    int
+	address uint16
+}
+
+/*
+Offset in the ROM of an address in 0000-7FFF when bank is mapped at
+4000-7FFF, -1 if it is past the end of the ROM.
+*/
+func (d *romDisassembler) offset(bank int, address uint16) int {
+	offset := int(address)
+	if address >= 0x4000 {
+		offset = bank*0x4000 + int(address-0x4000)
+	}
+	if address >= 0x8000 || offset >= len(d.rom) {
+		return -1
+	}
+	return offset
+}
+
+/*
+Read function for Disassemble with bank mapped at 4000-7FFF.
+*/
+func (d *romDisassembler) reader(bank int) func(uint16) byte {
+	return func(address uint16) byte {
+		if offset := d.offset(bank, address); offset >= 0 {
+			return d.rom[offset]
+		}
+		return 0xFF
+	}
+}
+
+/*
+Length of the instruction at address, 0 if it isn't a valid instruction
+or runs past its bank.
+*/
+func (d *romDisassembler) length(bank int, address uint16) int {
+	code := d.reader(bank)(address)
+	if OPCodeFunctionMap[code].Clock == 0 && code != 0xCB {
+		return 0
+	}
+	_, length := Disassemble(d.reader(bank), address)
+	if code == 0x10 {
+		// STOP is followed by a byte which is skipped
+		length = 2
+	}
+	end := address + uint16(length) - 1
+	if end < address || address < 0x4000 && end >= 0x4000 || d.offset(bank, end) < 0 {
+		return 0
+	}
+	return length
+}
+
+/*
+Follow the code at address until it jumps away for good.
+*/
+func (d *romDisassembler) trace(bank int, address uint16) {
+	read := d.reader(bank)
+	// Bank selected by the code on the way, -1 if unknown, and the last value loaded in A
+	switched, lastA := -1, -1
+	for {
+		offset := d.offset(bank, address)
+		if offset < 0 || d.code[offset] {
+			return
+		}
+		length := d.length(bank, address)
+		if length == 0 {
+			return
+		}
+		d.start[offset] = true
+		for i := 0; i < length; i++ {
+			d.code[offset+i] = true
+		}
+
+		code := read(address)
+		d16 := uint16(read(address+2))<<8 | uint16(read(address+1))
+		switch {
+		case code == 0xC3 || code&0xE7 == 0xC2:
+			d.branch(offset, bank, d16, switched, "Jump")
+		case code == 0xCD || code&0xE7 == 0xC4:
+			d.branch(offset, bank, d16, switched, "Call")
+		case code == 0x18 || code&0xE7 == 0x20:
+			d.branch(offset, bank, address+2+uint16(int8(read(address+1))), bank, "Jump")
+		case code&0xC7 == 0xC7:
+			d.branch(offset, bank, uint16(code&0x38), switched, "")
+		case code == 0x3E:
+			lastA = int(read(address + 1))
+		case code == 0xEA && d16 >= 0x2000 && d16 < 0x4000 && lastA >= 0:
+			switched = lastA
+			if switched == 0 {
+				switched = 1
+			}
+		}
+
+		switch code {
+		case 0xC3, 0x18, 0xC9, 0xD9, 0xE9:
+			// JP, JR, RET, RETI, JP (HL)
+			return
+		}
+		address += uint16(length)
+	}
+}
+
+/*
+Queue the target of the jump, call or RST at from and give it a label.
+*/
+func (d *romDisassembler) branch(from int, bank int, target uint16, switched int, kind string) {
+	if target >= 0x4000 {
+		switch {
+		case target >= 0x8000:
+			// Code running from RAM
+			return
+		case switched > 0:
+			bank = switched
+		case bank == 0 && d.banks == 2:
+			bank = 1
+		case bank == 0:
+			return
+		}
+	} else {
+		bank = 0
+	}
+	offset := d.offset(bank, target)
+	if offset < 0 {
+		return
+	}
+	label := d.labels[offset]
+	switch {
+	case kind == "":
+		label = romVectors[int(target)]
+	case label == "" || kind == "Call" && strings.HasPrefix(label, "Jump_"):
+		label = fmt.Sprintf("%s_%03X_%04X", kind, bank, target)
+	}
+	d.labels[offset] = label
+	d.targets[from] = offset
+	d.queue = append(d.queue, romAddress{bank, target})
+}
+
+/*
+Write one bank as a section.
+*/
+func (d *romDisassembler) writeBank(out *bufio.Writer, bank int) {
+	base := uint16(0x4000)
+	if bank == 0 {
+		fmt.Fprintf(out, "\nSECTION \"ROM Bank $000\", ROM0[$0000]\n")
+		base = 0
+	} else {
+		fmt.Fprintf(out, "\nSECTION \"ROM Bank $%03X\", ROMX[$4000], BANK[$%X]\n", bank, bank)
+	}
+	end := (bank + 1) * 0x4000
+	if end > len(d.rom) {
+		end = len(d.rom)
+	}
+	for offset := bank * 0x4000; offset < end; {
+		address := base + uint16(offset-bank*0x4000)
+		if label, ok := d.labels[offset]; ok {
+			fmt.Fprintf(out, "\n%s:\n", label)
+		}
+		if length := d.instructionLength(offset); length > 0 {
+			text := d.instruction(bank, address)
+			fmt.Fprintf(out, "    %-24s ; %d\n", text, d.cycles(bank, address))
+			offset += length
+			continue
+		}
+
+		// Data up to the next instruction or label, runs of one value are written with ds
+		count := 1
+		for offset+count < end && !d.start[offset+count] && d.labels[offset+count] == "" {
+			count++
+		}
+		run := 1
+		for run < count && d.rom[offset+run] == d.rom[offset] {
+			run++
+		}
+		if run >= 16 {
+			fmt.Fprintf(out, "    ds %d, $%02X\n", run, d.rom[offset])
+			offset += run
+			continue
+		}
+		if count > 8 {
+			count = 8
+		}
+		values := make([]string, count)
+		for i := range values {
+			values[i] = fmt.Sprintf("$%02X", d.rom[offset+i])
+		}
+		fmt.Fprintf(out, "    db %s\n", strings.Join(values, ", "))
+		offset += count
+	}
+}
+
+/*
+Length of the instruction starting at offset, 0 if there is none or if
+another instruction or a label starts inside it, it is then written as data.
+*/
+func (d *romDisassembler) instructionLength(offset int) int {
+	if !d.start[offset] {
+		return 0
+	}
+	bank := offset / 0x4000
+	address := uint16(offset % 0x4000)
+	if bank > 0 {
+		address += 0x4000
+	}
+	length := d.length(bank, address)
+	for i := 1; i < length; i++ {
+		if d.start[offset+i] || d.labels[offset+i] != "" {
+			return 0
+		}
+	}
+	return length
+}
+
+/*
+Cycles taken by the instruction, when a branch isn't taken.
+*/
+func (d *romDisassembler) cycles(bank int, address uint16) int {
+	read := d.reader(bank)
+	if code := read(address); code != 0xCB {
+		return OPCodeFunctionMap[code].Clock
+	}
+	return CBCycles[read(address+1)] * 4
+}
+
+/*
+The instruction at address in RGBDS syntax, with labels for branch targets.
+*/
+func (d *romDisassembler) instruction(bank int, address uint16) string {
+	read := d.reader(bank)
+	code := read(address)
+	d8 := read(address + 1)
+	d16 := uint16(read(address+2))<<8 | uint16(d8)
+
+	var op string
+	switch {
+	case code == 0xCB:
+		op = CBOPName(d8)
+	case code == 0x10 && d8 == 0x00:
+		return "stop"
+	case code == 0x10:
+		// The assembler always writes 00h after STOP
+		return fmt.Sprintf("db $10, $%02X", d8)
+	case code == 0xE2:
+		return "ldh [c], a"
+	case code == 0xF2:
+		return "ldh a, [c]"
+	case code == 0xE9:
+		return "jp hl"
+	case code&0xC7 == 0xC7:
+		return fmt.Sprintf("rst $%02X", code&0x38)
+	default:
+		op = OPCodeFunctionMap[code].OP
+	}
+
+	operand := ""
+	switch {
+	case strings.Contains(op, "a16") && (strings.HasPrefix(op, "JP") || strings.HasPrefix(op, "CALL")):
+		operand = d.target(bank, address, d16)
+		op = strings.Replace(op, "a16", "@", 1)
+	case strings.HasPrefix(op, "JR"):
+		operand = d.target(bank, address, address+2+uint16(int8(d8)))
+		op = strings.Replace(op, "r8", "@", 1)
+	case strings.Contains(op, "d16"), strings.Contains(op, "a16"):
+		operand = fmt.Sprintf("$%04X", d16)
+		op = strings.Replace(strings.Replace(op, "d16", "@", 1), "a16", "@", 1)
+	case strings.Contains(op, "d8"):
+		operand = fmt.Sprintf("$%02X", d8)
+		op = strings.Replace(op, "d8", "@", 1)
+	case strings.Contains(op, "a8"):
+		operand = fmt.Sprintf("$FF%02X", d8)
+		op = strings.Replace(op, "a8", "@", 1)
+	case strings.Contains(op, "SP+r8"):
+		if int8(d8) < 0 {
+			operand = fmt.Sprintf("sp-%d", -int(int8(d8)))
+		} else {
+			operand = fmt.Sprintf("sp+%d", d8)
+		}
+		op = strings.Replace(op, "SP+r8", "@", 1)
+	case strings.Contains(op, "r8"):
+		operand = fmt.Sprintf("%d", int8(d8))
+		op = strings.Replace(op, "r8", "@", 1)
+	}
+
+	op = strings.ToLower(op)
+	op = strings.NewReplacer("(", "[", ")", "]", ",", ", ").Replace(op)
+	return strings.Replace(op, "@", operand, 1)
+}
+
+/*
+Label of the target of the branch at address if it has one, the target
+address otherwise.
+*/
+func (d *romDisassembler) target(bank int, address uint16, target uint16) string {
+	if offset, ok := d.targets[d.offset(bank, address)]; ok {
+		return d.labels[offset]
+	}
+	return fmt.Sprintf("$%04X", target)
+}
@@ -2,342 +2,472 @@ package gb
 
 import (
 	"github.com/HFO4/gbc-in-cloud/util"
-	"log"
 )
 
 /*
-	Draw the current scan line
+	State of the pixel processing unit. The PPU advances one dot at a time,
+	pixels are fetched into a background FIFO and a sprite FIFO and mixed
+	while they are shifted out to the LCD.
 */
-func (core *Core) DrawScanLine() {
+type PPU struct {
+	// Dot of the current scan line, 0-455
+	Dot int
+	// Current LCD mode, same as the lower two STAT bits
+	Mode byte
+	// Set while the LCD is disabled in LCDC.7
+	Off bool
+	// Next LCD pixel to be drawn in the current scan line
+	X int
+	// Pixels left to discard at the start of the line, scrolled out by SCX
+	Discard int
+	// Dots the pixel transfer is stalled for
+	Stall int
+
+	// Internal window line counter, only incremented on lines the window was drawn on
+	WindowLine int
+	// Whether WY matched LY in the current frame
+	WindowTriggered bool
+	// Whether the window has been drawn in the current scan line
+	WindowDrawn bool
+
+	BGFIFO  PixelFIFO
+	OBJFIFO PixelFIFO
+	Fetcher Fetcher
+
+	// Sprites found by the OAM scan of the current line, at most 10
+	Sprites     [10]Sprite
+	SpriteCount int
+
+	// Level of the STAT interrupt line, an interrupt is requested on its rising edge
+	StatLine bool
+}
 
-	//	FF40 - LCDC - LCD Control (R/W)
-	//  	Bit 7 - LCD Display Enable             (0=Off, 1=On)
-	//  	Bit 6 - Window Tile Map Display Select (0=9800-9BFF, 1=9C00-9FFF)
-	//  	Bit 5 - Window Display Enable          (0=Off, 1=On)
-	//  	Bit 4 - BG & Window Tile Data Select   (0=8800-97FF, 1=8000-8FFF)
-	//  	Bit 3 - BG Tile Map Display Select     (0=9800-9BFF, 1=9C00-9FFF)
-	//  	Bit 2 - OBJ (Sprite) Size              (0=8x8, 1=8x16)
-	//  	Bit 1 - OBJ (Sprite) Display Enable    (0=Off, 1=On)
-	//  	Bit 0 - BG Display (for CGB see below) (0=Off, 1=On)
-	control := core.ReadMemory(0xFF40)
+/*
+	A pixel waiting in one of the FIFOs.
+*/
+type Pixel struct {
+	// Colour number 0-3, 0 is transparent for sprites
+	Colour byte
+	// DMG: sprite palette OBP0/OBP1, CGB: palette number 0-7
+	Palette byte
+	// BG: BG-to-OAM priority in CGB mode, Sprite: OBJ-to-BG priority (1=behind BG colour 1-3)
+	Priority bool
+	// OAM index of the sprite this pixel belongs to
+	OAMIndex byte
+}
 
-	//	LCDC.0 - 1) Monochrome Gameboy and SGB: BG Display
-	//	When Bit 0 is cleared, the background becomes blank (white).
-	//	Window and Sprites may still be displayed (if enabled in Bit 1 and/or Bit 5).
-	if util.TestBit(control, 0) {
-		core.RenderTiles()
-	}
+/*
+	FIFO of up to 16 pixels.
+*/
+type PixelFIFO struct {
+	Pixels [16]Pixel
+	Head   int
+	Len    int
+}
 
-	if util.TestBit(control, 1) {
-		core.RenderSprites()
-	}
+func (fifo *PixelFIFO) push(pixel Pixel) {
+	fifo.Pixels[(fifo.Head+fifo.Len)&0xF] = pixel
+	fifo.Len++
+}
+
+func (fifo *PixelFIFO) pop() Pixel {
+	pixel := fifo.Pixels[fifo.Head]
+	fifo.Head = (fifo.Head + 1) & 0xF
+	fifo.Len--
+	return pixel
+}
+
+func (fifo *PixelFIFO) at(i int) *Pixel {
+	return &fifo.Pixels[(fifo.Head+i)&0xF]
+}
+
+func (fifo *PixelFIFO) clear() {
+	fifo.Head = 0
+	fifo.Len = 0
 }
 
 /*
-	Render Sprites
+	Background/window tile fetcher. Each step takes 2 dots:
+		0-1 Get tile number
+		2-3 Get tile data low
+		4-5 Get tile data high
+		6-  Push the 8 pixels once the background FIFO is empty
 */
-func (core *Core) RenderSprites() {
-	use8x16 := false
-	lcdControl := core.ReadMemory(0xFF40)
-
-	if util.TestBit(lcdControl, 2) {
-		use8x16 = true
-	}
-	for sprite := 0; sprite < 40; sprite++ {
-		// sprite occupies 4 bytes in the sprite attributes table
-		index := sprite * 4
-		yPos := core.ReadMemory(0xFE00+uint16(index)) - 16
-		xPos := core.ReadMemory(0xFE00+uint16(index)+1) - 8
-		tileLocation := core.ReadMemory(uint16(0xFE00 + index + 2))
-		attributes := core.ReadMemory(0xFE00 + uint16(index) + 3)
-
-		yFlip := util.TestBit(attributes, 6)
-		xFlip := util.TestBit(attributes, 5)
-		priority := !util.TestBit(attributes, 7)
-		scanline := core.ReadMemory(0xFF44)
-
-		ysize := 8
-		if use8x16 {
-			ysize = 16
-		}
+type Fetcher struct {
+	Step int
+	// Tile column to fetch, relative to SCX or to the window
+	TileX      byte
+	TileNum    byte
+	Attributes byte
+	Line       byte
+	DataLow    byte
+	DataHigh   byte
+	// Whether the window is being fetched instead of the background
+	Window bool
+}
 
-		// does this sprite intercept with the scanline?
-		if (scanline >= yPos) && (scanline < (yPos + byte(ysize))) {
-			line := int(scanline - yPos)
-			// read the sprite in backwards in the y axis
-			if yFlip {
-				line -= ysize
-				line *= -1
-			}
-			line *= 2 // same as for tiles
-			dataAddress := (uint16(int(tileLocation)*16 + line))
-			data1 := core.ReadMemory(0x8000 + dataAddress)
-			data2 := core.ReadMemory(0x8000 + dataAddress + 1)
-
-			// its easier to read in from right to left as pixel 0 is
-			// bit 7 in the colour data, pixel 1 is bit 6 etc...
-			for tilePixel := 7; tilePixel >= 0; tilePixel-- {
-				colourbit := tilePixel
-
-				// read the sprite in backwards for the x axis
-				if xFlip {
-					colourbit -= 7
-					colourbit *= -1
-				}
-
-				colourNum := util.GetVal(data2, uint(colourbit))
-				colourNum <<= 1
-				colourNum |= util.GetVal(data1, uint(colourbit))
-				colourAddress := uint16(0xFF48)
-				if util.TestBit(attributes, 4) {
-					colourAddress = 0xFF49
-				}
-				// now we have the colour id get the actual
-				// colour from palette 0xFF47
-				colour := core.GetColour(colourNum, colourAddress)
-
-				// white is transparent for sprites.
-				if colourNum == 0 {
-					continue
-				}
-
-				red := uint8(0)
-				green := uint8(0)
-				blue := uint8(0)
-
-				switch colour {
-				case 0:
-					red = 255
-					green = 255
-					blue = 255
-				case 1:
-					red = 0xCC
-					green = 0xCC
-					blue = 0xCC
-				case 2:
-					red = 0x77
-					green = 0x77
-					blue = 0x77
-				default:
-					red = 0
-					green = 0
-					blue = 0
-				}
-
-				xPix := 0 - tilePixel
-				xPix += 7
-
-				pixel := int(xPos) + xPix
-
-				// sanity check
-				if (scanline < 0) || (scanline > 143) || (pixel < 0) || (pixel > 159) {
-					continue
-				}
-
-				if core.ScanLineBG[pixel] || priority {
-					core.Screen[pixel][scanline][0] = red
-					core.Screen[pixel][scanline][1] = green
-					core.Screen[pixel][scanline][2] = blue
-				}
+/*
+	A sprite selected by the OAM scan.
+*/
+type Sprite struct {
+	Y          byte
+	X          byte
+	Tile       byte
+	Attributes byte
+	Index      byte
+	Fetched    bool
+}
 
+/*
+	Search the OAM for the sprites on the current scan line, at most 10 are kept in OAM order.
+
+	Byte0 - Y Position
+	Byte1 - X Position
+	Byte2 - Tile/Pattern Number
+	Byte3 - Attributes/Flags:
+	  Bit7   OBJ-to-BG Priority (0=OBJ Above BG, 1=OBJ Behind BG color 1-3)
+	  Bit6   Y flip          (0=Normal, 1=Vertically mirrored)
+	  Bit5   X flip          (0=Normal, 1=Horizontally mirrored)
+	  Bit4   Palette number  **Non CGB Mode Only** (0=OBP0, 1=OBP1)
+	  Bit3   Tile VRAM-Bank  **CGB Mode Only**     (0=Bank 0, 1=Bank 1)
+	  Bit2-0 Palette number  **CGB Mode Only**     (OBP0-7)
+*/
+func (core *Core) scanOAM() {
+	ppu := &core.PPU
+	ppu.SpriteCount = 0
+	height := 8
+	if util.TestBit(core.Memory.MainMemory[0xFF40], 2) {
+		height = 16
+	}
+	line := int(core.Memory.MainMemory[0xFF44]) + 16
+	for index := 0; index < 40 && ppu.SpriteCount < 10; index++ {
+		oam := core.Memory.MainMemory[0xFE00+index*4 : 0xFE00+index*4+4]
+		if line >= int(oam[0]) && line < int(oam[0])+height {
+			ppu.Sprites[ppu.SpriteCount] = Sprite{
+				Y:          oam[0],
+				X:          oam[1],
+				Tile:       oam[2],
+				Attributes: oam[3],
+				Index:      byte(index),
 			}
+			ppu.SpriteCount++
 		}
-
 	}
 }
 
-var last uint16
+/*
+	Prepare the FIFOs and the fetcher at the start of mode 3.
+*/
+func (core *Core) startPixelTransfer() {
+	ppu := &core.PPU
+	ppu.X = 0
+	// The first 8 pixels are fetched twice, and the fine scroll of SCX is discarded
+	ppu.Stall = 6
+	ppu.Discard = int(core.Memory.MainMemory[0xFF43] & 0x7)
+	ppu.BGFIFO.clear()
+	ppu.OBJFIFO.clear()
+	ppu.Fetcher = Fetcher{}
+}
 
 /*
-	Render Tiles for the current scan line
+	Advance the pixel transfer by one dot, return whether the scan line is complete.
 */
-func (core *Core) RenderTiles() {
-	var tileData uint16 = 0
-	var backgroundMemory uint16 = 0
-	var unsig bool = true
-	lcdControl := core.ReadMemory(0xFF40)
-
-	//	FF42 - SCY - Scroll Y (R/W)
-	//	FF43 - SCX - Scroll X (R/W)
-	//		Specifies the position in the 256x256 pixels BG map (32x32 tiles)
-	//		which is to be displayed at the upper/left LCD display position.
-	//		Values in range from 0-255 may be used for X/Y each, the video
-	//		controller automatically wraps back to the upper (left) position
-	//		in BG map when drawing exceeds the lower (right) border of the BG
-	//		map area.
-	scrollY := core.ReadMemory(0xFF42)
-	scrollX := core.ReadMemory(0xFF43)
+func (core *Core) stepPixelTransfer() bool {
+	ppu := &core.PPU
+	if ppu.Stall > 0 {
+		ppu.Stall--
+		return false
+	}
+
+	//	FF40 - LCDC - LCD Control (R/W)
+	//  	Bit 7 - LCD Display Enable             (0=Off, 1=On)
+	//  	Bit 6 - Window Tile Map Display Select (0=9800-9BFF, 1=9C00-9FFF)
+	//  	Bit 5 - Window Display Enable          (0=Off, 1=On)
+	//  	Bit 4 - BG & Window Tile Data Select   (0=8800-97FF, 1=8000-8FFF)
+	//  	Bit 3 - BG Tile Map Display Select     (0=9800-9BFF, 1=9C00-9FFF)
+	//  	Bit 2 - OBJ (Sprite) Size              (0=8x8, 1=8x16)
+	//  	Bit 1 - OBJ (Sprite) Display Enable    (0=Off, 1=On)
+	//  	Bit 0 - BG Display (for CGB see below) (0=Off, 1=On)
+	control := core.Memory.MainMemory[0xFF40]
 
 	//	FF4A - WY - Window Y Position (R/W)
 	//	FF4B - WX - Window X Position minus 7 (R/W)
-	//		Specifies the upper/left positions of the Window area.
-	//		(The window is an alternate background area which can be
-	//		displayed above of the normal background. OBJs (sprites)
-	//		may be still displayed above or behinf the window, just as
-	//		for normal BG.)
-	//
 	//		The window becomes visible (if enabled) when positions are set
 	//		in range WX=0..166, WY=0..143. A postion of WX=7, WY=0 locates
 	//		the window at upper left, it is then completly covering normal
 	//		background.
-	windowY := core.ReadMemory(0xFF4A)
-	windowX := int(core.ReadMemory(0xFF4B)) - 7
-
-	usingWindow := false
-
-	// is the window enabled?
-	if util.TestBit(lcdControl, 5) {
-
-		// is the current scan line we're drawing
-		// within the windows Y pos?,
-		if windowY <= core.ReadMemory(0xFF44) {
-			usingWindow = true
+	//	On monochrome Gameboys LCDC.0 also hides the window.
+	windowEnabled := util.TestBit(control, 5) && (util.TestBit(control, 0) || core.CGBMode)
+	windowX := int(core.Memory.MainMemory[0xFF4B])
+	if !ppu.Fetcher.Window && windowEnabled && ppu.WindowTriggered && ppu.X+7 >= windowX {
+		// Restart the fetcher on the window, pixels already fetched are dropped
+		ppu.BGFIFO.clear()
+		ppu.Fetcher = Fetcher{Window: true}
+		ppu.WindowDrawn = true
+		ppu.Discard = 0
+		if windowX < 7 {
+			ppu.Discard = 7 - windowX
 		}
+		return false
 	}
 
-	// which tile data are we using?
-	if util.TestBit(lcdControl, 4) {
-		tileData = 0x8000
-	} else {
-		// IMPORTANT: This memory region uses signed
-		// bytes as tile identifiers
-		tileData = 0x8800
-		unsig = false
-	}
-
-	// which background mem?
-	if !usingWindow {
-		if util.TestBit(lcdControl, 3) {
-			backgroundMemory = 0x9C00
-		} else {
-			backgroundMemory = 0x9800
-		}
-	} else {
-		if util.TestBit(lcdControl, 6) {
-			backgroundMemory = 0x9C00
-		} else {
-			backgroundMemory = 0x9800
+	// Fetch the sprites starting at the current pixel, the background fetch
+	// in progress is completed first
+	if util.TestBit(control, 1) {
+		for i := 0; i < ppu.SpriteCount; i++ {
+			sprite := &ppu.Sprites[i]
+			if sprite.Fetched || int(sprite.X) > ppu.X+8 {
+				continue
+			}
+			if ppu.Fetcher.Step < 6 {
+				core.stepFetcher()
+				return false
+			}
+			core.fetchSprite(sprite)
+			ppu.Stall = 5
+			return false
 		}
 	}
 
-	// yPos is used to calculate which of 32 vertical tiles the
-	// current scanline is drawing
-	var yPos byte = 0
-	if !usingWindow {
-		yPos = scrollY + core.ReadMemory(0xFF44)
-	} else {
-		yPos = core.ReadMemory(0xFF44) - windowY
+	core.stepFetcher()
+	if ppu.BGFIFO.Len == 0 {
+		return false
 	}
 
-	// which of the 8 vertical pixels of the current
-	// tile is the scanline on?
-	var tileRow = ((uint16(yPos / 8)) * 32)
+	bg := ppu.BGFIFO.pop()
+	if ppu.Discard > 0 {
+		ppu.Discard--
+		return false
+	}
+	var obj Pixel
+	if ppu.OBJFIFO.Len > 0 {
+		obj = ppu.OBJFIFO.pop()
+	}
 
-	// time to start drawing the 160 horizontal pixels
-	// for this scanline
-	for pixel := byte(0); pixel < 160; pixel++ {
+	rgb := core.mixPixel(control, bg, obj)
+	scanline := core.Memory.MainMemory[0xFF44]
+	core.Screen[ppu.X][scanline] = rgb
+	ppu.X++
+	return ppu.X == 160
+}
 
-		xPos := int(byte(pixel) + scrollX)
+/*
+	Advance the background/window fetcher by one dot.
+*/
+func (core *Core) stepFetcher() {
+	ppu := &core.PPU
+	fetcher := &ppu.Fetcher
+	control := core.Memory.MainMemory[0xFF40]
 
-		// translate the current x pos to window space if necessary
-		if usingWindow {
-			if int(pixel) >= windowX {
-				xPos = int(pixel) - windowX
+	switch fetcher.Step {
+	case 1:
+		var mapAddress uint16
+		var tileY byte
+		if fetcher.Window {
+			mapAddress = 0x1800
+			if util.TestBit(control, 6) {
+				mapAddress = 0x1C00
+			}
+			tileY = byte(ppu.WindowLine)
+		} else {
+			mapAddress = 0x1800
+			if util.TestBit(control, 3) {
+				mapAddress = 0x1C00
 			}
+			//	FF42 - SCY - Scroll Y (R/W)
+			//	FF43 - SCX - Scroll X (R/W)
+			//		Specifies the position in the 256x256 pixels BG map (32x32 tiles)
+			//		which is to be displayed at the upper/left LCD display position.
+			tileY = core.Memory.MainMemory[0xFF44] + core.Memory.MainMemory[0xFF42]
+			mapAddress += uint16(core.Memory.MainMemory[0xFF43] >> 3)
+		}
+		mapAddress = mapAddress&0x1C00 | (mapAddress+uint16(fetcher.TileX))&0x1F | uint16(tileY>>3)<<5
+		fetcher.Line = tileY & 0x7
+		fetcher.TileNum = core.Memory.VRAM[0][mapAddress]
+
+		//	In CGB mode, VRAM bank 1 holds an attribute byte for each tile in the BG map
+		//	  Bit 0-2  Background Palette number  (BGP0-7)
+		//	  Bit 3    Tile VRAM Bank number      (0=Bank 0, 1=Bank 1)
+		//	  Bit 4    Not used
+		//	  Bit 5    Horizontal Flip            (0=Normal, 1=Mirror horizontally)
+		//	  Bit 6    Vertical Flip              (0=Normal, 1=Mirror vertically)
+		//	  Bit 7    BG-to-OAM Priority         (0=Use OAM priority bit, 1=BG Priority)
+		fetcher.Attributes = 0
+		if core.CGBMode {
+			fetcher.Attributes = core.Memory.VRAM[1][mapAddress]
 		}
+	case 3:
+		fetcher.DataLow = core.Memory.VRAM[fetcher.bank()][core.tileDataAddress(control, fetcher)]
+	case 5:
+		fetcher.DataHigh = core.Memory.VRAM[fetcher.bank()][core.tileDataAddress(control, fetcher)+1]
+	}
 
-		// which of the 32 horizontal tiles does this xPos fall within?
-		tileCol := uint16(xPos / 8)
-		var tileNum int16
+	if fetcher.Step < 6 {
+		fetcher.Step++
+		return
+	}
 
-		// get the tile identity number. Remember it can be signed
-		// or unsigned
-		tileAddress := backgroundMemory + tileRow + tileCol
-		if unsig {
-			tileNum = int16(core.ReadMemory(tileAddress))
-		} else {
-			tileNum = int16(int8(core.ReadMemory(tileAddress)))
+	// Push a whole tile row when the FIFO is empty
+	if ppu.BGFIFO.Len != 0 {
+		return
+	}
+	for i := uint(0); i < 8; i++ {
+		// pixel 0 in the tile is bit 7 of data 1 and data2.
+		bit := 7 - i
+		if util.TestBit(fetcher.Attributes, 5) {
+			bit = i
 		}
+		ppu.BGFIFO.push(Pixel{
+			Colour:   util.GetVal(fetcher.DataHigh, bit)<<1 | util.GetVal(fetcher.DataLow, bit),
+			Palette:  fetcher.Attributes & 0x7,
+			Priority: util.TestBit(fetcher.Attributes, 7),
+		})
+	}
+	fetcher.TileX++
+	fetcher.Step = 0
+}
 
-		// deduce where this tile identifier is in memory.
-		tileLocation := tileData
-		if unsig {
-			tileLocation += uint16(tileNum * 16)
-		} else {
-			tileLocation = uint16(int32(tileLocation) + int32((tileNum+128)*16))
-		}
+func (fetcher *Fetcher) bank() int {
+	if util.TestBit(fetcher.Attributes, 3) {
+		return 1
+	}
+	return 0
+}
 
-		// find the correct vertical line we're on of the
-		// tile to get the tile data
-		//	from in memory
-		line := yPos % 8
-		// each vertical line takes up two bytes of memory
-		line *= 2
-		data1 := core.ReadMemory(tileLocation + uint16(line))
-		data2 := core.ReadMemory(tileLocation + uint16(line) + 1)
-		if last == 0x86F0 && (tileLocation+uint16(line) == 0x8000) {
-			log.Printf("%X\n", tileNum)
+/*
+	VRAM offset of the tile row being fetched.
+	With LCDC.4 cleared, tiles are in 8800-97FF and use signed tile numbers.
+*/
+func (core *Core) tileDataAddress(control byte, fetcher *Fetcher) uint16 {
+	line := fetcher.Line
+	if util.TestBit(fetcher.Attributes, 6) {
+		line = 7 - line
+	}
+	if util.TestBit(control, 4) {
+		return uint16(fetcher.TileNum)*16 + uint16(line)*2
+	}
+	return uint16(0x1000+int(int8(fetcher.TileNum))*16) + uint16(line)*2
+}
 
+/*
+	Fetch the current line of a sprite and merge it into the sprite FIFO.
+	Pixels already in the FIFO win, except in CGB mode where the sprite with
+	the lower OAM index is drawn on top.
+*/
+func (core *Core) fetchSprite(sprite *Sprite) {
+	ppu := &core.PPU
+	sprite.Fetched = true
+	control := core.Memory.MainMemory[0xFF40]
+
+	height := 8
+	tile := sprite.Tile
+	if util.TestBit(control, 2) {
+		height = 16
+		tile &= 0xFE
+	}
+	line := int(core.Memory.MainMemory[0xFF44]) + 16 - int(sprite.Y)
+	if util.TestBit(sprite.Attributes, 6) {
+		line = height - 1 - line
+	}
+	address := uint16(tile)*16 + uint16(line)*2
+
+	// In CGB mode, Bit 3 of the attributes selects the VRAM bank of the tile
+	bank := 0
+	palette := (sprite.Attributes >> 4) & 0x1
+	if core.CGBMode {
+		if util.TestBit(sprite.Attributes, 3) {
+			bank = 1
 		}
-		last = tileLocation + uint16(line)
-
-		// pixel 0 in the tile is it 7 of data 1 and data2.
-		// Pixel 1 is bit 6 etc..
-		var colourBit int = int(xPos % 8)
-		colourBit -= 7
-		colourBit *= -1
-
-		// combine data 2 and data 1 to get the colour id for this pixel
-		// in the tile
-		colourNum := util.GetVal(data2, uint(colourBit))
-		colourNum <<= 1
-		colourNum |= util.GetVal(data1, uint(colourBit))
-
-		// now we have the colour id get the actual
-		// colour from palette 0xFF47
-		colour := core.GetColour(colourNum, 0xFF47)
-
-		red := uint8(0)
-		green := uint8(0)
-		blue := uint8(0)
-
-		switch colour {
-		case 0:
-			red = 255
-			green = 255
-			blue = 255
-		case 1:
-			red = 0xCC
-			green = 0xCC
-			blue = 0xCC
-		case 2:
-			red = 0x77
-			green = 0x77
-			blue = 0x77
-		default:
-			red = 0
-			green = 0
-			blue = 0
+		palette = sprite.Attributes & 0x7
+	}
+	data1 := core.Memory.VRAM[bank][address]
+	data2 := core.Memory.VRAM[bank][address+1]
+
+	for ppu.OBJFIFO.Len < 8 {
+		ppu.OBJFIFO.push(Pixel{})
+	}
+
+	// Sprites partially hidden on the left are shifted
+	offset := ppu.X + 8 - int(sprite.X)
+	for i := offset; i < 8; i++ {
+		bit := uint(7 - i)
+		if util.TestBit(sprite.Attributes, 5) {
+			bit = uint(i)
 		}
-		finally := int(core.ReadMemory(0xFF44))
-		// safety check to make sure what im about
-		// to set is int the 160x144 bounds
-		if (finally < 0) || (finally > 143) || (pixel < 0) || (pixel > 159) {
+		colourNum := util.GetVal(data2, bit)<<1 | util.GetVal(data1, bit)
+		// colour 0 is transparent for sprites
+		if colourNum == 0 {
 			continue
 		}
+		pixel := ppu.OBJFIFO.at(i - offset)
+		if pixel.Colour == 0 || (core.CGBMode && sprite.Index < pixel.OAMIndex) {
+			*pixel = Pixel{
+				Colour:   colourNum,
+				Palette:  palette,
+				Priority: util.TestBit(sprite.Attributes, 7),
+				OAMIndex: sprite.Index,
+			}
+		}
+	}
+}
+
+/*
+	Mix a background and a sprite pixel and get its 24bit colour.
+*/
+func (core *Core) mixPixel(control byte, bg Pixel, obj Pixel) [3]uint8 {
+	//	LCDC.0 - 1) Monochrome Gameboy and SGB: BG Display
+	//	When Bit 0 is cleared, the background becomes blank (white).
+	//	Window and Sprites may still be displayed (if enabled in Bit 1 and/or Bit 5).
+	//	LCDC.0 - 2) CGB in CGB Mode: BG and Window Master Priority
+	//	When Bit 0 is cleared, the background and window lose their priority,
+	//	the sprites will be always displayed on top of background and window.
+	bgEnabled := util.TestBit(control, 0)
+	if !core.CGBMode && !bgEnabled {
+		bg.Colour = 0
+	}
 
-		// Store whether the background is white
-		if colour == 0 {
-			core.ScanLineBG[pixel] = true
+	showSprite := obj.Colour != 0 && util.TestBit(control, 1)
+	if showSprite {
+		if core.CGBMode {
+			showSprite = !bgEnabled || bg.Colour == 0 || (!bg.Priority && !obj.Priority)
 		} else {
-			core.ScanLineBG[pixel] = false
+			showSprite = bg.Colour == 0 || !obj.Priority
 		}
+	}
 
-		core.Screen[pixel][finally][0] = red
-		core.Screen[pixel][finally][1] = green
-		core.Screen[pixel][finally][2] = blue
+	if core.CGBMode {
+		if showSprite {
+			return core.OBJPalette.Colour(obj.Palette, obj.Colour)
+		}
+		return core.BGPalette.Colour(bg.Palette, bg.Colour)
+	}
+	// In DMG compatibility mode, the monochrome shades index the colour palettes set up by the boot ROM
+	if core.CGBHardware {
+		if showSprite {
+			return core.OBJPalette.Colour(obj.Palette, byte(core.GetColour(obj.Colour, 0xFF48+uint16(obj.Palette))))
+		}
+		return core.BGPalette.Colour(0, byte(core.GetColour(bg.Colour, 0xFF47)))
+	}
+	if showSprite {
+		return shadeColour(core.GetColour(obj.Colour, 0xFF48+uint16(obj.Palette)))
 	}
+	return shadeColour(core.GetColour(bg.Colour, 0xFF47))
+}
 
+/*
+	Get the 24bit colour of a monochrome shade.
+*/
+func shadeColour(colour int) [3]uint8 {
+	switch colour {
+	case 0:
+		return [3]uint8{255, 255, 255}
+	case 1:
+		return [3]uint8{0xCC, 0xCC, 0xCC}
+	case 2:
+		return [3]uint8{0x77, 0x77, 0x77}
+	default:
+		return [3]uint8{0, 0, 0}
+	}
 }
 
 /*
@@ -346,11 +476,10 @@ func (core *Core) RenderTiles() {
 		1 - LIGHT_GRAY
 		2 - DARK_GRAY
 		3 - BLACK
-	TODO: GCB mode
 */
 func (core *Core) GetColour(colourNum byte, address uint16) int {
 	res := 0
-	palette := core.ReadMemory(address)
+	palette := core.readMemory(address)
 
 	// which bits of the colour palette does the colour id map to?
 	var hi uint
@@ -0,0 +1,324 @@
+package gb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+Value read from the infrared register. Bit 0 is set when the receiver sees
+light, there is never another device in front of the emulated cartridge.
+*/
+const irNoLight = 0xC0
+
+/*
+====================================
+
+	HuC1
+*/
+type HuC1 struct {
+	rom            []byte
+	CurrentROMBank byte
+	RAMBank        []byte
+	CurrentRAMBank byte
+	// Whether A000-BFFF maps the infrared register instead of the RAM
+	IRMode bool
+	// Whether the infrared LED is on
+	IRLed bool
+}
+
+func (mbc *HuC1) ReadRomBank(address uint16) byte {
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
+}
+
+/*
+A000-BFFF - RAM Bank 00-03 or infrared register (Read/Write)
+
+	HuC1 has no RAM enable, the RAM is always accessible unless the
+	infrared register is selected.
+*/
+func (mbc *HuC1) ReadRamBank(address uint16) byte {
+	if mbc.IRMode {
+		return irNoLight
+	}
+	if len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
+}
+
+func (mbc *HuC1) WriteRamBank(address uint16, data byte) {
+	if mbc.IRMode {
+		mbc.IRLed = util.TestBit(data, 0)
+	} else if len(mbc.RAMBank) > 0 {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
+	}
+}
+
+func (mbc *HuC1) ReadRom(address uint16) byte {
+	return readRomBank(mbc.rom, 0, address)
+}
+
+func (mbc *HuC1) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		/*
+			0000-1FFF - RAM/IR Select (Write Only)
+				Writing 0Eh maps the infrared register at A000-BFFF,
+				any other value maps the RAM.
+		*/
+		mbc.IRMode = val&0xF == 0xE
+	} else if (address >= 0x2000) && (address < 0x4000) {
+		/*
+			2000-3FFF - ROM Bank Number (Write Only)
+				6bit ROM bank number, unlike MBC1 writing 00h maps bank 00h.
+		*/
+		mbc.CurrentROMBank = val & 0x3F
+	} else if (address >= 0x4000) && (address < 0x6000) {
+		/*
+			4000-5FFF - RAM Bank Number (Write Only)
+		*/
+		mbc.CurrentRAMBank = val & 0x3
+	}
+}
+
+func (mbc *HuC1) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
+}
+
+func (mbc *HuC1) RAM() []byte {
+	return mbc.RAMBank
+}
+
+/*
+		HuC1  END
+	====================================
+*/
+
+/*
+====================================
+
+	HuC3
+*/
+type HuC3 struct {
+	rom            []byte
+	CurrentROMBank byte
+	RAMBank        []byte
+	CurrentRAMBank byte
+	/*
+		Register mapped at A000-BFFF, selected by writing to 0000-1FFF:
+		  00h  RAM, read only
+		  0Ah  RAM, read/write
+		  0Bh  RTC command (write)
+		  0Ch  RTC command result (read)
+		  0Dh  RTC semaphore
+		  0Eh  Infrared
+	*/
+	Mode  byte
+	IRLed bool
+	RTC   HuC3RTC
+}
+
+/*
+HuC3 real time clock. It is driven through commands written to A000 in
+mode 0Bh, the upper nibble being the command and the lower nibble its
+argument:
+
+	1h  Read the nibble at the current address into the result, increment the address
+	3h  Write the argument at the current address, increment the address
+	4h  Set the lower nibble of the address
+	5h  Set the upper nibble of the address
+	6h  Extended command: 0 copies the time into nibbles 00h-05h, 1 sets the
+	    time from them, 2 reports the clock as ready
+
+The time is stored as a 12bit minute of the day followed by a 12bit day
+counter, least significant nibble first.
+*/
+type HuC3RTC struct {
+	// Minute of the day, 0-1439
+	Minutes uint16
+	// 12bit day counter
+	Days         uint16
+	AlarmMinutes uint16
+	AlarmDays    uint16
+	AlarmEnabled bool
+	// Unix time the counters were last brought up to date
+	LastUpdate int64
+
+	Memory  [0x100]byte
+	Address byte
+	// Last command written and its result nibble
+	Command byte
+	Result  byte
+}
+
+/*
+Bring the counters up to date with the given unix time, whole minutes only.
+*/
+func (rtc *HuC3RTC) update(now int64) {
+	elapsed := (now - rtc.LastUpdate) / 60
+	if elapsed <= 0 {
+		return
+	}
+	rtc.LastUpdate += elapsed * 60
+	total := int64(rtc.Days)*1440 + int64(rtc.Minutes) + elapsed
+	rtc.Minutes = uint16(total % 1440)
+	rtc.Days = uint16(total/1440) & 0xFFF
+}
+
+func (rtc *HuC3RTC) execute(val byte, now int64) {
+	rtc.Command = (val >> 4) & 0x7
+	arg := val & 0xF
+	switch rtc.Command {
+	case 0x1:
+		rtc.Result = rtc.Memory[rtc.Address]
+		rtc.Address++
+	case 0x3:
+		rtc.Memory[rtc.Address] = arg
+		rtc.Address++
+	case 0x4:
+		rtc.Address = rtc.Address&0xF0 | arg
+	case 0x5:
+		rtc.Address = rtc.Address&0x0F | arg<<4
+	case 0x6:
+		switch arg {
+		case 0x0:
+			rtc.update(now)
+			for i := uint(0); i < 3; i++ {
+				rtc.Memory[i] = byte(rtc.Minutes>>(i*4)) & 0xF
+				rtc.Memory[3+i] = byte(rtc.Days>>(i*4)) & 0xF
+			}
+		case 0x1:
+			rtc.Minutes, rtc.Days = 0, 0
+			for i := uint(0); i < 3; i++ {
+				rtc.Minutes |= uint16(rtc.Memory[i]) << (i * 4)
+				rtc.Days |= uint16(rtc.Memory[3+i]) << (i * 4)
+			}
+			rtc.Minutes %= 1440
+			rtc.LastUpdate = now
+		case 0x2:
+			rtc.Result = 0x1
+		}
+	}
+}
+
+// Size of the HuC3 clock footer appended to the cartridge RAM in save files
+const huc3FooterSize = 17
+
+/*
+Restore the clock from a save file footer, in the layout used by SameBoy:
+
+	uint64  - Unix timestamp
+	uint16  - Minute of the day
+	uint16  - Days
+	uint16  - Alarm minute of the day
+	uint16  - Alarm days
+	uint8   - Alarm enabled
+
+All values are little endian.
+*/
+func (rtc *HuC3RTC) loadFooter(footer []byte) {
+	rtc.LastUpdate = int64(binary.LittleEndian.Uint64(footer[0:]))
+	rtc.Minutes = binary.LittleEndian.Uint16(footer[8:]) % 1440
+	rtc.Days = binary.LittleEndian.Uint16(footer[10:]) & 0xFFF
+	rtc.AlarmMinutes = binary.LittleEndian.Uint16(footer[12:])
+	rtc.AlarmDays = binary.LittleEndian.Uint16(footer[14:])
+	rtc.AlarmEnabled = footer[16] != 0
+}
+
+/*
+Build the save file footer at the given unix time.
+*/
+func (rtc *HuC3RTC) footer(now int64) []byte {
+	rtc.update(now)
+	footer := make([]byte, huc3FooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(rtc.LastUpdate))
+	binary.LittleEndian.PutUint16(footer[8:], rtc.Minutes)
+	binary.LittleEndian.PutUint16(footer[10:], rtc.Days)
+	binary.LittleEndian.PutUint16(footer[12:], rtc.AlarmMinutes)
+	binary.LittleEndian.PutUint16(footer[14:], rtc.AlarmDays)
+	if rtc.AlarmEnabled {
+		footer[16] = 1
+	}
+	return footer
+}
+
+func (mbc *HuC3) ReadRomBank(address uint16) byte {
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
+}
+
+func (mbc *HuC3) ReadRamBank(address uint16) byte {
+	switch mbc.Mode {
+	case 0x0, 0xA:
+		if len(mbc.RAMBank) == 0 {
+			return 0xFF
+		}
+		return mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)]
+	case 0xC:
+		return mbc.RTC.Command<<4 | mbc.RTC.Result
+	case 0xD:
+		// Commands complete immediately
+		return 0x1
+	case 0xE:
+		return irNoLight
+	}
+	return 0xFF
+}
+
+func (mbc *HuC3) WriteRamBank(address uint16, data byte) {
+	switch mbc.Mode {
+	case 0xA:
+		if len(mbc.RAMBank) > 0 {
+			mbc.RAMBank[ramOffset(mbc.RAMBank, int(mbc.CurrentRAMBank), address)] = data
+		}
+	case 0xB:
+		mbc.RTC.execute(data, time.Now().Unix())
+	case 0xE:
+		mbc.IRLed = util.TestBit(data, 0)
+	}
+}
+
+func (mbc *HuC3) ReadRom(address uint16) byte {
+	return readRomBank(mbc.rom, 0, address)
+}
+
+func (mbc *HuC3) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		/*
+			0000-1FFF - Mode Select (Write Only)
+				Selects the register mapped at A000-BFFF.
+		*/
+		mbc.Mode = val & 0xF
+	} else if (address >= 0x2000) && (address < 0x4000) {
+		/*
+			2000-3FFF - ROM Bank Number (Write Only)
+				As for MBC3, writing 00h selects bank 01h.
+		*/
+		mbc.CurrentROMBank = val & 0x7F
+		if mbc.CurrentROMBank == 0 {
+			mbc.CurrentROMBank = 1
+		}
+	} else if (address >= 0x4000) && (address < 0x6000) {
+		/*
+			4000-5FFF - RAM Bank Number (Write Only)
+		*/
+		mbc.CurrentRAMBank = val & 0x3
+	}
+}
+
+/*
+The clock is saved after the RAM, like MBC3 cartridges.
+*/
+func (mbc *HuC3) SaveRam(path string) error {
+	return writeRamFile(path, append(append([]byte{}, mbc.RAMBank...), mbc.RTC.footer(time.Now().Unix())...))
+}
+
+func (mbc *HuC3) RAM() []byte {
+	return mbc.RAMBank
+}
+
+/*
+		HuC3  END
+	====================================
+*/
@@ -42,118 +42,150 @@ The following are typical when the display is enabled:
 
 The Mode Flag goes through the values 0, 2, and 3 at a cycle of about 109uS. 0 is present about 48.6uS, 2 about 19uS, and 3 about 41uS. This is interrupted every 16.6ms by the VBlank (1). The mode flag stays set at 1 for about 1.08 ms.
 
-Mode 0 is present between 201-207 clks, 2 about 77-83 clks, and 3 about 169-175 clks. A complete cycle through these states takes 456 clks. VBlank lasts 4560 clks. A complete screen refresh occurs every 70224 clks.)
+Mode 2 always lasts 80 dots. Mode 3 takes 172-289 dots depending on the fine
+scroll SCX, the window and the sprites on the line, H-Blank lasts for the rest of the 456 dots.
+VBlank lasts 4560 clks. A complete screen refresh occurs every 70224 clks.)
 */
-func (core *Core) SetLCDStatus() {
-	status := core.ReadMemory(0xFF41)
-	if !core.IsLCDEnabled() {
-		// set the mode to 1 during lcd disabled and reset scanline
-		core.Timer.ScanlineCounter = 456
-		core.Memory.MainMemory[0xFF44] = 0
-		status &= 252
-		status = util.ClearBit(status, 0)
-		status = util.ClearBit(status, 1)
-		core.WriteMemory(0xFF41, status)
-		return
-	}
+func (core *Core) setLCDMode(mode byte) {
+	core.PPU.Mode = mode
+	core.Memory.MainMemory[0xFF41] = core.Memory.MainMemory[0xFF41]&0xFC | mode
 
-	currentLine := core.ReadMemory(0xFF44)
-	currentMode := status & 0x3
-	mode := byte(0)
-	reqInt := false
-
-	// in vblank so set mode to 1
-	if currentLine >= 144 {
-		mode = 1
-		status = util.SetBit(status, 0)
-		status = util.ClearBit(status, 1)
-		reqInt = util.TestBit(status, 4)
-	} else {
-		mode2bounds := 456 - 80
-		mode3bounds := mode2bounds - 172
-
-		// mode 2
-		if core.Timer.ScanlineCounter >= mode2bounds {
-			mode = 2
-			status = util.SetBit(status, 1)
-			status = util.ClearBit(status, 0)
-			reqInt = util.TestBit(status, 5)
-		} else if core.Timer.ScanlineCounter >= mode3bounds {
-			mode = 3
-			// mode 3
-			status = util.SetBit(status, 1)
-			status = util.SetBit(status, 0)
-		} else {
-			// mode 0
-			mode = 0
-			status = util.ClearBit(status, 1)
-			status = util.ClearBit(status, 0)
-			reqInt = util.TestBit(status, 3)
-		}
+	// H-Blank DMA transfers a block at the start of every H-Blank
+	if mode == 0 && core.CGBMode {
+		core.hblankHDMA()
 	}
+}
 
-	// just entered a new mode so request interupt
-	if reqInt && (mode != currentMode) {
-		core.RequestInterrupt(1)
-	}
+/*
+	Update the coincidence flag and request the STAT interrupt. All sources
+	share one interrupt line, so an interrupt is only requested when none
+	of the enabled conditions was true before.
+*/
+func (core *Core) updateLCDStatus() {
+	status := core.Memory.MainMemory[0xFF41]
 
 	// check the conincidence flag
-	if currentLine == core.ReadMemory(0xFF45) {
+	if core.Memory.MainMemory[0xFF44] == core.Memory.MainMemory[0xFF45] {
 		status = util.SetBit(status, 2)
-		if util.TestBit(status, 6) {
-			core.RequestInterrupt(1)
-		}
 	} else {
 		status = util.ClearBit(status, 2)
 	}
-	core.WriteMemory(0xFF41, status)
-
+	core.Memory.MainMemory[0xFF41] = status
+
+	statLine := util.TestBit(status, 6) && util.TestBit(status, 2)
+	switch core.PPU.Mode {
+	case 0:
+		statLine = statLine || util.TestBit(status, 3)
+	case 1:
+		statLine = statLine || util.TestBit(status, 4)
+	case 2:
+		statLine = statLine || util.TestBit(status, 5)
+	}
+	if statLine && !core.PPU.StatLine {
+		core.RequestInterrupt(1)
+	}
+	core.PPU.StatLine = statLine
 }
 
 /*
 	Check if LCD is enabled
 */
 func (core *Core) IsLCDEnabled() bool {
-	return util.TestBit(core.ReadMemory(0xFF40), 7)
+	return util.TestBit(core.readMemory(0xFF40), 7)
 }
 
 /*
-	Scan line and draw line
+	Reset the PPU and start from the first scan line
 */
-func (core *Core) UpdateGraphics(cycles int) {
-	//Set the LCD status register
-	core.SetLCDStatus()
+func (core *Core) initPPU() {
+	core.PPU = PPU{}
+	core.Memory.MainMemory[0xFF44] = 0
+	core.startScanLine()
+}
 
-	//A complete cycle through Scan Line states takes 456 clks.
-	//We use a counter to mark this.
-	if core.IsLCDEnabled() {
-		core.Timer.ScanlineCounter -= cycles
-	} else {
+/*
+	Advance the PPU by the given number of dots
+*/
+func (core *Core) UpdateGraphics(cycles int) {
+	if !core.IsLCDEnabled() {
+		if !core.PPU.Off {
+			// set the mode to 0 during lcd disabled and reset scanline
+			core.PPU = PPU{Off: true}
+			core.Memory.MainMemory[0xFF44] = 0
+			core.Memory.MainMemory[0xFF41] &= 0xFC
+		}
 		return
 	}
+	if core.PPU.Off {
+		core.initPPU()
+	}
 
-	if core.Timer.ScanlineCounter <= 0 {
-		// time to move onto next scanline
-		core.Memory.MainMemory[0xFF44]++
+	for ; cycles > 0; cycles-- {
+		switch core.PPU.Mode {
+		case 2:
+			if core.PPU.Dot == 79 {
+				core.scanOAM()
+				core.startPixelTransfer()
+				core.setLCDMode(3)
+			}
+		case 3:
+			if core.stepPixelTransfer() {
+				core.setLCDMode(0)
+			}
+		}
 
-		currentLine := core.ReadMemory(0xFF44)
+		//A complete cycle through Scan Line states takes 456 clks.
+		core.PPU.Dot++
+		if core.PPU.Dot == 456 {
+			core.PPU.Dot = 0
+			core.nextScanLine()
+		}
+		core.updateLCDStatus()
+	}
+}
 
-		//Reset the counter
-		core.Timer.ScanlineCounter += 456
+/*
+	Move onto the next scan line
+*/
+func (core *Core) nextScanLine() {
+	if core.PPU.WindowDrawn {
+		core.PPU.WindowLine++
+		core.PPU.WindowDrawn = false
+	}
+
+	core.Memory.MainMemory[0xFF44]++
+	currentLine := core.Memory.MainMemory[0xFF44]
 
+	if currentLine == 144 {
 		// we have entered vertical blank period
-		if currentLine == 144 {
-			core.DrawScanLine()
-			core.RequestInterrupt(0)
-		} else if currentLine > 153 {
-			// if gone past scanline 153 reset to 0
-			core.Memory.MainMemory[0xFF44] = 0
-			core.DrawScanLine()
-		} else if currentLine < 144 {
-			//log.Println(currentLine)
-			core.DrawScanLine()
+		core.setLCDMode(1)
+		core.RequestInterrupt(0)
+		core.applyGameShark()
+		core.frameDone = true
+		if core.tracer != nil {
+			core.tracer.nextFrame()
 		}
-
+		if core.rewind != nil {
+			core.rewind.nextFrame()
+		}
+	} else if currentLine > 153 {
+		// if gone past scanline 153 reset to 0
+		core.Memory.MainMemory[0xFF44] = 0
+		core.PPU.WindowLine = 0
+		core.PPU.WindowTriggered = false
+		core.startScanLine()
+	} else if currentLine < 144 {
+		core.startScanLine()
 	}
+}
 
+/*
+	Enter the OAM search of a visible scan line
+*/
+func (core *Core) startScanLine() {
+	// The window is only drawn after WY matched LY once in the frame
+	if core.Memory.MainMemory[0xFF44] == core.Memory.MainMemory[0xFF4A] {
+		core.PPU.WindowTriggered = true
+	}
+	core.setLCDMode(2)
 }
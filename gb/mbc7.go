@@ -0,0 +1,318 @@
+package gb
+
+import (
+	"encoding/binary"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+====================================
+
+	MBC7
+
+MBC7 cartridges have a 2-axis accelerometer and a 93LC56 serial EEPROM
+instead of RAM. Both are accessed through registers at A000-AFFF, once
+enabled by writing 0Ah to 0000-1FFF and 40h to 4000-5FFF:
+
+	A00x  Write 55h to erase the latched accelerometer values
+	A01x  Write AAh after 55h to latch the accelerometer values
+	A02x  Latched X value, low byte
+	A03x  Latched X value, high byte
+	A04x  Latched Y value, low byte
+	A05x  Latched Y value, high byte
+	A06x  Always 00h
+	A07x  Always FFh
+	A08x  EEPROM pins: bit 7 CS, bit 6 CLK, bit 1 DI, bit 0 DO
+*/
+type MBC7 struct {
+	rom            []byte
+	CurrentROMBank byte
+	EnableRAM1     bool
+	EnableRAM2     bool
+	// Latched accelerometer values, 81D0h when flat
+	AccelX      uint16
+	AccelY      uint16
+	AccelErased bool
+	EEPROM      EEPROM
+
+	tilt driver.TiltInput
+}
+
+const (
+	// Accelerometer value when the console is flat, and the change for 1g
+	accelCentre = 0x81D0
+	accelScale  = 0x70
+	// Default EEPROM size, 128 words of 16 bits
+	mbc7EEPROMSize = 0x100
+)
+
+func (mbc *MBC7) ReadRomBank(address uint16) byte {
+	return readRomBank(mbc.rom, int(mbc.CurrentROMBank), address)
+}
+
+func (mbc *MBC7) ReadRom(address uint16) byte {
+	return readRomBank(mbc.rom, 0, address)
+}
+
+func (mbc *MBC7) ReadRamBank(address uint16) byte {
+	if !mbc.EnableRAM1 || !mbc.EnableRAM2 || address >= 0xB000 {
+		return 0xFF
+	}
+	switch (address >> 4) & 0xF {
+	case 0x2:
+		return byte(mbc.AccelX)
+	case 0x3:
+		return byte(mbc.AccelX >> 8)
+	case 0x4:
+		return byte(mbc.AccelY)
+	case 0x5:
+		return byte(mbc.AccelY >> 8)
+	case 0x6:
+		return 0x00
+	case 0x8:
+		return mbc.EEPROM.pins()
+	}
+	return 0xFF
+}
+
+func (mbc *MBC7) WriteRamBank(address uint16, data byte) {
+	if !mbc.EnableRAM1 || !mbc.EnableRAM2 || address >= 0xB000 {
+		return
+	}
+	switch (address >> 4) & 0xF {
+	case 0x0:
+		if data == 0x55 {
+			mbc.AccelX, mbc.AccelY = 0x8000, 0x8000
+			mbc.AccelErased = true
+		}
+	case 0x1:
+		if data == 0xAA && mbc.AccelErased {
+			mbc.latchAccelerometer()
+			mbc.AccelErased = false
+		}
+	case 0x8:
+		mbc.EEPROM.write(data)
+	}
+}
+
+func (mbc *MBC7) latchAccelerometer() {
+	var x, y float64
+	if mbc.tilt != nil {
+		x, y = mbc.tilt.Tilt()
+	}
+	// The accelerometer measures the reaction to gravity, opposed to the tilt
+	mbc.AccelX = uint16(accelCentre - int(clampTilt(x)*accelScale))
+	mbc.AccelY = uint16(accelCentre - int(clampTilt(y)*accelScale))
+}
+
+func clampTilt(value float64) float64 {
+	if value > 1 {
+		return 1
+	}
+	if value < -1 {
+		return -1
+	}
+	return value
+}
+
+func (mbc *MBC7) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		/*
+			0000-1FFF - RAM Enable 1 (Write Only)
+				0Ah enables the accelerometer and the EEPROM, if RAM Enable 2 is set too.
+		*/
+		mbc.EnableRAM1 = val == 0x0A
+	} else if (address >= 0x2000) && (address < 0x4000) {
+		/*
+			2000-3FFF - ROM Bank Number (Write Only)
+		*/
+		mbc.CurrentROMBank = val & 0x7F
+	} else if (address >= 0x4000) && (address < 0x6000) {
+		/*
+			4000-5FFF - RAM Enable 2 (Write Only)
+				40h enables the accelerometer and the EEPROM, if RAM Enable 1 is set too.
+		*/
+		mbc.EnableRAM2 = val == 0x40
+	}
+}
+
+/*
+The EEPROM contents are saved in place of the RAM.
+*/
+func (mbc *MBC7) SaveRam(path string) error {
+	return writeRamFile(path, mbc.EEPROM.Data)
+}
+
+func (mbc *MBC7) RAM() []byte {
+	return mbc.EEPROM.Data
+}
+
+/*
+93LC56 serial EEPROM, organized as 16bit words.
+
+While CS is high, a bit is shifted in from DI on each rising edge of CLK.
+A command is a start bit (1), a 2bit opcode and an 8bit address:
+
+	10  READ   Shift out a dummy 0 then the word at the address on DO,
+	           following words are shifted out as long as CS stays high
+	01  WRITE  Write the 16 following bits at the address
+	11  ERASE  Set the word at the address to FFFFh
+	00  With the upper 2 bits of the address:
+	    00  EWDS  Disable writes
+	    01  WRAL  Write the 16 following bits to all words
+	    10  ERAL  Set all words to FFFFh
+	    11  EWEN  Enable writes
+
+Writes complete immediately, DO reads 1 (ready) once the command is done.
+*/
+type EEPROM struct {
+	Data []byte
+	CS   bool
+	CLK  bool
+	DI   bool
+	DO   bool
+	// Bits shifted in since the start bit, and their count
+	Command   uint32
+	Bits      int
+	WriteMode bool
+	// Word being shifted out, the number of bits left and its address
+	Output     uint16
+	OutputBits int
+	Address    int
+	Reading    bool
+}
+
+func (eeprom *EEPROM) pins() byte {
+	var res byte
+	if eeprom.CS {
+		res = util.SetBit(res, 7)
+	}
+	if eeprom.CLK {
+		res = util.SetBit(res, 6)
+	}
+	if eeprom.DI {
+		res = util.SetBit(res, 1)
+	}
+	if eeprom.DO {
+		res = util.SetBit(res, 0)
+	}
+	return res
+}
+
+func (eeprom *EEPROM) write(val byte) {
+	cs, clk, di := util.TestBit(val, 7), util.TestBit(val, 6), util.TestBit(val, 1)
+	rising := clk && !eeprom.CLK
+	eeprom.CS, eeprom.CLK, eeprom.DI = cs, clk, di
+	if !cs {
+		// Deselecting the chip aborts the current command
+		eeprom.Bits, eeprom.Command, eeprom.Reading = 0, 0, false
+		return
+	}
+	if !rising {
+		return
+	}
+
+	if eeprom.Reading {
+		eeprom.shiftOut()
+		return
+	}
+	if eeprom.Bits == 0 && !di {
+		// Waiting for the start bit
+		return
+	}
+	eeprom.Command <<= 1
+	if di {
+		eeprom.Command |= 1
+	}
+	eeprom.Bits++
+	eeprom.execute()
+}
+
+/*
+Shift out the next bit of the word being read, then move to the next word.
+*/
+func (eeprom *EEPROM) shiftOut() {
+	if eeprom.OutputBits == 0 {
+		eeprom.Address = (eeprom.Address + 1) % eeprom.words()
+		eeprom.Output = eeprom.word(eeprom.Address)
+		eeprom.OutputBits = 16
+	}
+	eeprom.DO = eeprom.Output&0x8000 != 0
+	eeprom.Output <<= 1
+	eeprom.OutputBits--
+}
+
+func (eeprom *EEPROM) words() int {
+	return len(eeprom.Data) / 2
+}
+
+func (eeprom *EEPROM) word(address int) uint16 {
+	return binary.LittleEndian.Uint16(eeprom.Data[address*2:])
+}
+
+func (eeprom *EEPROM) setWord(address int, value uint16) {
+	binary.LittleEndian.PutUint16(eeprom.Data[address*2:], value)
+}
+
+/*
+Run the command once enough bits have been shifted in.
+*/
+func (eeprom *EEPROM) execute() {
+	// Start bit, opcode and address
+	if eeprom.Bits < 11 {
+		return
+	}
+	header := eeprom.Command >> uint(eeprom.Bits-11)
+	opcode := (header >> 8) & 0x3
+	address := int(header & 0xFF)
+	// WRITE and WRAL are followed by 16 data bits
+	withData := opcode == 0x1 || (opcode == 0x0 && address>>6 == 0x1)
+	if withData && eeprom.Bits < 27 {
+		return
+	}
+	data := uint16(eeprom.Command)
+	eeprom.Bits, eeprom.Command = 0, 0
+
+	switch opcode {
+	case 0x2:
+		eeprom.Reading = true
+		eeprom.Address = address % eeprom.words()
+		eeprom.Output = eeprom.word(eeprom.Address)
+		eeprom.OutputBits = 16
+		eeprom.DO = false
+		return
+	case 0x1:
+		if eeprom.WriteMode {
+			eeprom.setWord(address%eeprom.words(), data)
+		}
+	case 0x3:
+		if eeprom.WriteMode {
+			eeprom.setWord(address%eeprom.words(), 0xFFFF)
+		}
+	case 0x0:
+		switch address >> 6 {
+		case 0x0:
+			eeprom.WriteMode = false
+		case 0x1, 0x2:
+			if !eeprom.WriteMode {
+				break
+			}
+			if address>>6 == 0x2 {
+				data = 0xFFFF
+			}
+			for i := 0; i < eeprom.words(); i++ {
+				eeprom.setWord(i, data)
+			}
+		case 0x3:
+			eeprom.WriteMode = true
+		}
+	}
+	eeprom.DO = true
+}
+
+/*
+		MBC7  END
+	====================================
+*/
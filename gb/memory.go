@@ -24,41 +24,24 @@ import (
 */
 type Memory struct {
 	MainMemory [0x10000]byte
-	dirty      bool
+	// Video RAM, bank 1 is only available in CGB mode
+	VRAM     [2][0x2000]byte
+	VRAMBank byte
+	// Work RAM, bank 0 is fixed at C000, banks 2-7 are only available in CGB mode
+	WRAM     [8][0x1000]byte
+	WRAMBank byte
+	dirty    bool
 }
 
 func (core *Core) initMemory() {
 	log.Println("[Core] Start to initialize memory...")
 
-	log.Println("[Memory] Load first 32KByte of rom data into memory")
-	//Load first 32KB of ROM into 0000-7FFF
-	for i := 0x0000; i < core.Cartridge.Props.ROMLength && i < 0x8000; i++ {
-		core.Memory.MainMemory[i] = core.Cartridge.MBC.ReadRom(uint16(i))
-	}
-
 	//Specify other register mapped in main memory according to http://bgb.bircd.org/pandocs.htm#powerupsequence
 	core.Memory.MainMemory[0xFF05] = 0x00
 	core.Memory.MainMemory[0xFF06] = 0x00
-	core.Memory.MainMemory[0xFF07] = 0x00
+	core.Memory.MainMemory[0xFF07] = 0xF8
 	core.Memory.MainMemory[0xFF0F] = 0xE1
-	core.Memory.MainMemory[0xFF10] = 0x80
-	core.Memory.MainMemory[0xFF11] = 0xBF
-	core.Memory.MainMemory[0xFF12] = 0xF3
-	core.Memory.MainMemory[0xFF14] = 0xBF
-	core.Memory.MainMemory[0xFF16] = 0x3F
-	core.Memory.MainMemory[0xFF17] = 0x00
-	core.Memory.MainMemory[0xFF19] = 0xBF
-	core.Memory.MainMemory[0xFF1A] = 0x7F
-	core.Memory.MainMemory[0xFF1B] = 0xFF
-	core.Memory.MainMemory[0xFF1C] = 0x9F
-	core.Memory.MainMemory[0xFF1E] = 0xBF
-	core.Memory.MainMemory[0xFF20] = 0xFF
-	core.Memory.MainMemory[0xFF21] = 0x00
-	core.Memory.MainMemory[0xFF22] = 0x00
-	core.Memory.MainMemory[0xFF23] = 0xBF
-	core.Memory.MainMemory[0xFF24] = 0x77
-	core.Memory.MainMemory[0xFF25] = 0xF3
-	core.Memory.MainMemory[0xFF26] = 0xF1
+	core.Sound.Reset()
 	core.Memory.MainMemory[0xFF40] = 0x91
 	core.Memory.MainMemory[0xFF42] = 0x00
 	core.Memory.MainMemory[0xFF43] = 0x00
@@ -70,33 +53,96 @@ func (core *Core) initMemory() {
 	core.Memory.MainMemory[0xFF4B] = 0x00
 	core.Memory.MainMemory[0xFFFF] = 0x00
 
+	core.Memory.VRAMBank = 0
+	core.Memory.WRAMBank = 1
+
 	core.setupSaveLoop()
 }
 
-func (core *Core) SaveRAM() {
+func (core *Core) SaveRAM() error {
 	if core.Memory.dirty {
 		core.Memory.dirty = false
-		core.Cartridge.MBC.SaveRam(core.RamPath)
+		return core.Cartridge.MBC.SaveRam(core.RamPath)
 	}
+	return nil
 }
 
 func (core *Core) setupSaveLoop() {
+	core.stopSaveLoop()
 	// each second check if there are new saves (to avoid thousands within a frame)
-	saveTimer := time.Tick(time.Second)
+	saveTicker := time.NewTicker(time.Second)
+	stop := make(chan bool)
+	core.saveLoopStop = stop
 	go func() {
-		for range saveTimer {
-			core.SaveRAM()
+		defer saveTicker.Stop()
+		for {
+			select {
+			case <-saveTicker.C:
+				if err := core.SaveRAM(); err != nil {
+					log.Println("[Memory] Failed to save cartridge RAM:", err)
+				}
+			case <-stop:
+				return
+			}
 		}
 	}()
 }
 
+/*
+Stop the save loop, waiting for a save in progress to complete.
+*/
+func (core *Core) stopSaveLoop() {
+	if core.saveLoopStop != nil {
+		core.saveLoopStop <- true
+		core.saveLoopStop = nil
+	}
+}
+
+/*
+Release an emulator which is no longer run: stop saving the cartridge RAM
+every second and save it a last time. Run does it when Exit is set, cores
+run by RunFrame must be closed by their owner.
+*/
+func (core *Core) Close() error {
+	core.stopSaveLoop()
+	return core.SaveRAM()
+}
+
 func (core *Core) ReadMemory(address uint16) byte {
-	if (address >= 0x4000) && (address <= 0x7FFF) {
+	value := core.readMemory(address)
+	if core.debugger != nil {
+		core.debugger.access(address, value, false)
+	}
+	return value
+}
+
+/*
+Read memory for the hardware itself, such as DMA or the PPU, without
+hitting watchpoints, which only see the accesses of the CPU.
+*/
+func (core *Core) readMemory(address uint16) byte {
+	if core.Bus != nil {
+		return core.Bus.Read(address)
+	} else if core.isBootROMAddress(address) {
+		return core.bootROM[address]
+	} else if address < 0x4000 {
+		// ROM bank 00, some MBCs can map other banks here
+		return core.readROMCheat(address, core.Cartridge.MBC.ReadRom(address))
+	} else if (address >= 0x4000) && (address <= 0x7FFF) {
 		// are we reading from the rom memory bank?
-		return core.Cartridge.MBC.ReadRomBank(address)
+		return core.readROMCheat(address, core.Cartridge.MBC.ReadRomBank(address))
 	} else if (address >= 0xA000) && (address <= 0xBFFF) {
 		// are we reading from ram memory bank?
 		return core.Cartridge.MBC.ReadRamBank(address)
+	} else if (address >= 0x8000) && (address <= 0x9FFF) {
+		return core.Memory.VRAM[core.Memory.VRAMBank][address-0x8000]
+	} else if (address >= 0xC000) && (address <= 0xFDFF) {
+		// E000-FDFF mirrors C000-DDFF
+		return *core.wramAddress(address)
+	} else if address >= 0xFF4D && address <= 0xFF70 && core.CGBMode {
+		return core.readCGBRegister(address)
+	} else if address == 0xFF44 && core.tracer != nil && core.tracer.StubLY {
+		return 0x90
 	} else if 0xFF00 == address {
 		// Read Joypad status
 		// FF00 - P1/JOYP - Joypad (R/W)
@@ -113,33 +159,67 @@ func (core *Core) ReadMemory(address uint16) byte {
 		return core.GetJoypadStatus()
 	} else if address == 0xFF01 {
 		return core.SerialByte
+	} else if address == 0xFF04 {
+		// DIV is the upper byte of the system counter
+		return byte(core.Timer.SystemCounter >> 8)
+	} else if address >= 0xFF10 && address <= 0xFF3F {
+		return core.Sound.Read(address)
 	}
 	return core.Memory.MainMemory[address]
 }
 
 func (core *Core) WriteMemory(address uint16, data byte) {
-	if address < 0x8000 {
+	if core.debugger != nil {
+		core.debugger.access(address, data, true)
+	}
+	core.writeMemory(address, data)
+}
+
+/*
+Write memory for the hardware itself, see readMemory.
+*/
+func (core *Core) writeMemory(address uint16, data byte) {
+	if core.Bus != nil {
+		core.Bus.Write(address, data)
+	} else if address < 0x8000 {
 		core.Cartridge.MBC.HandleBanking(address, data)
 		//core.HandleBanking(address,data) ;
 	} else if (address >= 0xA000) && (address < 0xC000) {
 		core.Cartridge.MBC.WriteRamBank(address, data)
 		core.Memory.dirty = true
-	} else if (address >= 0xE000) && (address < 0xFE00) {
+	} else if (address >= 0x8000) && (address < 0xA000) {
+		core.Memory.VRAM[core.Memory.VRAMBank][address-0x8000] = data
+	} else if (address >= 0xC000) && (address < 0xFE00) {
 		// writing to ECHO ram also writes in RAM
-		core.Memory.MainMemory[address] = data
-		core.WriteMemory(address-0x2000, data)
+		*core.wramAddress(address) = data
+	} else if address >= 0xFF4D && address <= 0xFF70 && core.CGBMode && core.writeCGBRegister(address, data) {
+		// CGB only registers
 	} else if (address >= 0xFEA0) && (address < 0xFEFF) {
 		// this area is restricted
 	} else if 0xFF04 == address {
 		// This register is incremented at rate of 16384Hz (~16779Hz on SGB).
 		// In CGB Double Speed Mode it is incremented twice as fast, ie. at 32768Hz.
 		// Writing any value to this register resets it to 00h.
-		core.Memory.MainMemory[0xFF04] = 0
+		core.writeDIV()
+	} else if address == 0xFF05 {
+		core.writeTIMA(data)
 	} else if address == 0xFF44 {
 		// The LY indicates the vertical line to which the present data is
 		// transferred to the LCD Driver. The LY can take on any value between 0 through 153.
-		// The values between 144 and 153 indicate the V-Blank period. Writing will reset the counter.
-		core.Memory.MainMemory[0xFF44] = 0
+		// The values between 144 and 153 indicate the V-Blank period. LY is driven by the PPU and read only.
+	} else if address == 0xFF41 {
+		// The coincidence flag and the mode flag of STAT are read only
+		core.Memory.MainMemory[0xFF41] = 0x80 | data&0x78 | core.Memory.MainMemory[0xFF41]&0x07
+	} else if address == 0xFF50 {
+		// Writing a non-zero value unmaps the boot ROM
+		if data != 0 && core.BootROMMapped {
+			core.unmapBootROM()
+		}
+	} else if address == 0xFF4C {
+		// KEY0 can only be written by the CGB boot ROM
+		if core.BootROMMapped {
+			core.Memory.MainMemory[0xFF4C] = data
+		}
 	} else if address == 0xFF46 {
 		// FF46 - DMA - DMA Transfer and Start Address (W)
 		// Writing to this register launches a DMA transfer from ROM or RAM to
@@ -153,20 +233,10 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 		//             01: 262144 Hz  (~268400 Hz SGB)
 		//             10:  65536 Hz   (~67110 Hz SGB)
 		//             11:  16384 Hz   (~16780 Hz SGB)
-		currentFreq := core.GetClockFreq()
-		core.Memory.MainMemory[0xFF07] = data
-		newFreq := core.GetClockFreq()
-		if currentFreq != newFreq {
-			core.SetClockFreq()
-		}
-
+		core.writeTAC(data)
 	} else if address >= 0xFF10 && address <= 0xFF3F {
 		//Trigger sound controller
-		core.Memory.MainMemory[address] = data
-		if core.ToggleSound {
-			core.Sound.Trigger(address, data, core.Memory.MainMemory[0xFF10:0xFF40])
-		}
-
+		core.Sound.Write(address, data)
 	} else if address == 0xFF02 {
 		/*
 			FF02 - SC - Serial Transfer Control (R/W)
@@ -180,7 +250,8 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 		// If transfer is requested
 		if util.TestBit(data, 7) {
 			// If this console is the Master console
-			if util.TestBit(data, 0) {
+			if util.TestBit(data, 0) && core.SerialOutput != nil {
+				core.SerialOutput.Write([]byte{core.Memory.MainMemory[0xFF01]})
 			}
 			//log.Printf("send:%X\n",core.Memory.MainMemory[0xFF01])
 			core.Serial.SendByte(core.Memory.MainMemory[0xFF01])
@@ -193,6 +264,84 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 	//log.Printf("Write to %X,data:%X\n", address, data)
 }
 
+/*
+	Locate a work RAM address in the current banks.
+*/
+func (core *Core) wramAddress(address uint16) *byte {
+	if address >= 0xE000 {
+		address -= 0x2000
+	}
+	if address < 0xD000 {
+		return &core.Memory.WRAM[0][address-0xC000]
+	}
+	return &core.Memory.WRAM[core.Memory.WRAMBank][address-0xD000]
+}
+
+/*
+	Read CGB only registers, which are not backed by main memory.
+*/
+func (core *Core) readCGBRegister(address uint16) byte {
+	switch address {
+	case 0xFF4D:
+		return core.readKey1()
+	case 0xFF4F:
+		// FF4F - VBK - CGB Mode Only - VRAM Bank
+		return core.Memory.VRAMBank | 0xFE
+	case 0xFF55:
+		return core.readHDMA()
+	case 0xFF68:
+		return core.BGPalette.readIndex()
+	case 0xFF69:
+		return core.BGPalette.readData()
+	case 0xFF6A:
+		return core.OBJPalette.readIndex()
+	case 0xFF6B:
+		return core.OBJPalette.readData()
+	case 0xFF70:
+		// FF70 - SVBK - CGB Mode Only - WRAM Bank
+		return core.Memory.WRAMBank | 0xF8
+	}
+	return core.Memory.MainMemory[address]
+}
+
+/*
+	Write CGB only registers, return false if the address is a normal register.
+*/
+func (core *Core) writeCGBRegister(address uint16, data byte) bool {
+	switch address {
+	case 0xFF4D:
+		core.prepareSpeedSwitch = util.TestBit(data, 0)
+	case 0xFF4F:
+		core.Memory.VRAMBank = data & 0x1
+	case 0xFF51:
+		core.HDMA.Source = core.HDMA.Source&0x00FF | uint16(data)<<8
+	case 0xFF52:
+		core.HDMA.Source = core.HDMA.Source&0xFF00 | uint16(data&0xF0)
+	case 0xFF53:
+		core.HDMA.Destination = core.HDMA.Destination&0x00FF | uint16(data&0x1F)<<8
+	case 0xFF54:
+		core.HDMA.Destination = core.HDMA.Destination&0xFF00 | uint16(data&0xF0)
+	case 0xFF55:
+		core.startHDMA(data)
+	case 0xFF68:
+		core.BGPalette.writeIndex(data)
+	case 0xFF69:
+		core.BGPalette.writeData(data)
+	case 0xFF6A:
+		core.OBJPalette.writeIndex(data)
+	case 0xFF6B:
+		core.OBJPalette.writeData(data)
+	case 0xFF70:
+		core.Memory.WRAMBank = data & 0x7
+		if core.Memory.WRAMBank == 0 {
+			core.Memory.WRAMBank = 1
+		}
+	default:
+		return false
+	}
+	return true
+}
+
 /*
 	Perform DMA transfer.
 	The written value specifies the transfer source address divided by 100h, ie. source & destination are:
@@ -203,7 +352,7 @@ func (core *Core) DoDMA(data byte) {
 	// source address is data * 100
 	address := uint16(data) << 8
 	for i := 0; i < 0xA0; i++ {
-		core.WriteMemory(0xFE00+uint16(i), core.ReadMemory(address+uint16(i)))
+		core.writeMemory(0xFE00+uint16(i), core.readMemory(address+uint16(i)))
 	}
 }
 
@@ -0,0 +1,169 @@
+package gb
+
+import (
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+====================================
+
+	MMM01
+
+The MMM01 is a multicart mapper. At power on it maps the last 32KByte of
+the ROM, which holds the game selection menu, at 0000-7FFF. The menu sets
+up the outer bank registers of the selected game and then locks them by
+writing to 0000-1FFF with bit 6 set, the MMM01 then behaves as an MBC1
+restricted to the game's part of the ROM.
+*/
+type MMM01 struct {
+	rom     []byte
+	RAMBank []byte
+	// Whether the game is mapped and the outer bank registers are locked
+	Locked    bool
+	EnableRAM bool
+	// ROM bank number: bits 0-4, bits 5-6 and bits 7-8
+	ROMBankLow  byte
+	ROMBankMid  byte
+	ROMBankHigh byte
+	// ROM bank bits 1-4 which are part of the outer bank and can't be changed by the game
+	ROMBankMask byte
+	// RAM bank number: bits 0-1 and bits 2-3
+	RAMBankLow  byte
+	RAMBankHigh byte
+	// RAM bank bits 0-1 which are part of the outer bank and can't be changed by the game
+	RAMBankMask byte
+	// MBC1 mode 1, and whether the game can change it
+	MBC1Mode        bool
+	MBC1ModeDisable bool
+	// Swaps the ROM bank bits 5-6 and the RAM bank bits 0-1
+	Multiplex bool
+}
+
+/*
+ROM banks mapped at 0000-3FFF and 4000-7FFF.
+*/
+func (mbc *MMM01) romBanks() (int, int) {
+	if !mbc.Locked {
+		// The last 32KByte of the ROM, the menu
+		return 0x1FE, 0x1FF
+	}
+	mid := mbc.ROMBankMid
+	if mbc.Multiplex {
+		mid = mbc.RAMBankLow
+	}
+	outer := int(mid)<<5 | int(mbc.ROMBankHigh)<<7
+	low := mbc.ROMBankLow
+	if low&^(mbc.ROMBankMask<<1) == 0 {
+		// As for MBC1, writing 00h selects bank 01h
+		low |= 0x1
+	}
+	bank0 := outer | int(mbc.ROMBankLow&(mbc.ROMBankMask<<1))
+	if mbc.Multiplex && mbc.MBC1Mode {
+		// The multiplexed RAM bank bits don't apply to 0000-3FFF in MBC1 mode 1
+		bank0 = int(mbc.ROMBankLow&(mbc.ROMBankMask<<1)) | int(mbc.ROMBankHigh)<<7
+	}
+	return bank0, outer | int(low)
+}
+
+func (mbc *MMM01) ramBank() int {
+	if mbc.Multiplex {
+		return int(mbc.ROMBankMid) | int(mbc.RAMBankHigh)<<2
+	}
+	return int(mbc.RAMBankLow) | int(mbc.RAMBankHigh)<<2
+}
+
+func (mbc *MMM01) ReadRomBank(address uint16) byte {
+	_, bank := mbc.romBanks()
+	return readRomBank(mbc.rom, bank, address)
+}
+
+func (mbc *MMM01) ReadRom(address uint16) byte {
+	bank, _ := mbc.romBanks()
+	return readRomBank(mbc.rom, bank, address)
+}
+
+func (mbc *MMM01) ReadRamBank(address uint16) byte {
+	if !mbc.EnableRAM || len(mbc.RAMBank) == 0 {
+		return 0xFF
+	}
+	return mbc.RAMBank[ramOffset(mbc.RAMBank, mbc.ramBank(), address)]
+}
+
+func (mbc *MMM01) WriteRamBank(address uint16, data byte) {
+	if mbc.EnableRAM && len(mbc.RAMBank) > 0 {
+		mbc.RAMBank[ramOffset(mbc.RAMBank, mbc.ramBank(), address)] = data
+	}
+}
+
+func (mbc *MMM01) HandleBanking(address uint16, val byte) {
+	if address < 0x2000 {
+		/*
+			0000-1FFF - RAM Enable (Write Only)
+				Bit 0-3 - 0Ah enables the RAM, as for MBC1
+				Bit 4-5 - RAM bank mask (unlocked only)
+				Bit 6   - Lock the outer bank registers and map the game (unlocked only)
+		*/
+		mbc.EnableRAM = val&0xF == 0xA
+		if !mbc.Locked {
+			mbc.RAMBankMask = (val >> 4) & 0x3
+			mbc.Locked = util.TestBit(val, 6)
+		}
+	} else if (address >= 0x2000) && (address < 0x4000) {
+		/*
+			2000-3FFF - ROM Bank Number (Write Only)
+				Bit 0-4 - ROM bank bits 0-4, except the masked bits once locked
+				Bit 5-6 - ROM bank bits 5-6 (unlocked only)
+		*/
+		mask := byte(0)
+		if mbc.Locked {
+			mask = mbc.ROMBankMask << 1
+		} else {
+			mbc.ROMBankMid = (val >> 5) & 0x3
+		}
+		mbc.ROMBankLow = mbc.ROMBankLow&mask | val&^mask&0x1F
+	} else if (address >= 0x4000) && (address < 0x6000) {
+		/*
+			4000-5FFF - RAM Bank Number (Write Only)
+				Bit 0-1 - RAM bank bits 0-1, except the masked bits once locked
+				Bit 2-3 - RAM bank bits 2-3 (unlocked only)
+				Bit 4-5 - ROM bank bits 7-8 (unlocked only)
+				Bit 6   - Prevent the game from changing the MBC1 mode (unlocked only)
+		*/
+		mask := byte(0)
+		if mbc.Locked {
+			mask = mbc.RAMBankMask
+		} else {
+			mbc.RAMBankHigh = (val >> 2) & 0x3
+			mbc.ROMBankHigh = (val >> 4) & 0x3
+			mbc.MBC1ModeDisable = util.TestBit(val, 6)
+		}
+		mbc.RAMBankLow = mbc.RAMBankLow&mask | val&^mask&0x3
+	} else if (address >= 0x6000) && (address < 0x8000) {
+		/*
+			6000-7FFF - Mode Select (Write Only)
+				Bit 0   - MBC1 mode, unless disabled
+				Bit 2-5 - ROM bank mask (unlocked only)
+				Bit 6   - Multiplex (unlocked only)
+		*/
+		if !mbc.MBC1ModeDisable {
+			mbc.MBC1Mode = util.TestBit(val, 0)
+		}
+		if !mbc.Locked {
+			mbc.ROMBankMask = (val >> 2) & 0xF
+			mbc.Multiplex = util.TestBit(val, 6)
+		}
+	}
+}
+
+func (mbc *MMM01) SaveRam(path string) error {
+	return writeRamFile(path, mbc.RAMBank)
+}
+
+func (mbc *MMM01) RAM() []byte {
+	return mbc.RAMBank
+}
+
+/*
+		MMM01  END
+	====================================
+*/
@@ -1,8 +1,8 @@
 package gb
 
 import (
+	"fmt"
 	"github.com/HFO4/gbc-in-cloud/util"
-	"log"
 )
 
 /*
@@ -1423,7 +1423,8 @@ func (core *Core) OP15() int {
 	OP:0x10 STOP 0
 */
 func (core *Core) OP10() int {
-	//TODO STOP
+	// In CGB mode, STOP executes a prepared speed switch
+	core.switchSpeed()
 	return 0
 }
 
@@ -2243,7 +2244,7 @@ func (core *Core) OPCB() int {
 		core.cbMap[nextIns]()
 		return CBCycles[nextIns] * 4
 	} else {
-		log.Fatalf("Undefined CB Opcode: %X \n", nextIns)
+		core.fail(fmt.Errorf("undefined CB Opcode: %X", nextIns))
 	}
 	return 0
 }
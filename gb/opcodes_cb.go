@@ -1,6 +1,8 @@
 package gb
 
 import (
+	"fmt"
+
 	"github.com/HFO4/gbc-in-cloud/util"
 )
 
@@ -23,6 +25,26 @@ var CBCycles = []int{
 	2, 2, 2, 2, 2, 2, 4, 2, 2, 2, 2, 2, 2, 2, 4, 2, // F
 } //0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f
 
+/*
+	Mnemonic of a CB prefixed instruction. Every 8 instructions is a group,
+	which use different registers. The first 8 groups are shifts and
+	rotations, the others test, reset or set one bit each.
+*/
+func CBOPName(code byte) string {
+	registers := [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	register := registers[code&0x7]
+	switch code >> 6 {
+	case 0:
+		shifts := [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SWAP", "SRL"}
+		return shifts[code>>3] + " " + register
+	case 1:
+		return fmt.Sprintf("BIT %d,%s", (code>>3)&0x7, register)
+	case 2:
+		return fmt.Sprintf("RES %d,%s", (code>>3)&0x7, register)
+	}
+	return fmt.Sprintf("SET %d,%s", (code>>3)&0x7, register)
+}
+
 func (core *Core) initCB() {
 
 	var getters = [8]func() byte{
@@ -15,7 +15,7 @@ var OPCodeFunctionMap = [0x100]OPCodeUnit{
 	byte(0x02): {
 		Func:  (*Core).OP02,
 		Clock: 8,
-		OP:    "LD BC,A",
+		OP:    "LD (BC),A",
 	},
 	byte(0x03): {
 		Func:  (*Core).OP03,
@@ -1032,7 +1032,7 @@ var OPCodeFunctionMap = [0x100]OPCodeUnit{
 	byte(0xCB): {
 		Func:  (*Core).OPCB,
 		Clock: 4,
-		OP:    "PERFIX CB",
+		OP:    "PREFIX CB",
 	},
 	byte(0xCC): {
 		Func:  (*Core).OPCC,
@@ -0,0 +1,338 @@
+package gb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of the patches looked for next to the ROM, in order
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+/*
+Find the patch named after the ROM, "Game.ips" for "Game.gb" or "Game.zip".
+Returns an empty string if there is none.
+*/
+func findPatch(romPath string) string {
+	base := strings.TrimSuffix(romPath, filepath.Ext(romPath))
+	base = strings.TrimSuffix(base, ".tar")
+	for _, ext := range patchExtensions {
+		path := base + ext
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+/*
+Apply the patch file at the given path to the ROM, the format is told by
+the header of the patch.
+*/
+func applyPatchFile(rom []byte, path string) ([]byte, error) {
+	patch, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		patched, err = applyIPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("UPS1")):
+		patched, err = applyUPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		patched, err = applyBPS(rom, patch)
+	default:
+		return nil, fmt.Errorf("unknown patch format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch %s: %v", path, err)
+	}
+	log.Println("[Core] Patch applied:", path)
+	return patched, nil
+}
+
+var errPatchTruncated = errors.New("unexpected end of patch")
+
+// Largest ROM a patch may produce or an archive may hold, the 8MB an MBC5
+// cartridge can address
+const maxPatchedROMSize = 0x800000
+
+var errPatchTooLarge = errors.New("patched ROM too large")
+
+/*
+IPS patch: a list of records, each one a 24bit offset and a 16bit size
+followed by the data, ended by "EOF". A record of size 0 is a run of a
+single byte, given by a 16bit length and the byte. The end may be
+followed by a 24bit size the ROM is truncated to. All values are big
+endian, IPS has no checksum.
+*/
+func applyIPS(rom []byte, patch []byte) ([]byte, error) {
+	out := append([]byte{}, rom...)
+	pos := 5
+	read := func(n int) (int, error) {
+		if pos+n > len(patch) {
+			return 0, errPatchTruncated
+		}
+		value := 0
+		for i := 0; i < n; i++ {
+			value = value<<8 | int(patch[pos+i])
+		}
+		pos += n
+		return value, nil
+	}
+	for {
+		if pos+3 <= len(patch) && string(patch[pos:pos+3]) == "EOF" {
+			pos += 3
+			break
+		}
+		offset, err := read(3)
+		if err != nil {
+			return nil, err
+		}
+		size, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if size == 0 {
+			if size, err = read(2); err != nil {
+				return nil, err
+			}
+			value, err := read(1)
+			if err != nil {
+				return nil, err
+			}
+			data = bytes.Repeat([]byte{byte(value)}, size)
+		} else {
+			if pos+size > len(patch) {
+				return nil, errPatchTruncated
+			}
+			data = patch[pos : pos+size]
+			pos += size
+		}
+		if offset+len(data) > len(out) {
+			out = append(out, make([]byte, offset+len(data)-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+	if truncate, err := read(3); err == nil && truncate < len(out) {
+		out = out[:truncate]
+	}
+	return out, nil
+}
+
+/*
+Reader of the variable length numbers used by UPS and BPS patches.
+*/
+type patchReader struct {
+	data []byte
+	pos  int
+}
+
+func (reader *patchReader) byte() (byte, error) {
+	if reader.pos >= len(reader.data) {
+		return 0, errPatchTruncated
+	}
+	value := reader.data[reader.pos]
+	reader.pos++
+	return value, nil
+}
+
+func (reader *patchReader) number() (int, error) {
+	value, shift := 0, 1
+	for {
+		x, err := reader.byte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return value, nil
+		}
+		shift <<= 7
+		// Numbers are sizes and offsets in a ROM, never near this large
+		if shift > maxPatchedROMSize {
+			return 0, errPatchTooLarge
+		}
+		value += shift
+	}
+}
+
+/*
+UPS and BPS patches end with the CRC32 of the source ROM, of the patched
+ROM and of the patch itself, little endian. Returns the patched ROM CRC32
+and the patch with the footer removed.
+*/
+func checkPatchFooter(rom []byte, patch []byte) (uint32, []byte, error) {
+	if len(patch) < 16 {
+		return 0, nil, errPatchTruncated
+	}
+	body, footer := patch[:len(patch)-12], patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return 0, nil, errors.New("patch checksum mismatch")
+	}
+	if crc32.ChecksumIEEE(rom) != binary.LittleEndian.Uint32(footer[0:]) {
+		return 0, nil, errors.New("the patch is made for another ROM")
+	}
+	return binary.LittleEndian.Uint32(footer[4:]), body, nil
+}
+
+/*
+UPS patch: the source and target sizes, then a list of hunks, each one
+the number of bytes to skip followed by bytes XORed with the ROM up to
+and including a 00h byte.
+*/
+func applyUPS(rom []byte, patch []byte) ([]byte, error) {
+	targetCRC, body, err := checkPatchFooter(rom, patch)
+	if err != nil {
+		return nil, err
+	}
+	reader := &patchReader{data: body, pos: 4}
+	if _, err := reader.number(); err != nil {
+		return nil, err
+	}
+	targetSize, err := reader.number()
+	if err != nil {
+		return nil, err
+	}
+	if targetSize > maxPatchedROMSize {
+		return nil, errPatchTooLarge
+	}
+	out := make([]byte, targetSize)
+	copy(out, rom)
+	offset := 0
+	for reader.pos < len(body) {
+		skip, err := reader.number()
+		if err != nil {
+			return nil, err
+		}
+		if skip > len(out)-offset {
+			return nil, errors.New("patch hunk outside of the ROM")
+		}
+		offset += skip
+		for {
+			x, err := reader.byte()
+			if err != nil {
+				return nil, err
+			}
+			if offset < len(out) {
+				out[offset] ^= x
+			}
+			offset++
+			if x == 0 {
+				break
+			}
+		}
+	}
+	if crc32.ChecksumIEEE(out) != targetCRC {
+		return nil, errors.New("patched ROM checksum mismatch")
+	}
+	return out, nil
+}
+
+/*
+BPS patch: the source and target sizes and metadata, then a list of
+actions building the patched ROM, each one a number holding the action in
+its lower 2 bits and the length minus one in the upper bits:
+
+	0  SourceRead  Copy bytes from the ROM at the same offset
+	1  TargetRead  Copy bytes from the patch
+	2  SourceCopy  Copy bytes from the ROM at a relative offset
+	3  TargetCopy  Copy bytes already written at a relative offset
+*/
+func applyBPS(rom []byte, patch []byte) ([]byte, error) {
+	targetCRC, body, err := checkPatchFooter(rom, patch)
+	if err != nil {
+		return nil, err
+	}
+	reader := &patchReader{data: body, pos: 4}
+	if _, err := reader.number(); err != nil {
+		return nil, err
+	}
+	targetSize, err := reader.number()
+	if err != nil {
+		return nil, err
+	}
+	if targetSize > maxPatchedROMSize {
+		return nil, errPatchTooLarge
+	}
+	metadataSize, err := reader.number()
+	if err != nil {
+		return nil, err
+	}
+	if metadataSize > len(body)-reader.pos {
+		return nil, errPatchTruncated
+	}
+	reader.pos += metadataSize
+
+	out := make([]byte, 0, targetSize)
+	sourceOffset, targetOffset := 0, 0
+	// Read a signed relative offset
+	relative := func() (int, error) {
+		value, err := reader.number()
+		if value&1 != 0 {
+			return -(value >> 1), err
+		}
+		return value >> 1, err
+	}
+	for reader.pos < len(body) {
+		action, err := reader.number()
+		if err != nil {
+			return nil, err
+		}
+		length := action>>2 + 1
+		if len(out)+length > targetSize {
+			return nil, errPatchTooLarge
+		}
+		switch action & 0x3 {
+		case 0x0:
+			if len(out)+length > len(rom) {
+				return nil, errPatchTruncated
+			}
+			out = append(out, rom[len(out):len(out)+length]...)
+		case 0x1:
+			if reader.pos+length > len(body) {
+				return nil, errPatchTruncated
+			}
+			out = append(out, body[reader.pos:reader.pos+length]...)
+			reader.pos += length
+		case 0x2:
+			delta, err := relative()
+			if err != nil {
+				return nil, err
+			}
+			sourceOffset += delta
+			if sourceOffset < 0 || sourceOffset+length > len(rom) {
+				return nil, errPatchTruncated
+			}
+			out = append(out, rom[sourceOffset:sourceOffset+length]...)
+			sourceOffset += length
+		case 0x3:
+			delta, err := relative()
+			if err != nil {
+				return nil, err
+			}
+			targetOffset += delta
+			if targetOffset < 0 || targetOffset >= len(out) {
+				return nil, errPatchTruncated
+			}
+			// The copy may overlap the bytes it writes, copy byte by byte
+			for i := 0; i < length; i++ {
+				out = append(out, out[targetOffset])
+				targetOffset++
+			}
+		}
+	}
+	if len(out) != targetSize || crc32.ChecksumIEEE(out) != targetCRC {
+		return nil, errors.New("patched ROM checksum mismatch")
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+package gb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+/*
+Append the footer of UPS and BPS patches: the CRC32 of the source ROM, of
+the patched ROM and of the patch.
+*/
+func withPatchFooter(patch []byte, source []byte, target []byte) []byte {
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(source))
+	patch = append(patch, crc[:]...)
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(target))
+	patch = append(patch, crc[:]...)
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(patch))
+	return append(patch, crc[:]...)
+}
+
+// Encode a number the way UPS and BPS patches store them
+func encodePatchNumber(value int) []byte {
+	var data []byte
+	for {
+		x := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(data, x|0x80)
+		}
+		data = append(data, x)
+		value--
+	}
+}
+
+func TestApplyIPS(t *testing.T) {
+	rom := make([]byte, 8)
+	for _, c := range []struct {
+		name  string
+		patch string
+		want  []byte
+	}{
+		{"record", "PATCH\x00\x00\x02\x00\x02\xAA\xBBEOF", []byte{0, 0, 0xAA, 0xBB, 0, 0, 0, 0}},
+		{"run", "PATCH\x00\x00\x01\x00\x00\x00\x03\xCCEOF", []byte{0, 0xCC, 0xCC, 0xCC, 0, 0, 0, 0}},
+		{"grow", "PATCH\x00\x00\x07\x00\x02\x11\x22EOF", []byte{0, 0, 0, 0, 0, 0, 0, 0x11, 0x22}},
+		{"truncate", "PATCH\x00\x00\x00\x00\x01\x55EOF\x00\x00\x03", []byte{0x55, 0, 0}},
+		{"empty", "PATCHEOF", rom},
+	} {
+		got, err := applyIPS(rom, []byte(c.patch))
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%s: applyIPS = % X, %v, want % X", c.name, got, err, c.want)
+		}
+	}
+	if rom[2] != 0 {
+		t.Error("applyIPS modified the ROM")
+	}
+	for _, patch := range []string{"PATCH", "PATCH\x00\x00", "PATCH\x00\x00\x00\x00\x04\x01EOF"} {
+		if _, err := applyIPS(rom, []byte(patch)); err == nil {
+			t.Errorf("applyIPS(%q) succeeded, want an error", patch)
+		}
+	}
+}
+
+func TestPatchNumber(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		want int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0xFF}, 127},
+		{[]byte{0x00, 0x80}, 128},
+		{[]byte{0x7F, 0x80}, 255},
+		{[]byte{0x00, 0x81}, 256},
+		{[]byte{0x00, 0x00, 0x80}, 16512},
+	} {
+		reader := &patchReader{data: c.data}
+		got, err := reader.number()
+		if err != nil || got != c.want || reader.pos != len(c.data) {
+			t.Errorf("number(% X) = %d, %v, want %d", c.data, got, err, c.want)
+		}
+	}
+	if _, err := (&patchReader{data: []byte{0x00}}).number(); err == nil {
+		t.Error("number of a truncated patch succeeded, want an error")
+	}
+	for _, value := range []int{0, 127, 128, 16512, maxPatchedROMSize} {
+		reader := &patchReader{data: encodePatchNumber(value)}
+		if got, err := reader.number(); err != nil || got != value {
+			t.Errorf("number(encode(%d)) = %d, %v", value, got, err)
+		}
+	}
+	overflow := append(bytes.Repeat([]byte{0x7F}, 12), 0xFF)
+	if _, err := (&patchReader{data: overflow}).number(); err == nil {
+		t.Error("number overflowing an int succeeded, want an error")
+	}
+}
+
+func TestApplyUPS(t *testing.T) {
+	rom := []byte{0x01, 0x02, 0x03, 0x04}
+	want := []byte{0x01, 0xFF, 0x03, 0x04, 0x05}
+	// Skip 1 and XOR FDh, the 00h ending the hunk leaves 03h as is, then
+	// skip 1 and XOR 05h past the end of the ROM
+	body := []byte("UPS1\x84\x85\x81\xFD\x00\x81\x05\x00")
+	patch := withPatchFooter(body, rom, want)
+	got, err := applyUPS(rom, patch)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("applyUPS = % X, %v, want % X", got, err, want)
+	}
+
+	if _, err := applyUPS([]byte{0x01, 0x02, 0x03, 0x05}, patch); err == nil {
+		t.Error("applyUPS to another ROM succeeded, want an error")
+	}
+	corrupt := append([]byte{}, patch...)
+	corrupt[7] ^= 1
+	if _, err := applyUPS(rom, corrupt); err == nil {
+		t.Error("applyUPS of a corrupt patch succeeded, want an error")
+	}
+	wrongTarget := withPatchFooter(body, rom, []byte{0x01, 0xFF, 0x03, 0x04, 0x06})
+	if _, err := applyUPS(rom, wrongTarget); err == nil {
+		t.Error("applyUPS with a wrong target checksum succeeded, want an error")
+	}
+
+	// Patches with valid checksums but sizes and offsets out of range
+	huge := append([]byte("UPS1\x84"), encodePatchNumber(maxPatchedROMSize+1)...)
+	if _, err := applyUPS(rom, withPatchFooter(huge, rom, want)); err == nil {
+		t.Error("applyUPS with a huge target size succeeded, want an error")
+	}
+	farSkip := append([]byte("UPS1\x84\x85"), encodePatchNumber(maxPatchedROMSize)...)
+	farSkip = append(farSkip, 0x01, 0x00)
+	if _, err := applyUPS(rom, withPatchFooter(farSkip, rom, want)); err == nil {
+		t.Error("applyUPS skipping past the ROM succeeded, want an error")
+	}
+}
+
+func TestApplyBPS(t *testing.T) {
+	rom := []byte("ABCDEFGH")
+	want := []byte("ABCxyzDEFGHxyzAB")
+	body := []byte("BPS1\x88\x90\x80")
+	body = append(body,
+		// SourceRead 3
+		0x88,
+		// TargetRead 3
+		0x89, 'x', 'y', 'z',
+		// SourceCopy 5 from +3
+		0x92, 0x86,
+		// TargetCopy 3 from +3
+		0x8B, 0x86,
+		// SourceCopy 2 from -8, back to the start
+		0x86, 0x91,
+	)
+	patch := withPatchFooter(body, rom, want)
+	got, err := applyBPS(rom, patch)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("applyBPS = %q, %v, want %q", got, err, want)
+	}
+
+	// TargetCopy overlapping the bytes it writes repeats them
+	want = []byte("ABABAB")
+	body = append([]byte("BPS1\x88\x86\x80"), 0x84, 0x8F, 0x80)
+	if got, err := applyBPS(rom, withPatchFooter(body, rom, want)); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("applyBPS overlapping = %q, %v, want %q", got, err, want)
+	}
+
+	if _, err := applyBPS([]byte("ABCDEFGX"), patch); err == nil {
+		t.Error("applyBPS to another ROM succeeded, want an error")
+	}
+	// SourceCopy before the start of the ROM
+	body = append([]byte("BPS1\x88\x81\x80"), 0x82, 0x83)
+	if _, err := applyBPS(rom, withPatchFooter(body, rom, []byte("A"))); err == nil {
+		t.Error("applyBPS copying outside of the ROM succeeded, want an error")
+	}
+	huge := append([]byte("BPS1\x88"), encodePatchNumber(maxPatchedROMSize+1)...)
+	huge = append(huge, 0x80)
+	if _, err := applyBPS(rom, withPatchFooter(huge, rom, want)); err == nil {
+		t.Error("applyBPS with a huge target size succeeded, want an error")
+	}
+	metadata := append([]byte("BPS1\x88\x81"), encodePatchNumber(1<<20)...)
+	if _, err := applyBPS(rom, withPatchFooter(metadata, rom, want)); err == nil {
+		t.Error("applyBPS with metadata past the end succeeded, want an error")
+	}
+}
@@ -0,0 +1,263 @@
+package gb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+)
+
+/*
+Size of the memories at the start of a rewind state, stored as they are
+so that they stay at the same place from one state to the next: WRAM,
+VRAM, the address space and the screen.
+*/
+const rewindRawSize = 8*0x1000 + 2*0x2000 + 0x10000 + 160*144*3
+
+/*
+Ring buffer of the states kept for rewinding, one every interval frames.
+
+Only the newest state is kept whole. Every older one is stored as the XOR
+with the state taken after it, compressed: most of the memory doesn't
+change in a few frames, so the XOR is mostly zeros. Going back a state
+rebuilds the previous one from the newest, dropping the oldest only
+forgets its delta.
+*/
+type rewindBuffer struct {
+	interval int
+	// Frames since the last state, and whether a state is due at the end
+	// of the current instruction
+	frames int
+	due    bool
+
+	// Newest state, nil if there is none
+	head []byte
+	// Older states, count of them from start, the oldest first
+	deltas [][]byte
+	start  int
+	count  int
+
+	compressor *flate.Writer
+	xor        []byte
+}
+
+func newRewindBuffer(length int, interval int) *rewindBuffer {
+	if interval < 1 {
+		interval = 1
+	}
+	compressor, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &rewindBuffer{
+		interval:   interval,
+		deltas:     make([][]byte, length-1),
+		compressor: compressor,
+	}
+}
+
+/*
+Called at V-Blank.
+*/
+func (rewind *rewindBuffer) nextFrame() {
+	rewind.frames++
+	if rewind.frames >= rewind.interval {
+		rewind.frames = 0
+		rewind.due = true
+	}
+}
+
+/*
+Take a state of the emulator, the oldest one is forgotten when the buffer
+is full.
+*/
+func (rewind *rewindBuffer) capture(core *Core) {
+	rewind.due = false
+	state, err := core.rewindState()
+	if err != nil {
+		log.Println("[Rewind] Failed to take a state:", err)
+		return
+	}
+	if rewind.head != nil && len(rewind.deltas) > 0 {
+		if rewind.count == len(rewind.deltas) {
+			rewind.start = (rewind.start + 1) % len(rewind.deltas)
+			rewind.count--
+		}
+		rewind.deltas[(rewind.start+rewind.count)%len(rewind.deltas)] = rewind.delta(rewind.head, state)
+		rewind.count++
+	}
+	rewind.head = state
+}
+
+/*
+Rebuild the state before the newest one, which is dropped.
+*/
+func (rewind *rewindBuffer) pop() error {
+	if rewind.count == 0 {
+		rewind.head = nil
+		return nil
+	}
+	newest := (rewind.start + rewind.count - 1) % len(rewind.deltas)
+	previous, err := rewind.apply(rewind.deltas[newest], rewind.head)
+	rewind.deltas[newest] = nil
+	rewind.count--
+	if err != nil {
+		rewind.clear()
+		return err
+	}
+	rewind.head = previous
+	return nil
+}
+
+func (rewind *rewindBuffer) clear() {
+	rewind.head = nil
+	for i := range rewind.deltas {
+		rewind.deltas[i] = nil
+	}
+	rewind.start = 0
+	rewind.count = 0
+}
+
+/*
+Compress the XOR of state with base, prefixed with the length of state.
+*/
+func (rewind *rewindBuffer) delta(state []byte, base []byte) []byte {
+	if cap(rewind.xor) < len(state) {
+		rewind.xor = make([]byte, len(state))
+	}
+	xor := rewind.xor[:len(state)]
+	copy(xor, state)
+	for i := 0; i < len(xor) && i < len(base); i++ {
+		xor[i] ^= base[i]
+	}
+
+	var length [binary.MaxVarintLen64]byte
+	delta := bytes.NewBuffer(length[:binary.PutUvarint(length[:], uint64(len(state)))])
+	rewind.compressor.Reset(delta)
+	rewind.compressor.Write(xor)
+	rewind.compressor.Close()
+	return delta.Bytes()
+}
+
+/*
+Rebuild a state from its delta against base.
+*/
+func (rewind *rewindBuffer) apply(delta []byte, base []byte) ([]byte, error) {
+	length, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, errors.New("invalid rewind delta")
+	}
+	state := make([]byte, length)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(delta[n:])), state); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(state) && i < len(base); i++ {
+		state[i] ^= base[i]
+	}
+	return state, nil
+}
+
+/*
+Snapshot the emulator for rewinding: the memories as they are, followed
+by the other fields of stateData encoded with gob, which vary in length.
+*/
+func (core *Core) rewindState() ([]byte, error) {
+	data, err := core.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	state := make([]byte, 0, rewindRawSize+0x1000)
+	for bank := range data.WRAM {
+		state = append(state, data.WRAM[bank][:]...)
+	}
+	for bank := range data.VRAM {
+		state = append(state, data.VRAM[bank][:]...)
+	}
+	state = append(state, data.Memory[:]...)
+	for x := range data.Screen {
+		for y := range data.Screen[x] {
+			state = append(state, data.Screen[x][y][:]...)
+		}
+	}
+
+	buffer := bytes.NewBuffer(state)
+	encoder := gob.NewEncoder(buffer)
+	fields := reflect.ValueOf(data).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if !rewindRawFields[fields.Type().Field(i).Name] {
+			if err := encoder.Encode(fields.Field(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Fields of stateData at the start of rewind states
+var rewindRawFields = map[string]bool{"WRAM": true, "VRAM": true, "Memory": true, "Screen": true}
+
+func (core *Core) loadRewindState(state []byte) error {
+	data := new(stateData)
+	offset := 0
+	for bank := range data.WRAM {
+		offset += copy(data.WRAM[bank][:], state[offset:])
+	}
+	for bank := range data.VRAM {
+		offset += copy(data.VRAM[bank][:], state[offset:])
+	}
+	offset += copy(data.Memory[:], state[offset:])
+	for x := range data.Screen {
+		for y := range data.Screen[x] {
+			offset += copy(data.Screen[x][y][:], state[offset:])
+		}
+	}
+
+	decoder := gob.NewDecoder(bytes.NewReader(state[offset:]))
+	fields := reflect.ValueOf(data).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if !rewindRawFields[fields.Type().Field(i).Name] {
+			if err := decoder.Decode(fields.Field(i).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return core.restore(data)
+}
+
+/*
+Go back to the newest state kept for rewinding, it is then dropped so that
+each call goes further back. Return false if there is none left. Must be
+called from the emulation goroutine, between two instructions.
+*/
+func (core *Core) Rewind() bool {
+	rewind := core.rewind
+	if rewind == nil || rewind.head == nil {
+		return false
+	}
+	err := core.loadRewindState(rewind.head)
+	if err == nil {
+		err = rewind.pop()
+	}
+	rewind.frames = 0
+	rewind.due = false
+	if err != nil {
+		log.Println("[Rewind] Failed to restore a state:", err)
+		rewind.clear()
+		return false
+	}
+	return true
+}
+
+/*
+Go back a state if the rewind hotkey was held since the last frame, return
+whether the emulator rewound instead of running.
+*/
+func (core *Core) rewindIfHeld() bool {
+	if !core.rewinding {
+		return false
+	}
+	core.rewinding = false
+	core.Rewind()
+	return true
+}
@@ -0,0 +1,181 @@
+package gb
+
+import (
+	"encoding/binary"
+
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+MBC3 real time clock.
+
+	08h  RTC S   Seconds   0-59 (0-3Bh)
+	09h  RTC M   Minutes   0-59 (0-3Bh)
+	0Ah  RTC H   Hours     0-23 (0-17h)
+	0Bh  RTC DL  Lower 8 bits of Day Counter (0-FFh)
+	0Ch  RTC DH  Upper 1 bit of Day Counter, Carry Bit, Halt Flag
+	      Bit 0  Most significant bit of Day Counter (Bit 8)
+	      Bit 6  Halt (0=Active, 1=Stop Timer)
+	      Bit 7  Day Counter Carry Bit (1=Counter Overflow)
+
+The clock follows the wall-clock time, the counters are brought up to date
+with the seconds elapsed since the last update whenever they are accessed.
+*/
+type RTC struct {
+	Seconds byte
+	Minutes byte
+	Hours   byte
+	// 9bit day counter
+	Days  uint16
+	Halt  bool
+	Carry bool
+	// Unix time the counters were last brought up to date
+	LastUpdate int64
+}
+
+/*
+Bring the counters up to date with the given unix time.
+*/
+func (rtc *RTC) update(now int64) {
+	elapsed := now - rtc.LastUpdate
+	rtc.LastUpdate = now
+	if rtc.Halt || elapsed <= 0 {
+		return
+	}
+
+	// Out of range values count up to the register limit before wrapping, tick them one by one
+	for ; elapsed > 0 && (rtc.Seconds >= 60 || rtc.Minutes >= 60 || rtc.Hours >= 24); elapsed-- {
+		rtc.tick()
+	}
+	total := int64(rtc.Seconds) + int64(rtc.Minutes)*60 + int64(rtc.Hours)*3600 + int64(rtc.Days)*86400 + elapsed
+	days := total / 86400
+	if days >= 512 {
+		rtc.Carry = true
+		days %= 512
+	}
+	rtc.Days = uint16(days)
+	rtc.Hours = byte(total % 86400 / 3600)
+	rtc.Minutes = byte(total % 3600 / 60)
+	rtc.Seconds = byte(total % 60)
+}
+
+/*
+Advance the clock by one second.
+*/
+func (rtc *RTC) tick() {
+	rtc.Seconds = (rtc.Seconds + 1) & 0x3F
+	if rtc.Seconds != 60 {
+		return
+	}
+	rtc.Seconds = 0
+	rtc.Minutes = (rtc.Minutes + 1) & 0x3F
+	if rtc.Minutes != 60 {
+		return
+	}
+	rtc.Minutes = 0
+	rtc.Hours = (rtc.Hours + 1) & 0x1F
+	if rtc.Hours != 24 {
+		return
+	}
+	rtc.Hours = 0
+	rtc.Days++
+	if rtc.Days == 512 {
+		rtc.Days = 0
+		rtc.Carry = true
+	}
+}
+
+/*
+Current value of the 5 RTC registers 08h-0Ch.
+*/
+func (rtc *RTC) registers() [5]byte {
+	dh := byte(rtc.Days>>8) & 0x1
+	if rtc.Halt {
+		dh = util.SetBit(dh, 6)
+	}
+	if rtc.Carry {
+		dh = util.SetBit(dh, 7)
+	}
+	return [5]byte{rtc.Seconds, rtc.Minutes, rtc.Hours, byte(rtc.Days), dh}
+}
+
+/*
+Write one of the RTC registers 08h-0Ch at the given unix time.
+*/
+func (rtc *RTC) write(register byte, data byte, now int64) {
+	rtc.update(now)
+	switch register {
+	case 0x08:
+		rtc.Seconds = data & 0x3F
+	case 0x09:
+		rtc.Minutes = data & 0x3F
+	case 0x0A:
+		rtc.Hours = data & 0x1F
+	case 0x0B:
+		rtc.Days = rtc.Days&0x100 | uint16(data)
+	case 0x0C:
+		rtc.Days = rtc.Days&0xFF | uint16(data&0x1)<<8
+		rtc.Halt = util.TestBit(data, 6)
+		rtc.Carry = util.TestBit(data, 7)
+	}
+}
+
+/*
+Size of the RTC footer appended to the cartridge RAM in save files, and of
+its older variant with a 32bit timestamp.
+*/
+const (
+	rtcFooterSize      = 48
+	rtcShortFooterSize = 44
+)
+
+/*
+Split a save file into the cartridge RAM and the clock footer, if it has
+one of the given sizes. RAM sizes are multiples of 2KBytes, the footer is
+whatever is left.
+*/
+func splitSaveFooter(data []byte, footerSizes ...int) ([]byte, []byte) {
+	for _, size := range footerSizes {
+		if len(data)%0x800 == size {
+			ramSize := len(data) - size
+			return data[:ramSize], data[ramSize:]
+		}
+	}
+	return data, nil
+}
+
+/*
+Restore the clock from a save file footer:
+
+	5 x uint32 - Current S, M, H, DL, DH registers
+	5 x uint32 - Latched S, M, H, DL, DH registers
+	uint64     - Unix timestamp (uint32 in the 44 bytes variant)
+
+All values are little endian.
+*/
+func (rtc *RTC) loadFooter(footer []byte, latched *[5]byte) {
+	for i := 0; i < 5; i++ {
+		rtc.write(byte(0x08+i), byte(binary.LittleEndian.Uint32(footer[i*4:])), rtc.LastUpdate)
+		latched[i] = byte(binary.LittleEndian.Uint32(footer[20+i*4:]))
+	}
+	if len(footer) == rtcFooterSize {
+		rtc.LastUpdate = int64(binary.LittleEndian.Uint64(footer[40:]))
+	} else {
+		rtc.LastUpdate = int64(binary.LittleEndian.Uint32(footer[40:]))
+	}
+}
+
+/*
+Build the save file footer at the given unix time.
+*/
+func (rtc *RTC) footer(latched [5]byte, now int64) []byte {
+	rtc.update(now)
+	footer := make([]byte, rtcFooterSize)
+	current := rtc.registers()
+	for i := 0; i < 5; i++ {
+		binary.LittleEndian.PutUint32(footer[i*4:], uint32(current[i]))
+		binary.LittleEndian.PutUint32(footer[20+i*4:], uint32(latched[i]))
+	}
+	binary.LittleEndian.PutUint64(footer[40:], uint64(rtc.LastUpdate))
+	return footer
+}
@@ -0,0 +1,301 @@
+package gb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+A test vector of the SingleStepTests SM83 suite: the state of the CPU and
+of the memory before and after one instruction, and what happened on the
+bus at each M-cycle, [address, data, "r-m"], [address, data, "-wm"] or
+[address, data, "---"] when the bus isn't accessed.
+*/
+type stepVector struct {
+	Name    string          `json:"name"`
+	Initial stepState       `json:"initial"`
+	Final   stepState       `json:"final"`
+	Cycles  [][]interface{} `json:"cycles"`
+}
+
+type stepState struct {
+	PC  uint16 `json:"pc"`
+	SP  uint16 `json:"sp"`
+	A   byte   `json:"a"`
+	B   byte   `json:"b"`
+	C   byte   `json:"c"`
+	D   byte   `json:"d"`
+	E   byte   `json:"e"`
+	F   byte   `json:"f"`
+	H   byte   `json:"h"`
+	L   byte   `json:"l"`
+	IME byte   `json:"ime"`
+	// Only in some versions of the suite
+	IE  *byte       `json:"ie"`
+	EI  *byte       `json:"ei"`
+	RAM [][2]uint16 `json:"ram"`
+}
+
+// Failures reported for each file, the others are only counted
+const maxStepFailures = 20
+
+/*
+Run the SingleStepTests SM83 vectors of the directory named by
+GBDOTLIVE_SM83_TESTS, testdata/sm83 by default, one test per opcode file
+(00.json, cb 00.json...). Files may be gzipped. The vectors are not
+distributed with the emulator, the test is skipped if there are none.
+*/
+func TestSingleStep(t *testing.T) {
+	dir := os.Getenv("GBDOTLIVE_SM83_TESTS")
+	if dir == "" {
+		dir = "testdata/sm83"
+	}
+	var files []string
+	for _, pattern := range []string{"*.json", "*.json.gz"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		t.Skipf("no test vectors in %s", dir)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".json")
+		t.Run(name, func(t *testing.T) {
+			vectors, err := loadStepVectors(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ram := new(FlatRAM)
+			core := NewBusCore(ram)
+			failures := 0
+			for _, vector := range vectors {
+				if errs := runStepVector(core, ram, vector); len(errs) > 0 {
+					failures++
+					if failures <= maxStepFailures {
+						t.Errorf("%s: %s", vector.Name, strings.Join(errs, ", "))
+					}
+				}
+			}
+			if failures > maxStepFailures {
+				t.Errorf("%d more vectors failed, %d of %d", failures-maxStepFailures, failures, len(vectors))
+			}
+		})
+	}
+}
+
+func loadStepVectors(path string) ([]stepVector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var vectors []stepVector
+	err = json.NewDecoder(r).Decode(&vectors)
+	return vectors, err
+}
+
+/*
+Execute the instruction of a vector and return the differences with its
+final state.
+*/
+func runStepVector(core *Core, ram *FlatRAM, vector stepVector) []string {
+	initial := vector.Initial
+	ram.Data = [0x10000]byte{}
+	for _, cell := range initial.RAM {
+		ram.Data[cell[0]] = byte(cell[1])
+	}
+	if initial.IE != nil {
+		ram.Data[0xFFFF] = *initial.IE
+	}
+
+	/*
+		The vectors of the SM83 suite start with the opcode already
+		fetched, PC is past it, and end with the opcode of the next
+		instruction fetched. Other suites start at the opcode.
+	*/
+	start := initial.PC
+	prefetched := !stepOpcodeAt(ram, start, vector.Name) && stepOpcodeAt(ram, start-1, vector.Name)
+	if prefetched {
+		start--
+	}
+
+	cpu := &core.CPU
+	*cpu = CPU{}
+	cpu.Registers = Registers{
+		A:  initial.A,
+		B:  initial.B,
+		C:  initial.C,
+		D:  initial.D,
+		E:  initial.E,
+		F:  initial.F,
+		HL: uint16(initial.H)<<8 | uint16(initial.L),
+		SP: initial.SP,
+		PC: start,
+	}
+	cpu.Flags.Zero = initial.F&0x80 != 0
+	cpu.Flags.Sub = initial.F&0x40 != 0
+	cpu.Flags.HalfCarry = initial.F&0x20 != 0
+	cpu.Flags.Carry = initial.F&0x10 != 0
+	cpu.Flags.InterruptMaster = initial.IME != 0
+	cpu.Flags.PendingInterruptEnabled = initial.EI != nil && *initial.EI != 0
+	core.err = nil
+
+	ram.Accesses = ram.Accesses[:0]
+	ram.Record = true
+	cycles := core.ExecuteNextOPCode()
+	if prefetched {
+		core.ReadMemory(cpu.Registers.PC)
+		cpu.Registers.PC++
+	}
+	ram.Record = false
+
+	var errs []string
+	if core.err != nil {
+		errs = append(errs, core.err.Error())
+	}
+	final := vector.Final
+	for _, register := range []struct {
+		name      string
+		got, want uint16
+	}{
+		{"A", uint16(cpu.Registers.A), uint16(final.A)},
+		{"F", uint16(traceFlags(cpu)), uint16(final.F)},
+		{"B", uint16(cpu.Registers.B), uint16(final.B)},
+		{"C", uint16(cpu.Registers.C), uint16(final.C)},
+		{"D", uint16(cpu.Registers.D), uint16(final.D)},
+		{"E", uint16(cpu.Registers.E), uint16(final.E)},
+		{"H", cpu.Registers.HL >> 8, uint16(final.H)},
+		{"L", cpu.Registers.HL & 0xFF, uint16(final.L)},
+		{"SP", cpu.Registers.SP, final.SP},
+		{"PC", cpu.Registers.PC, final.PC},
+	} {
+		if register.got != register.want {
+			errs = append(errs, fmt.Sprintf("%s = %02X, want %02X", register.name, register.got, register.want))
+		}
+	}
+
+	// Without a separate EI flag, a pending EI counts as IME set
+	ime := cpu.Flags.InterruptMaster
+	if final.EI != nil {
+		if pending := *final.EI != 0; cpu.Flags.PendingInterruptEnabled != pending {
+			errs = append(errs, fmt.Sprintf("EI pending = %v, want %v", cpu.Flags.PendingInterruptEnabled, pending))
+		}
+	} else {
+		ime = ime || cpu.Flags.PendingInterruptEnabled
+	}
+	if want := final.IME != 0; ime != want {
+		errs = append(errs, fmt.Sprintf("IME = %v, want %v", ime, want))
+	}
+	if final.IE != nil && ram.Data[0xFFFF] != *final.IE {
+		errs = append(errs, fmt.Sprintf("IE = %02X, want %02X", ram.Data[0xFFFF], *final.IE))
+	}
+	for _, cell := range final.RAM {
+		if got := ram.Data[cell[0]]; got != byte(cell[1]) {
+			errs = append(errs, fmt.Sprintf("(%04X) = %02X, want %02X", cell[0], got, cell[1]))
+		}
+	}
+
+	if want := len(vector.Cycles) * 4; cycles != want {
+		errs = append(errs, fmt.Sprintf("%d cycles, want %d", cycles, want))
+	}
+	accesses, err := stepAccesses(vector.Cycles)
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	if prefetched {
+		// The opcode fetch isn't part of the vector
+		ram.Accesses = ram.Accesses[1:]
+	}
+	if !equalAccesses(ram.Accesses, accesses) {
+		errs = append(errs, fmt.Sprintf("bus %s, want %s", formatAccesses(ram.Accesses), formatAccesses(accesses)))
+	}
+	return errs
+}
+
+/*
+Whether the opcode of the vector, the first byte of its name, is at
+address. CB prefixed opcodes are named "cb XX".
+*/
+func stepOpcodeAt(ram *FlatRAM, address uint16, name string) bool {
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return false
+	}
+	opcode, err := strconv.ParseUint(fields[0], 16, 8)
+	if err != nil || ram.Data[address] != byte(opcode) {
+		return false
+	}
+	if opcode == 0xCB && len(fields) > 1 {
+		next, err := strconv.ParseUint(fields[1], 16, 8)
+		return err == nil && ram.Data[address+1] == byte(next)
+	}
+	return true
+}
+
+/*
+Memory accesses of the cycles of a vector, cycles without any are skipped.
+*/
+func stepAccesses(cycles [][]interface{}) ([]BusAccess, error) {
+	var accesses []BusAccess
+	for _, cycle := range cycles {
+		if len(cycle) != 3 {
+			return nil, fmt.Errorf("invalid cycle: %v", cycle)
+		}
+		kind, _ := cycle[2].(string)
+		read := strings.HasPrefix(kind, "r")
+		write := !read && strings.Contains(kind, "w")
+		if !read && !write {
+			continue
+		}
+		address, ok := cycle[0].(float64)
+		data, ok2 := cycle[1].(float64)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid cycle: %v", cycle)
+		}
+		accesses = append(accesses, BusAccess{Address: uint16(address), Data: byte(data), Write: write})
+	}
+	return accesses, nil
+}
+
+func equalAccesses(a, b []BusAccess) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatAccesses(accesses []BusAccess) string {
+	parts := make([]string, len(accesses))
+	for i, access := range accesses {
+		kind := "r"
+		if access.Write {
+			kind = "w"
+		}
+		parts[i] = fmt.Sprintf("%s %04X:%02X", kind, access.Address, access.Data)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -2,72 +2,151 @@ package gb
 
 import (
 	"github.com/HFO4/gbc-in-cloud/util"
-	"github.com/faiface/beep"
-	"github.com/faiface/beep/effects"
-	"github.com/faiface/beep/speaker"
-	"log"
-	"math"
-	"math/rand"
-	"time"
 )
 
-type Sound struct {
-	Channel4 Channel
-	Channel3 Channel
-	Channel2 Channel
-	Channel1 Channel
+// Clock of the APU, which does not change in CGB double speed mode
+const soundClock = 4194304
+
+// Clocks averaged into one sample of the APU output
+const soundSampleClocks = 64
+
+// Rate of the samples produced by the APU
+const SoundSampleRate = soundClock / soundSampleClocks
 
-	enable bool
+// Clocks between two steps of the 512Hz frame sequencer
+const frameSequencerClocks = soundClock / 512
 
-	leftVolume  uint8
-	rightVolume uint8
+// Samples kept when they are not collected by the emulation loop, one second
+const maxPendingSamples = SoundSampleRate
 
-	VRAMCache   []byte
-	SampleCache [32]float64
+/*
+	Audio processing unit, clocked by the emulated CPU.
+
+	FF10-FF14 - Channel 1, tone and sweep
+	FF16-FF19 - Channel 2, tone
+	FF1A-FF1E - Channel 3, wave output
+	FF20-FF23 - Channel 4, noise
+	FF24-FF26 - Sound control registers
+	FF30-FF3F - Wave pattern RAM
+*/
+type Sound struct {
+	// NR52 Bit 7, all sound on/off
+	Enable bool
+
+	Channel1 SquareChannel
+	Channel2 SquareChannel
+	Channel3 WaveChannel
+	Channel4 NoiseChannel
+
+	// Raw values written to FF10-FF3F
+	Registers [0x30]byte
+
+	// Step of the frame sequencer, 0-7
+	FrameSequencer int
+	// Clocks left until the next frame sequencer step
+	FrameSequencerTimer int
+
+	// Output accumulated for the current sample
+	SampleLeft   float64
+	SampleRight  float64
+	SampleClocks int
+	// State of the high-pass filter removing the DC offset of the DACs
+	CapacitorLeft  float64
+	CapacitorRight float64
+
+	// Samples produced since the last frame, waiting to be pushed to the audio driver
+	samples [][2]float64
 }
 
-type Channel struct {
-	self   *Channel
-	parent *Sound
+/*
+	Length counter, disables the channel when it reaches zero.
+	Clocked at 256Hz by the frame sequencer.
+*/
+type LengthCounter struct {
+	Length  int
+	Enabled bool
+}
 
-	enable bool
+/*
+	Volume envelope of channel 1, 2 and 4, clocked at 64Hz by the frame sequencer.
+	  Bit 7-4 - Initial Volume of envelope (0-0Fh) (0=No Sound)
+	  Bit 3   - Envelope Direction (0=Decrease, 1=Increase)
+	  Bit 2-0 - Number of envelope sweep (n: 0-7)
+	            (If zero, stop envelope operation.)
+*/
+type Envelope struct {
+	Initial  byte
+	Increase bool
+	Period   byte
+	Timer    byte
+	Volume   byte
+}
 
-	envelopeIncrease bool
-	envelopeInitial  byte
-	envelopeSweepNum byte
-	lastEnvelope     float64
-	envelopeTick     float64
+/*
+	Frequency sweep of channel 1, clocked at 128Hz by the frame sequencer.
+	FF10 - NR10 - Channel 1 Sweep register (R/W)
+	  Bit 6-4 - Sweep Time
+	  Bit 3   - Sweep Increase/Decrease
+	             0: Addition    (frequency increases)
+	             1: Subtraction (frequency decreases)
+	  Bit 2-0 - Number of sweep shift (n: 0-7)
+*/
+type Sweep struct {
+	Period  byte
+	Negate  bool
+	Shift   byte
+	Timer   byte
+	Enabled bool
+	Shadow  uint16
+	// Whether a subtraction has been calculated since the last trigger
+	NegateUsed bool
+}
 
-	sweepIncrease bool
-	sweepNumber   byte
-	sweepTime     int
-	lastSweep     float64
-	sweepTick     float64
-	freqInitial   int
-	freqLast      int
+type SquareChannel struct {
+	// Channel status reported in NR52
+	Enabled bool
+	// DAC power, bits 7-3 of NRx2
+	DAC bool
+
+	Duty      byte
+	DutyStep  byte
+	Frequency uint16
+	Timer     int
+
+	Length   LengthCounter
+	Envelope Envelope
+	// Channel 1 only
+	Sweep Sweep
+}
 
-	stopWhileTimeout bool
+type WaveChannel struct {
+	Enabled bool
+	// NR30 Bit 7
+	DAC bool
 
-	Freq     int
-	freqLow  uint16
-	freqHigh uint16
-	waveDuty byte
+	VolumeCode byte
+	Frequency  uint16
+	Timer      int
+	// Current sample of the 32 4bit samples in wave RAM
+	Position     byte
+	SampleBuffer byte
 
-	volume float64
+	Length LengthCounter
+}
 
-	duration   float64
-	sampleTick float64
-	tickUnit   float64
+type NoiseChannel struct {
+	Enabled bool
+	DAC     bool
 
-	// For noise wave
-	lastGenerate     float64
-	lastGenerateTick float64
+	ClockShift  byte
+	WidthMode   bool
+	DivisorCode byte
+	Timer       int
+	// Linear feedback shift register
+	LFSR uint16
 
-	// Wave type
-	//		0 - Square
-	//		1 - Noise
-	//		2 - Sample
-	wave int
+	Length   LengthCounter
+	Envelope Envelope
 }
 
 /*
@@ -77,93 +156,65 @@ type Channel struct {
 	  10: 50%   ( ____----____----____---- ) (normal)
 	  11: 75%   ( ______--______--______-- )
 */
-var waveDutyMap = [5]float64{
-	1: -0.25,
-	2: -0.5,
-	3: 0,
-	4: 0.5,
+var dutyPatterns = [4][8]byte{
+	{0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 0},
 }
 
-var sweepTime = [8]float64{
-	0: 0.0,
-	1: 1.0 / 128,
-	2: 2.0 / 128,
-	3: 3.0 / 128,
-	4: 4.0 / 128,
-	5: 5.0 / 128,
-	6: 6.0 / 128,
-	7: 7.0 / 128,
-}
-
-const secondPerTick = 1 / 44100.0
-
-func (sound *Sound) Init() {
-	log.Println("[Sound] Initialize Sound process unit")
-	sound.enable = true
-	sound.Channel2.enable = false
-	sound.Channel2.self = &sound.Channel2
-	sound.Channel2.parent = sound
-
-	sound.Channel1.enable = false
-	sound.Channel1.self = &sound.Channel1
-	sound.Channel1.parent = sound
-
-	sound.Channel3.enable = false
-	sound.Channel3.self = &sound.Channel3
-	sound.Channel3.parent = sound
-	sound.Channel3.wave = 3
-
-	sound.Channel4.enable = false
-	sound.Channel4.self = &sound.Channel4
-	sound.Channel4.parent = sound
-	sound.Channel4.wave = 2
+// Noise channel timer periods by dividing ratio
+var noiseDivisors = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
 
-	sound.Play()
+/*
+	Bits always read as 1 in FF10-FF2F, unused and write only bits.
+*/
+var soundReadMasks = [0x20]byte{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF,
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF,
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF,
+	0xFF, 0xFF, 0x00, 0x00, 0xBF,
+	0x00, 0x00, 0x70,
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
 }
 
-func (sound *Sound) Play() {
-	sr := beep.SampleRate(44100)
-	err := speaker.Init(sr, sr.N(time.Second/30))
-	if err != nil {
-		log.Println("[Warning] Failed to init sound speaker")
-	}
-
-	stream := &beep.Mixer{}
-	stream.Add(sound.Channel1)
-	stream.Add(sound.Channel2)
-	stream.Add(sound.Channel3)
-	stream.Add(sound.Channel4)
-
-	//done := make(chan bool)
-	//rawStream := beep.Seq(&stream, beep.Callback(func() {
-	//	done <- true
-	//}))
-	volume := &effects.Volume{
-		Streamer: stream,
-		Base:     2,
-		Volume:   -3,
-	}
-	speaker.Play(volume)
-	//<-done
+/*
+	Set the sound registers to the values left by the boot ROM,
+	according to http://bgb.bircd.org/pandocs.htm#powerupsequence
+*/
+func (sound *Sound) Reset() {
+	*sound = Sound{samples: sound.samples[:0]}
+	sound.Write(0xFF26, 0x80)
+	sound.Write(0xFF10, 0x80)
+	sound.Write(0xFF11, 0xBF)
+	sound.Write(0xFF12, 0xF3)
+	sound.Write(0xFF14, 0x3F)
+	sound.Write(0xFF16, 0x3F)
+	sound.Write(0xFF17, 0x00)
+	sound.Write(0xFF19, 0x3F)
+	sound.Write(0xFF1A, 0x7F)
+	sound.Write(0xFF1B, 0xFF)
+	sound.Write(0xFF1C, 0x9F)
+	sound.Write(0xFF1E, 0x3F)
+	sound.Write(0xFF20, 0xFF)
+	sound.Write(0xFF21, 0x00)
+	sound.Write(0xFF22, 0x00)
+	sound.Write(0xFF23, 0x3F)
+	sound.Write(0xFF24, 0x77)
+	sound.Write(0xFF25, 0xF3)
+	// Channel 1 is left on by the boot sound
+	sound.Channel1.Enabled = true
+	sound.Channel4.LFSR = 0x7FFF
 }
 
 /*
-	When sound related memory is writen, this function will be
-	called to update sound props.
+	Read a sound register.
 */
-func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
-	sound.VRAMCache = vram
-	//log.Printf("new Sound:%X : %X tick:%d\n", address, val,sound.Channel2.sampleTick)
+func (sound *Sound) Read(address uint16) byte {
 	if address >= 0xFF30 {
-		count := 0
-		for i := 0; i < 0xF; i++ {
-			sound.SampleCache[count] = float64(vram[0x20+i]>>4) / float64(0xf)
-			count++
-			sound.SampleCache[count] = float64(vram[0x20+i]&0xF) / float64(0xf)
-		}
+		return sound.Registers[address-0xFF10]
 	}
-	switch address {
-	case 0xFF26:
+	if address == 0xFF26 {
 		/*
 			FF26 - NR52 - Sound on/off
 			  Bit 7 - All sound on/off  (0: stop all sound circuits) (Read/Write)
@@ -172,75 +223,72 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			  Bit 1 - Sound 2 ON flag (Read Only)
 			  Bit 0 - Sound 1 ON flag (Read Only)
 		*/
-		sound.enable = util.TestBit(val, 7)
-	case 0xFF25:
-		/*
-			FF25 - NR51 - Selection of Sound output terminal (R/W)
-			  Bit 7 - Output sound 4 to SO2 terminal
-			  Bit 6 - Output sound 3 to SO2 terminal
-			  Bit 5 - Output sound 2 to SO2 terminal
-			  Bit 4 - Output sound 1 to SO2 terminal
-			  Bit 3 - Output sound 4 to SO1 terminal
-			  Bit 2 - Output sound 3 to SO1 terminal
-			  Bit 1 - Output sound 2 to SO1 terminal
-			  Bit 0 - Output sound 1 to SO1 terminal
-
-			TODO: Separate Right/Left channel
-		*/
-		if !(util.TestBit(val, 5) || util.TestBit(val, 1)) {
-			sound.Channel2.enable = false
+		res := byte(0x70)
+		if sound.Enable {
+			res = util.SetBit(res, 7)
 		}
-	case 0xFF24:
-		/*
-			FF24 - NR50 - Channel control / ON-OFF / Volume (R/W)
-				The volume bits specify the "Master Volume" for Left/Right sound output.
-				  Bit 7   - Output Vin to SO2 terminal (1=Enable)
-				  Bit 6-4 - SO2 output level (volume)  (0-7)
-				  Bit 3   - Output Vin to SO1 terminal (1=Enable)
-				  Bit 2-0 - SO1 output level (volume)  (0-7)
-		*/
-		sound.leftVolume = uint8(val & 0x7)
-		sound.rightVolume = uint8((val >> 4) & 0x7)
-	// Channel 1
-	case 0xFF14:
-		if util.TestBit(val, 7) {
-			sound.Channel1.reSet()
-			//Envelope options
-			sound.Channel1.envelopeIncrease = util.TestBit(sound.VRAMCache[0x02], 3)
-			sound.Channel1.envelopeInitial = (sound.VRAMCache[0x02] & 0xF0) >> 4
-			sound.Channel1.envelopeSweepNum = sound.VRAMCache[0x02] & 0x7
-			sound.Channel1.volume = float64(sound.Channel1.envelopeInitial) / float64(0xf)
-
-			//Sweep options
-			sound.Channel1.sweepIncrease = !util.TestBit(sound.VRAMCache[0x00], 3)
-			sound.Channel1.sweepNumber = sound.VRAMCache[0x00] & 0x7
-			sound.Channel1.sweepTime = int((sound.VRAMCache[0x00] & 0x70) >> 4)
-
-			sound.Channel1.freqInitial = int(sound.Channel1.freqHigh + sound.Channel1.freqLow)
-			sound.Channel1.freqLast = int(sound.Channel1.freqHigh + sound.Channel1.freqLow)
-
-			sound.Channel1.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel1.freqHigh = uint16((val & 0x7)) << 8
-			sound.Channel1.Freq = 131072 / (2048 - int(sound.Channel1.freqHigh+uint16(sound.VRAMCache[0x03])))
-			sound.Channel1.tickUnit = 44100.0 / float64(sound.Channel1.Freq)
-
-			sound.Channel1.waveDuty = (sound.VRAMCache[0x01] >> 6) + 1
-			sound.Channel1.duration = (64.0 - float64(sound.VRAMCache[0x01]&0x3F)) * (1.0 / 256.0)
+		if sound.Channel1.Enabled {
+			res = util.SetBit(res, 0)
+		}
+		if sound.Channel2.Enabled {
+			res = util.SetBit(res, 1)
+		}
+		if sound.Channel3.Enabled {
+			res = util.SetBit(res, 2)
+		}
+		if sound.Channel4.Enabled {
+			res = util.SetBit(res, 3)
+		}
+		return res
+	}
+	return sound.Registers[address-0xFF10] | soundReadMasks[address-0xFF10]
+}
 
-			sound.Channel1.enable = true
+/*
+	When sound related memory is writen, this function will be
+	called to update sound props.
+*/
+func (sound *Sound) Write(address uint16, val byte) {
+	// Registers can't be written while the APU is off, except NR52 and the wave RAM
+	if !sound.Enable && address < 0xFF26 {
+		return
+	}
+	sound.Registers[address-0xFF10] = val
 
-			//log.Println(sound.Channel1)
+	switch address {
+	// Channel 1
+	case 0xFF10:
+		sweep := &sound.Channel1.Sweep
+		sweep.Period = (val >> 4) & 0x7
+		sweep.Negate = util.TestBit(val, 3)
+		sweep.Shift = val & 0x7
+		// Leaving subtraction mode after it was used disables the channel
+		if !sweep.Negate && sweep.NegateUsed {
+			sound.Channel1.Enabled = false
 		}
-		//log.Println(sound.Channel1)
 	case 0xFF11:
-		sound.Channel1.waveDuty = (sound.VRAMCache[0x01] >> 6) + 1
+		sound.Channel1.writeLength(val)
+	case 0xFF12:
+		sound.Channel1.writeEnvelope(val)
 	case 0xFF13:
-		//sound.Channel1.freqLow = uint16(val)
-		//sound.Channel1.Freq = 131072 / (2048 - int(sound.Channel1.freqHigh+sound.Channel1.freqLow))
-		//sound.Channel1.tickUnit = 44100.0 / float64(sound.Channel1.Freq)
-		//log.Println(sound.Channel1)
+		sound.Channel1.Frequency = sound.Channel1.Frequency&0x700 | uint16(val)
+	case 0xFF14:
+		if sound.Channel1.writeControl(val) {
+			sound.Channel1.triggerSweep()
+		}
 
 	// Channel 2
+	case 0xFF16:
+		sound.Channel2.writeLength(val)
+	case 0xFF17:
+		sound.Channel2.writeEnvelope(val)
+	case 0xFF18:
+		/*
+			FF18 - NR23 - Channel 2 Frequency lo data (W)
+				Frequency's lower 8 bits of 11 bit data (x).
+				Next 3 bits are in NR24 ($FF19).
+		*/
+		sound.Channel2.Frequency = sound.Channel2.Frequency&0x700 | uint16(val)
 	case 0xFF19:
 		/*
 			FF19 - NR24 - Channel 2 Frequency hi data (R/W)
@@ -250,33 +298,7 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			  Bit 2-0 - Frequency's higher 3 bits (x) (Write Only)
 			Frequency = 131072/(2048-x) Hz
 		*/
-		if util.TestBit(val, 7) {
-			sound.Channel2.reSet()
-			sound.Channel2.envelopeIncrease = util.TestBit(sound.VRAMCache[0x07], 3)
-			sound.Channel2.envelopeInitial = (sound.VRAMCache[0x07] & 0xF0) >> 4
-			sound.Channel2.envelopeSweepNum = sound.VRAMCache[0x07] & 0x7
-			sound.Channel2.volume = float64(sound.Channel2.envelopeInitial) / float64(0xf)
-
-			sound.Channel2.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel2.freqHigh = uint16((val & 0x7)) << 8
-			sound.Channel2.Freq = 131072 / (2048 - int(sound.Channel2.freqHigh+sound.Channel2.freqLow))
-			sound.Channel2.tickUnit = 44100.0 / float64(sound.Channel2.Freq)
-
-			sound.Channel2.waveDuty = (sound.VRAMCache[0x06] >> 6) + 1
-			sound.Channel2.duration = (64.0 - float64(sound.VRAMCache[0x06]&0x3F)) * (1.0 / 256.0)
-
-			sound.Channel2.enable = true
-		}
-		//log.Println(sound.Channel2)
-	case 0xFF18:
-		/*
-			FF18 - NR23 - Channel 2 Frequency lo data (W)
-				Frequency's lower 8 bits of 11 bit data (x).
-				Next 3 bits are in NR24 ($FF19).
-		*/
-		sound.Channel2.freqLow = uint16(val)
-		sound.Channel2.Freq = 131072 / (2048 - int(sound.Channel2.freqHigh+sound.Channel2.freqLow))
-		sound.Channel2.tickUnit = 44100.0 / float64(sound.Channel2.Freq)
+		sound.Channel2.writeControl(val)
 
 	//Channel 3
 	case 0xFF1A:
@@ -284,11 +306,12 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			FF1A - NR30 - Channel 3 Sound on/off (R/W)
 			  Bit 7 - Sound Channel 3 Off  (0=Stop, 1=Playback)  (Read/Write)
 		*/
-		if util.TestBit(val, 7) {
-			sound.Channel3.enable = true
-		} else {
-			sound.Channel3.enable = false
+		sound.Channel3.DAC = util.TestBit(val, 7)
+		if !sound.Channel3.DAC {
+			sound.Channel3.Enabled = false
 		}
+	case 0xFF1B:
+		sound.Channel3.Length.Length = 256 - int(val)
 	case 0xFF1C:
 		/*
 			FF1C - NR32 - Channel 3 Select output level (R/W)
@@ -299,28 +322,32 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			  2:  50% Volume (Produce Wave Pattern RAM data shifted once to the right)
 			  3:  25% Volume (Produce Wave Pattern RAM data shifted twice to the right)
 		*/
-		switch (val & 0x60) >> 5 {
-		case 0x00:
-			sound.Channel3.volume = 0
-		case 0x01:
-			sound.Channel3.volume = 1
-		case 0x02:
-			sound.Channel3.volume = 0.5
-		case 0x03:
-			sound.Channel3.volume = 0.25
-		}
-
+		sound.Channel3.VolumeCode = (val >> 5) & 0x3
+	case 0xFF1D:
+		sound.Channel3.Frequency = sound.Channel3.Frequency&0x700 | uint16(val)
 	case 0xFF1E:
+		channel := &sound.Channel3
+		channel.Frequency = channel.Frequency&0xFF | uint16(val&0x7)<<8
+		channel.Length.Enabled = util.TestBit(val, 6)
 		if util.TestBit(val, 7) {
-			sound.Channel3.reSet()
-			sound.Channel3.Freq = 65536 / (2048 - int(uint16((val&0x7))<<8+uint16(sound.VRAMCache[0x0D])))
-			sound.Channel3.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel3.waveDuty = 1
-			sound.Channel3.duration = (256.0 - float64(int(sound.VRAMCache[0x0B]))) * (1.0 / 256.0)
-			sound.Channel3.enable = true
+			channel.Enabled = channel.DAC
+			if channel.Length.Length == 0 {
+				channel.Length.Length = 256
+			}
+			// The first sample is delayed by 6 clocks
+			channel.Timer = int(2048-channel.Frequency)*2 + 6
+			channel.Position = 0
 		}
 
 	// Channel 4
+	case 0xFF20:
+		sound.Channel4.Length.Length = 64 - int(val&0x3F)
+	case 0xFF21:
+		sound.Channel4.DAC = val&0xF8 != 0
+		sound.Channel4.Envelope.write(val)
+		if !sound.Channel4.DAC {
+			sound.Channel4.Enabled = false
+		}
 	case 0xFF22:
 		/*
 			FF22 - NR43 - Channel 4 Polynomial Counter (R/W)
@@ -333,154 +360,376 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 				  Bit 2-0 - Dividing Ratio of Frequencies (r)
 				Frequency = 524288 Hz / r / 2^(s+1) ;For r=0 assume r=0.5 instead
 		*/
-		shiftClockFrequency := float64((val & 0xF0) >> 4)
-		dividingRatio := float64(val & 0x7)
-		if dividingRatio == 0 {
-			dividingRatio = 0.5
-		}
-		sound.Channel4.Freq = int(524288 / dividingRatio / math.Pow(2, shiftClockFrequency+1))
+		sound.Channel4.ClockShift = val >> 4
+		sound.Channel4.WidthMode = util.TestBit(val, 3)
+		sound.Channel4.DivisorCode = val & 0x7
 	case 0xFF23:
+		channel := &sound.Channel4
+		channel.Length.Enabled = util.TestBit(val, 6)
 		if util.TestBit(val, 7) {
-			sound.Channel4.enable = false
-			sound.Channel4.envelopeTick = 0
-			sound.Channel4.lastEnvelope = 0
-			sound.Channel4.sampleTick = 0
-			sound.Channel4.lastEnvelope = 0
-
-			//Envelope options
-			sound.Channel4.envelopeIncrease = util.TestBit(sound.VRAMCache[0x11], 3)
-			sound.Channel4.envelopeInitial = (sound.VRAMCache[0x11] & 0xF0) >> 4
-			sound.Channel4.envelopeSweepNum = sound.VRAMCache[0x11] & 0x7
-			sound.Channel4.volume = float64(sound.Channel4.envelopeInitial) / float64(0xf)
-			sound.Channel4.waveDuty = 1
-
-			sound.Channel4.duration = 64.0 - float64(int(sound.VRAMCache[0x10]))*(1.0/256.0)
-			sound.Channel4.stopWhileTimeout = util.TestBit(val, 6)
-
-			sound.Channel4.enable = true
+			channel.Enabled = channel.DAC
+			if channel.Length.Length == 0 {
+				channel.Length.Length = 64
+			}
+			channel.Timer = noiseDivisors[channel.DivisorCode] << channel.ClockShift
+			channel.LFSR = 0x7FFF
+			channel.Envelope.trigger()
 		}
 
+	case 0xFF26:
+		/*
+			FF26 - NR52 - Sound on/off
+			  Bit 7 - All sound on/off  (0: stop all sound circuits) (Read/Write)
+		*/
+		enable := util.TestBit(val, 7)
+		if !enable && sound.Enable {
+			// Powering off clears all registers except the wave RAM
+			for i := 0; i < 0x20; i++ {
+				sound.Registers[i] = 0
+			}
+			sound.Channel1 = SquareChannel{}
+			sound.Channel2 = SquareChannel{}
+			sound.Channel3 = WaveChannel{}
+			sound.Channel4 = NoiseChannel{}
+		} else if enable && !sound.Enable {
+			sound.FrameSequencer = 0
+			sound.FrameSequencerTimer = frameSequencerClocks
+		}
+		sound.Enable = enable
 	}
 }
 
-func (channel *Channel) shouldPlay() bool {
+/*
+	NRx1 - Sound Length/Wave pattern duty (R/W)
+	  Bit 7-6 - Wave Pattern Duty (Read/Write)
+	  Bit 5-0 - Sound length data (Write Only) (t1: 0-63)
+*/
+func (channel *SquareChannel) writeLength(val byte) {
+	channel.Duty = val >> 6
+	channel.Length.Length = 64 - int(val&0x3F)
+}
 
-	// Is the master sound control enabled?
-	if !channel.parent.enable {
-		return false
+/*
+	NRx2 - Volume Envelope (R/W)
+*/
+func (channel *SquareChannel) writeEnvelope(val byte) {
+	channel.DAC = val&0xF8 != 0
+	channel.Envelope.write(val)
+	if !channel.DAC {
+		channel.Enabled = false
 	}
+}
 
-	if channel.Freq <= 0 {
+/*
+	NRx4 - Frequency hi data (R/W), return whether the channel was restarted.
+*/
+func (channel *SquareChannel) writeControl(val byte) bool {
+	channel.Frequency = channel.Frequency&0xFF | uint16(val&0x7)<<8
+	channel.Length.Enabled = util.TestBit(val, 6)
+	if !util.TestBit(val, 7) {
 		return false
 	}
+	channel.Enabled = channel.DAC
+	if channel.Length.Length == 0 {
+		channel.Length.Length = 64
+	}
+	channel.Timer = int(2048-channel.Frequency) * 4
+	channel.Envelope.trigger()
+	return true
+}
 
-	// Is this channel enabled?
-	if !channel.enable {
-		return false
+func (channel *SquareChannel) triggerSweep() {
+	sweep := &channel.Sweep
+	sweep.Shadow = channel.Frequency
+	sweep.Timer = sweep.period()
+	sweep.Enabled = sweep.Period != 0 || sweep.Shift != 0
+	sweep.NegateUsed = false
+	if sweep.Shift != 0 {
+		channel.calculateSweep()
 	}
+}
 
-	if channel.waveDuty == 0 {
-		return false
+func (sweep *Sweep) period() byte {
+	if sweep.Period == 0 {
+		return 8
 	}
+	return sweep.Period
+}
 
-	// Is this channel reach time limit?
-	if channel.stopWhileTimeout && channel.duration <= 0 {
-		return false
+/*
+	Calculate the next frequency of the sweep, the channel is disabled on overflow.
+*/
+func (channel *SquareChannel) calculateSweep() uint16 {
+	sweep := &channel.Sweep
+	delta := sweep.Shadow >> sweep.Shift
+	newFreq := sweep.Shadow + delta
+	if sweep.Negate {
+		newFreq = sweep.Shadow - delta
+		sweep.NegateUsed = true
 	}
-	return true
+	if newFreq > 2047 {
+		channel.Enabled = false
+	}
+	return newFreq
 }
 
-func (channel Channel) Stream(samples [][2]float64) (n int, ok bool) {
-	for i := range samples {
-
-		channel.self.sampleTick += float64(channel.self.Freq) / 44100.0
-		if channel.self.shouldPlay() {
-			tickInCycle := channel.self.sampleTick * 2 * 3.1415926
-			switch channel.wave {
-			case 0:
-				if math.Sin(tickInCycle) <= waveDutyMap[int(channel.self.waveDuty)] {
-					samples[i][0] = 1 * channel.self.volume
-					samples[i][1] = 1 * channel.self.volume
-				} else {
-					samples[i][0] = 0
-					samples[i][1] = 0
-				}
-			case 3:
-				sampleID := math.Floor(math.Mod(channel.self.sampleTick, 1.0) * 32)
-				samples[i][0] = channel.parent.SampleCache[int(sampleID)] * channel.self.volume
-				samples[i][1] = channel.parent.SampleCache[int(sampleID)] * channel.self.volume
-			case 2:
-				if channel.self.sampleTick-channel.self.lastGenerateTick > 1 || channel.self.sampleTick-channel.self.lastGenerateTick < -1 {
-					sample := rand.Float64()*2 - 1
-					samples[i][0] = sample * channel.self.volume
-					samples[i][1] = sample * channel.self.volume
-					channel.self.lastGenerate = sample
-					channel.self.lastGenerateTick = channel.self.sampleTick
-				} else {
-					samples[i][0] = channel.self.lastGenerate * channel.self.volume
-					samples[i][1] = channel.self.lastGenerate * channel.self.volume
-				}
-			}
+func (channel *SquareChannel) clockSweep() {
+	sweep := &channel.Sweep
+	if sweep.Timer > 0 {
+		sweep.Timer--
+	}
+	if sweep.Timer != 0 {
+		return
+	}
+	sweep.Timer = sweep.period()
+	if !sweep.Enabled || sweep.Period == 0 {
+		return
+	}
+	newFreq := channel.calculateSweep()
+	if newFreq <= 2047 && sweep.Shift != 0 {
+		sweep.Shadow = newFreq
+		channel.Frequency = newFreq
+		channel.calculateSweep()
+	}
+}
+
+func (channel *SquareChannel) step(cycles int) {
+	channel.Timer -= cycles
+	for channel.Timer <= 0 {
+		channel.Timer += int(2048-channel.Frequency) * 4
+		channel.DutyStep = (channel.DutyStep + 1) & 0x7
+	}
+}
+
+func (channel *SquareChannel) output() byte {
+	if !channel.Enabled {
+		return 0
+	}
+	return dutyPatterns[channel.Duty][channel.DutyStep] * channel.Envelope.Volume
+}
 
-			channel.self.duration -= secondPerTick
-		} else {
-			samples[i][0] = 0
-			samples[i][1] = 0
+func (channel *WaveChannel) step(cycles int, waveRAM []byte) {
+	channel.Timer -= cycles
+	for channel.Timer <= 0 {
+		channel.Timer += int(2048-channel.Frequency) * 2
+		channel.Position = (channel.Position + 1) & 0x1F
+		// Samples are stored upper nibble first
+		sample := waveRAM[channel.Position>>1]
+		if channel.Position&1 == 0 {
+			sample >>= 4
 		}
+		channel.SampleBuffer = sample & 0xF
+	}
+}
 
-		channel.self.Envelope()
-		channel.self.Sweep()
-	}
-	return len(samples), true
-}
-
-func (channel *Channel) Sweep() {
-	channel.sweepTick += 1 / 44100.0
-	if channel.sweepNumber > 0 {
-		if channel.sweepTick-channel.lastSweep >= sweepTime[channel.sweepTime] {
-			if channel.Freq > 0 {
-				newFreq := 0
-				if channel.sweepIncrease {
-					newFreq = channel.freqLast + channel.freqLast/2 ^ int(channel.sweepNumber)
-				} else {
-					newFreq = channel.freqLast - channel.freqLast/2 ^ int(channel.sweepNumber)
-				}
-				channel.freqLast = newFreq
-				channel.Freq = 131072 / (2048 - int(newFreq))
-				channel.lastSweep = channel.sweepTick
-			}
+func (channel *WaveChannel) output() byte {
+	if !channel.Enabled || channel.VolumeCode == 0 {
+		return 0
+	}
+	return channel.SampleBuffer >> (channel.VolumeCode - 1)
+}
+
+func (channel *NoiseChannel) step(cycles int) {
+	channel.Timer -= cycles
+	for channel.Timer <= 0 {
+		channel.Timer += noiseDivisors[channel.DivisorCode] << channel.ClockShift
+		xor := (channel.LFSR & 1) ^ ((channel.LFSR >> 1) & 1)
+		channel.LFSR = (channel.LFSR >> 1) | xor<<14
+		if channel.WidthMode {
+			channel.LFSR = channel.LFSR&^(1<<6) | xor<<6
 		}
 	}
 }
 
-func (channel *Channel) Envelope() {
-	channel.envelopeTick += 1 / 44100.0
-	if channel.envelopeSweepNum > 0 {
-		step := float64(channel.envelopeSweepNum) * (1.0 / 64)
-		if channel.envelopeTick-channel.lastEnvelope >= step {
-			if channel.envelopeInitial > 0 {
-				channel.envelopeInitial--
-				if channel.envelopeIncrease {
-					channel.volume = 1 - float64(channel.envelopeInitial)/float64(0xf)
-				} else {
-					channel.volume = float64(channel.envelopeInitial) / float64(0xf)
-				}
+func (channel *NoiseChannel) output() byte {
+	if !channel.Enabled || channel.LFSR&1 == 1 {
+		return 0
+	}
+	return channel.Envelope.Volume
+}
 
-				channel.lastEnvelope = channel.envelopeTick
+/*
+	Return whether the counter expired and the channel has to be disabled.
+*/
+func (length *LengthCounter) clock() bool {
+	if !length.Enabled || length.Length == 0 {
+		return false
+	}
+	length.Length--
+	return length.Length == 0
+}
+
+func (envelope *Envelope) write(val byte) {
+	envelope.Initial = val >> 4
+	envelope.Increase = util.TestBit(val, 3)
+	envelope.Period = val & 0x7
+}
+
+func (envelope *Envelope) trigger() {
+	envelope.Volume = envelope.Initial
+	envelope.Timer = envelope.Period
+	if envelope.Timer == 0 {
+		envelope.Timer = 8
+	}
+}
+
+func (envelope *Envelope) clock() {
+	if envelope.Period == 0 {
+		return
+	}
+	if envelope.Timer > 0 {
+		envelope.Timer--
+	}
+	if envelope.Timer != 0 {
+		return
+	}
+	envelope.Timer = envelope.Period
+	if envelope.Increase && envelope.Volume < 15 {
+		envelope.Volume++
+	} else if !envelope.Increase && envelope.Volume > 0 {
+		envelope.Volume--
+	}
+}
+
+/*
+	Advance the APU by the given number of clocks.
+*/
+func (sound *Sound) Update(cycles int) {
+	for cycles > 0 {
+		// Run until the next frame sequencer step or the end of the current sample
+		n := cycles
+		if sound.Enable && n > sound.FrameSequencerTimer {
+			n = sound.FrameSequencerTimer
+		}
+		if n > soundSampleClocks-sound.SampleClocks {
+			n = soundSampleClocks - sound.SampleClocks
+		}
+		cycles -= n
+
+		if sound.Enable {
+			sound.Channel1.step(n)
+			sound.Channel2.step(n)
+			sound.Channel3.step(n, sound.Registers[0x20:])
+			sound.Channel4.step(n)
+
+			sound.FrameSequencerTimer -= n
+			if sound.FrameSequencerTimer == 0 {
+				sound.FrameSequencerTimer = frameSequencerClocks
+				sound.stepFrameSequencer()
 			}
 		}
+
+		left, right := sound.mix()
+		sound.SampleLeft += left * float64(n)
+		sound.SampleRight += right * float64(n)
+		sound.SampleClocks += n
+		if sound.SampleClocks == soundSampleClocks {
+			sound.outputSample(sound.SampleLeft/soundSampleClocks, sound.SampleRight/soundSampleClocks)
+			sound.SampleLeft = 0
+			sound.SampleRight = 0
+			sound.SampleClocks = 0
+		}
 	}
 }
 
-func (channel *Channel) reSet() {
-	channel.enable = false
-	channel.Freq = 0
-	channel.envelopeTick = 0
-	channel.lastEnvelope = 0
-	channel.sampleTick = 0
-	channel.lastEnvelope = 0
+/*
+	Frame sequencer:
+	  Step   Length Ctr  Vol Env     Sweep
+	  0      Clock       -           -
+	  1      -           -           -
+	  2      Clock       -           Clock
+	  3      -           -           -
+	  4      Clock       -           -
+	  5      -           -           -
+	  6      Clock       -           Clock
+	  7      -           Clock       -
+*/
+func (sound *Sound) stepFrameSequencer() {
+	switch sound.FrameSequencer {
+	case 0, 4:
+		sound.clockLength()
+	case 2, 6:
+		sound.clockLength()
+		sound.Channel1.clockSweep()
+	case 7:
+		sound.Channel1.Envelope.clock()
+		sound.Channel2.Envelope.clock()
+		sound.Channel4.Envelope.clock()
+	}
+	sound.FrameSequencer = (sound.FrameSequencer + 1) & 0x7
 }
 
-func (channel Channel) Err() error {
-	return nil
+func (sound *Sound) clockLength() {
+	if sound.Channel1.Length.clock() {
+		sound.Channel1.Enabled = false
+	}
+	if sound.Channel2.Length.clock() {
+		sound.Channel2.Enabled = false
+	}
+	if sound.Channel3.Length.clock() {
+		sound.Channel3.Enabled = false
+	}
+	if sound.Channel4.Length.clock() {
+		sound.Channel4.Enabled = false
+	}
+}
+
+/*
+	Mix the channels into the left and right terminals.
+
+	FF24 - NR50 - Channel control / ON-OFF / Volume (R/W)
+	  Bit 6-4 - SO2 output level (volume)  (0-7)
+	  Bit 2-0 - SO1 output level (volume)  (0-7)
+	FF25 - NR51 - Selection of Sound output terminal (R/W)
+	  Bit 7-4 - Output sound 4-1 to SO2 terminal
+	  Bit 3-0 - Output sound 4-1 to SO1 terminal
+	SO2 is the left terminal and SO1 the right one.
+*/
+func (sound *Sound) mix() (left float64, right float64) {
+	if !sound.Enable {
+		return 0, 0
+	}
+	outputs := [4]float64{
+		dac(sound.Channel1.output(), sound.Channel1.DAC),
+		dac(sound.Channel2.output(), sound.Channel2.DAC),
+		dac(sound.Channel3.output(), sound.Channel3.DAC),
+		dac(sound.Channel4.output(), sound.Channel4.DAC),
+	}
+	panning := sound.Registers[0x15]
+	for i, output := range outputs {
+		if util.TestBit(panning, uint(i)) {
+			right += output
+		}
+		if util.TestBit(panning, uint(i+4)) {
+			left += output
+		}
+	}
+	volume := sound.Registers[0x14]
+	left *= float64((volume>>4)&0x7+1) / 8 / 4
+	right *= float64(volume&0x7+1) / 8 / 4
+	return left, right
+}
+
+/*
+	Convert a digital channel output 0-15 into -1.0-1.0, a DAC turned off outputs 0.
+*/
+func dac(digital byte, on bool) float64 {
+	if !on {
+		return 0
+	}
+	return float64(digital)/7.5 - 1
+}
+
+// Charge factor of the high-pass filter capacitor for one sample
+const capacitorCharge = 0.99732
+
+func (sound *Sound) outputSample(left float64, right float64) {
+	outLeft := left - sound.CapacitorLeft
+	sound.CapacitorLeft = left - outLeft*capacitorCharge
+	outRight := right - sound.CapacitorRight
+	sound.CapacitorRight = right - outRight*capacitorCharge
+
+	if len(sound.samples) < maxPendingSamples {
+		sound.samples = append(sound.samples, [2]float64{outLeft, outRight})
+	}
 }
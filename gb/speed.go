@@ -0,0 +1,167 @@
+package gb
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Speed running the emulator as fast as the host allows
+const SpeedUncapped = math.MaxFloat64
+
+// Speeds stepped through by Faster and Slower
+var speedSteps = []float64{0.25, 0.5, 1, 2, 4, maxSpeed, SpeedUncapped}
+
+/*
+Speed control of Run, shared with the drivers and other goroutines.
+*/
+type speedControl struct {
+	lock sync.Mutex
+	// Multiple of the normal speed, 0 until set, which means 1
+	speed  float64
+	paused bool
+	// Whether a frame is to be run while paused
+	advance bool
+}
+
+// Fastest speed run by counting frames, faster speeds are uncapped
+const maxSpeed = 8
+
+/*
+Set the speed of Run as a multiple of the normal speed: 2 runs twice as
+fast and 0.5 half as fast, SpeedUncapped as fast as possible. Speeds above
+8x are uncapped, speeds of 0 or less restore the normal speed. Only the
+last frame of each tick is drawn when running faster. Can be called from
+any goroutine.
+*/
+func (core *Core) SetSpeed(speed float64) {
+	if speed <= 0 || math.IsNaN(speed) {
+		speed = 1
+	}
+	if speed > maxSpeed {
+		speed = SpeedUncapped
+	}
+	core.speed.lock.Lock()
+	core.speed.speed = speed
+	core.speed.lock.Unlock()
+}
+
+/*
+Return the speed of Run, see SetSpeed.
+*/
+func (core *Core) Speed() float64 {
+	core.speed.lock.Lock()
+	defer core.speed.lock.Unlock()
+	if core.speed.speed == 0 {
+		return 1
+	}
+	return core.speed.speed
+}
+
+/*
+Switch to the next faster speed of 0.25x, 0.5x, 1x, 2x, 4x, 8x and
+uncapped, and return it.
+*/
+func (core *Core) Faster() float64 {
+	speed := core.Speed()
+	for _, step := range speedSteps {
+		if step > speed {
+			speed = step
+			break
+		}
+	}
+	core.SetSpeed(speed)
+	return speed
+}
+
+/*
+Switch to the next slower speed, see Faster, and return it.
+*/
+func (core *Core) Slower() float64 {
+	speed := core.Speed()
+	for i := len(speedSteps) - 1; i >= 0; i-- {
+		if speedSteps[i] < speed {
+			speed = speedSteps[i]
+			break
+		}
+	}
+	core.SetSpeed(speed)
+	return speed
+}
+
+/*
+Stop running the game in Run, controller input and hotkeys are still
+checked. Can be called from any goroutine.
+*/
+func (core *Core) Pause() {
+	core.speed.lock.Lock()
+	core.speed.paused = true
+	core.speed.lock.Unlock()
+}
+
+/*
+Run the game again after Pause.
+*/
+func (core *Core) Resume() {
+	core.speed.lock.Lock()
+	core.speed.paused = false
+	core.speed.advance = false
+	core.speed.lock.Unlock()
+}
+
+/*
+Return whether Run is paused.
+*/
+func (core *Core) Paused() bool {
+	core.speed.lock.Lock()
+	defer core.speed.lock.Unlock()
+	return core.speed.paused
+}
+
+/*
+Run a single frame on the next tick of Run while paused, until the next
+V-Blank starts. The emulator is paused if it was running.
+*/
+func (core *Core) AdvanceFrame() {
+	core.speed.lock.Lock()
+	if core.speed.paused {
+		core.speed.advance = true
+	}
+	core.speed.paused = true
+	core.speed.lock.Unlock()
+}
+
+/*
+Read the speed control for a tick of Run, a requested frame advance is
+consumed.
+*/
+func (core *Core) speedState() (speed float64, paused bool, advance bool) {
+	core.speed.lock.Lock()
+	defer core.speed.lock.Unlock()
+	speed = core.speed.speed
+	if speed == 0 {
+		speed = 1
+	}
+	advance = core.speed.advance
+	core.speed.advance = false
+	return speed, core.speed.paused, advance
+}
+
+/*
+Format a speed for display, such as 0.5x or uncapped.
+*/
+func FormatSpeed(speed float64) string {
+	if speed == SpeedUncapped {
+		return "uncapped"
+	}
+	return strconv.FormatFloat(speed, 'f', -1, 64) + "x"
+}
+
+func (core *Core) logSpeed() {
+	if core.Paused() {
+		log.Println("[Core] Paused")
+	} else {
+		log.Println("[Core] Speed", FormatSpeed(core.Speed()))
+	}
+}
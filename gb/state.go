@@ -0,0 +1,245 @@
+package gb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+/*
+Save state file layout:
+
+	0000-0003   Magic "GBLS"
+	0004-0005   Format version (little endian)
+	0006-0009   CRC32 checksum of the ROM the state was taken from
+	000A-       gob encoded stateData
+*/
+const stateMagic = "GBLS"
+
+// Version of the save state format, bump it whenever stateData changes incompatibly.
+const StateVersion uint16 = 8
+
+var (
+	ErrStateFormat   = errors.New("not a save state file")
+	ErrStateVersion  = errors.New("save state format version mismatch")
+	ErrStateChecksum = errors.New("save state was taken from another ROM")
+)
+
+type stateHeader struct {
+	Magic    [4]byte
+	Version  uint16
+	Checksum uint32
+}
+
+/*
+Everything needed to resume emulation mid-frame.
+*/
+type stateData struct {
+	CPU          CPU
+	Memory       [0x10000]byte
+	Timer        Timer
+	JoypadStatus byte
+	SerialByte   byte
+
+	Screen [160][144][3]uint8
+	PPU    PPU
+
+	// Game Boy Color hardware
+	CGBMode            bool
+	CGBHardware        bool
+	BootROMMapped      bool
+	VRAM               [2][0x2000]byte
+	VRAMBank           byte
+	WRAM               [8][0x1000]byte
+	WRAMBank           byte
+	BGPalette          ColourPalette
+	OBJPalette         ColourPalette
+	HDMA               HDMA
+	SpeedMultiple      int
+	PrepareSpeedSwitch bool
+
+	Sound Sound
+	// Exported fields of the MBC in use: bank registers, RAM and RTC
+	MBC []byte
+}
+
+/*
+Write a snapshot of the emulator into w.
+*/
+func (core *Core) SaveState(w io.Writer) error {
+	header := stateHeader{
+		Version:  StateVersion,
+		Checksum: core.Cartridge.Props.Checksum,
+	}
+	copy(header.Magic[:], stateMagic)
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	data, err := core.snapshot()
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(data)
+}
+
+/*
+Gather the state of the emulator.
+*/
+func (core *Core) snapshot() (*stateData, error) {
+	var mbcData bytes.Buffer
+	if err := gob.NewEncoder(&mbcData).Encode(core.Cartridge.MBC); err != nil {
+		return nil, err
+	}
+
+	return &stateData{
+		CPU:          core.CPU,
+		Memory:       core.Memory.MainMemory,
+		Timer:        core.Timer,
+		JoypadStatus: core.JoypadStatus,
+		SerialByte:   core.SerialByte,
+		Screen:       core.Screen,
+		PPU:          core.PPU,
+
+		CGBMode:            core.CGBMode,
+		CGBHardware:        core.CGBHardware,
+		BootROMMapped:      core.BootROMMapped,
+		VRAM:               core.Memory.VRAM,
+		VRAMBank:           core.Memory.VRAMBank,
+		WRAM:               core.Memory.WRAM,
+		WRAMBank:           core.Memory.WRAMBank,
+		BGPalette:          core.BGPalette,
+		OBJPalette:         core.OBJPalette,
+		HDMA:               core.HDMA,
+		SpeedMultiple:      core.SpeedMultiple,
+		PrepareSpeedSwitch: core.prepareSpeedSwitch,
+
+		Sound: core.Sound,
+		MBC:   mbcData.Bytes(),
+	}, nil
+}
+
+/*
+Restore a snapshot written by SaveState. States taken from another ROM
+or with a different format version are rejected and leave the emulator untouched.
+*/
+func (core *Core) LoadState(r io.Reader) error {
+	var header stateHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return ErrStateFormat
+	}
+	if string(header.Magic[:]) != stateMagic {
+		return ErrStateFormat
+	}
+	if header.Version != StateVersion {
+		return ErrStateVersion
+	}
+	if header.Checksum != core.Cartridge.Props.Checksum {
+		return ErrStateChecksum
+	}
+
+	var data stateData
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	return core.restore(&data)
+}
+
+/*
+Put the emulator back into a state gathered by snapshot.
+*/
+func (core *Core) restore(data *stateData) error {
+	/*
+		gob does not transmit zero values, so the MBC is decoded into a
+		fresh value and only its exported fields are copied over. The
+		unexported ROM data stays in place.
+	*/
+	mbc := reflect.ValueOf(core.Cartridge.MBC).Elem()
+	fresh := reflect.New(mbc.Type())
+	if err := gob.NewDecoder(bytes.NewReader(data.MBC)).Decode(fresh.Interface()); err != nil {
+		return err
+	}
+	for i := 0; i < mbc.NumField(); i++ {
+		if mbc.Type().Field(i).PkgPath == "" {
+			mbc.Field(i).Set(fresh.Elem().Field(i))
+		}
+	}
+
+	core.CPU = data.CPU
+	core.Memory.MainMemory = data.Memory
+	core.Timer = data.Timer
+	core.JoypadStatus = data.JoypadStatus
+	core.SerialByte = data.SerialByte
+	core.Screen = data.Screen
+	core.PPU = data.PPU
+	core.CGBMode = data.CGBMode
+	core.CGBHardware = data.CGBHardware
+	core.BootROMMapped = data.BootROMMapped && core.bootROM != nil
+	core.Memory.VRAM = data.VRAM
+	core.Memory.VRAMBank = data.VRAMBank
+	core.Memory.WRAM = data.WRAM
+	core.Memory.WRAMBank = data.WRAMBank
+	core.BGPalette = data.BGPalette
+	core.OBJPalette = data.OBJPalette
+	core.HDMA = data.HDMA
+	core.SpeedMultiple = data.SpeedMultiple
+	core.prepareSpeedSwitch = data.PrepareSpeedSwitch
+	core.Sound.restore(data.Sound)
+	// Cartridge RAM comes from the snapshot now, flush it to the battery save
+	core.Memory.dirty = true
+	return nil
+}
+
+/*
+Path of the save state file of the given slot, placed next to the battery save.
+*/
+func (core *Core) StatePath(slot int) string {
+	return fmt.Sprintf("%s.ss%d", strings.TrimSuffix(core.RamPath, ".sav"), slot)
+}
+
+/*
+Save a snapshot into a numbered slot.
+*/
+func (core *Core) SaveStateSlot(slot int) error {
+	file, err := os.Create(core.StatePath(slot))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := core.SaveState(file); err != nil {
+		return err
+	}
+	log.Printf("[Core] State saved to slot %d\n", slot)
+	return nil
+}
+
+/*
+Restore the snapshot stored in a numbered slot.
+*/
+func (core *Core) LoadStateSlot(slot int) error {
+	file, err := os.Open(core.StatePath(slot))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := core.LoadState(file); err != nil {
+		return err
+	}
+	log.Printf("[Core] State loaded from slot %d\n", slot)
+	return nil
+}
+
+/*
+Restore the APU, samples of the discarded timeline are dropped.
+*/
+func (sound *Sound) restore(state Sound) {
+	samples := sound.samples[:0]
+	*sound = state
+	sound.samples = samples
+}
@@ -0,0 +1,112 @@
+package gb
+
+import (
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+Timer and divider registers.
+
+	FF04 - DIV - Divider Register (R/W)
+	FF05 - TIMA - Timer counter (R/W)
+	FF06 - TMA - Timer Modulo (R/W)
+	FF07 - TAC - Timer Control (R/W)
+
+Both DIV and TIMA are driven by a single 16bit system counter incremented
+every clock. DIV is its upper byte, TIMA is incremented on the falling edge
+of the counter bit selected in TAC, ANDed with the timer enable bit.
+*/
+type Timer struct {
+	SystemCounter uint16
+	// Clocks left before TIMA is reloaded from TMA after an overflow, 0 if none is pending
+	ReloadDelay int
+}
+
+// Value of the system counter when the boot ROM hands over to the cartridge
+const bootSystemCounter = 0xABCC
+
+/*
+Bit of the system counter selected by TAC:
+
+	Bits 1-0 - Input Clock Select
+	           00:   4096 Hz (bit 9)
+	           01: 262144 Hz (bit 3)
+	           10:  65536 Hz (bit 5)
+	           11:  16384 Hz (bit 7)
+*/
+var timerCounterBits = [4]uint{9, 3, 5, 7}
+
+func (core *Core) initTimer() {
+	core.Timer = Timer{SystemCounter: bootSystemCounter}
+}
+
+/*
+Whether the timer input, the selected counter bit ANDed with TAC bit 2, is high.
+*/
+func (core *Core) timerSignal(tac byte) bool {
+	return util.TestBit(tac, 2) && core.Timer.SystemCounter&(1<<timerCounterBits[tac&0x3]) != 0
+}
+
+/*
+Advance the timers by the given number of clocks.
+*/
+func (core *Core) UpdateTimers(cycles int) {
+	tac := core.Memory.MainMemory[0xFF07]
+	for ; cycles > 0; cycles-- {
+		if core.Timer.ReloadDelay > 0 {
+			core.Timer.ReloadDelay--
+			if core.Timer.ReloadDelay == 0 {
+				core.Memory.MainMemory[0xFF05] = core.Memory.MainMemory[0xFF06]
+				core.RequestInterrupt(2)
+			}
+		}
+
+		before := core.timerSignal(tac)
+		core.Timer.SystemCounter++
+		if before && !core.timerSignal(tac) {
+			core.incrementTIMA()
+		}
+	}
+}
+
+/*
+Increment TIMA. On overflow it reads 00 for 4 clocks before being
+reloaded with TMA and requesting the timer interrupt.
+*/
+func (core *Core) incrementTIMA() {
+	core.Memory.MainMemory[0xFF05]++
+	if core.Memory.MainMemory[0xFF05] == 0 {
+		core.Timer.ReloadDelay = 4
+	}
+}
+
+/*
+Writing any value to DIV resets the system counter, which may
+cause a falling edge on the timer input.
+*/
+func (core *Core) writeDIV() {
+	before := core.timerSignal(core.Memory.MainMemory[0xFF07])
+	core.Timer.SystemCounter = 0
+	if before {
+		core.incrementTIMA()
+	}
+}
+
+/*
+Writing TIMA during the reload delay cancels the reload.
+*/
+func (core *Core) writeTIMA(data byte) {
+	core.Timer.ReloadDelay = 0
+	core.Memory.MainMemory[0xFF05] = data
+}
+
+/*
+Changing TAC may also cause a falling edge on the timer input.
+*/
+func (core *Core) writeTAC(data byte) {
+	before := core.timerSignal(core.Memory.MainMemory[0xFF07])
+	core.Memory.MainMemory[0xFF07] = 0xF8 | data&0x7
+	if before && !core.timerSignal(data) {
+		core.incrementTIMA()
+	}
+}
@@ -0,0 +1,166 @@
+package gb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Tracer logs every instruction executed in the format of Gameboy Doctor,
+the registers before the instruction and the 4 bytes at PC:
+
+	A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02
+
+Logs from another emulator, or the reference logs of Gameboy Doctor, can
+then be compared with ours line by line. Those are taken with LY always
+reading 90h, set StubLY to do the same.
+*/
+type Tracer struct {
+	// Only instructions at an address between StartPC and EndPC, both
+	// included, are logged. All of them are if both are zero.
+	StartPC uint16
+	EndPC   uint16
+	// Only instructions of the frames between StartFrame and EndFrame,
+	// both included, are logged. Frames are counted at each V-Blank from
+	// 0 when the tracer is set, there is no end if EndFrame is NoEndFrame.
+	StartFrame int
+	EndFrame   int
+	// LY reads return 90h, as in Gameboy Doctor logs
+	StubLY bool
+
+	out   *bufio.Writer
+	frame int
+	line  []byte
+	// First write error, the tracer stops at it
+	err error
+	// Flush may be called while the emulation goroutine traces
+	lock sync.Mutex
+}
+
+// EndFrame of a tracer logging until the emulation stops
+const NoEndFrame = -1
+
+/*
+Create a tracer writing to out, Flush must be called once done.
+*/
+func NewTracer(out io.Writer) *Tracer {
+	return &Tracer{out: bufio.NewWriter(out), EndFrame: NoEndFrame}
+}
+
+/*
+Start logging the instructions with the tracer, nil stops it.
+*/
+func (core *Core) SetTracer(tracer *Tracer) {
+	core.tracer = tracer
+}
+
+/*
+Write the lines still buffered, return the first error met. It may be
+called while the emulator is running.
+*/
+func (tracer *Tracer) Flush() error {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	if tracer.err != nil {
+		return tracer.err
+	}
+	return tracer.out.Flush()
+}
+
+/*
+Parse START-END, hexadecimal, into a PC range.
+*/
+func ParsePCRange(text string) (uint16, uint16, error) {
+	return parseRange(text)
+}
+
+/*
+Parse START-END, decimal, into a frame range. END may be omitted, it is
+NoEndFrame then.
+*/
+func ParseFrameRange(text string) (int, int, error) {
+	parts := strings.SplitN(text, "-", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid frame range: %s", text)
+	}
+	end := NoEndFrame
+	if len(parts) == 2 && parts[1] != "" {
+		if end, err = strconv.Atoi(parts[1]); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid frame range: %s", text)
+		}
+	}
+	return start, end, nil
+}
+
+/*
+Called at V-Blank.
+*/
+func (tracer *Tracer) nextFrame() {
+	tracer.frame++
+}
+
+/*
+Log the instruction about to be executed.
+*/
+func (tracer *Tracer) trace(core *Core) {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	if tracer.err != nil || tracer.frame < tracer.StartFrame || tracer.EndFrame != NoEndFrame && tracer.frame > tracer.EndFrame {
+		return
+	}
+	registers := &core.CPU.Registers
+	pc := registers.PC
+	if (tracer.StartPC != 0 || tracer.EndPC != 0) && (pc < tracer.StartPC || pc > tracer.EndPC) {
+		return
+	}
+
+	// Formatted by hand, fmt is too slow for millions of lines
+	line := tracer.line[:0]
+	for _, register := range []struct {
+		name  string
+		value byte
+	}{
+		{"A:", registers.A}, {" F:", traceFlags(&core.CPU)}, {" B:", registers.B}, {" C:", registers.C},
+		{" D:", registers.D}, {" E:", registers.E}, {" H:", byte(registers.HL >> 8)}, {" L:", byte(registers.HL)},
+	} {
+		line = append(line, register.name...)
+		line = appendHex(line, register.value)
+	}
+	line = append(line, " SP:"...)
+	line = appendHex(appendHex(line, byte(registers.SP>>8)), byte(registers.SP))
+	line = append(line, " PC:"...)
+	line = appendHex(appendHex(line, byte(pc>>8)), byte(pc))
+	line = append(line, " PCMEM:"...)
+	for i := uint16(0); i < 4; i++ {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = appendHex(line, core.readMemory(pc+i))
+	}
+	line = append(line, '\n')
+	tracer.line = line
+	_, tracer.err = tracer.out.Write(line)
+}
+
+/*
+F as the flags are, Registers.F is only updated by some instructions.
+*/
+func traceFlags(cpu *CPU) byte {
+	f := byte(0)
+	for i, flag := range []bool{cpu.Flags.Zero, cpu.Flags.Sub, cpu.Flags.HalfCarry, cpu.Flags.Carry} {
+		if flag {
+			f |= 0x80 >> uint(i)
+		}
+	}
+	return f
+}
+
+func appendHex(line []byte, value byte) []byte {
+	const digits = "0123456789ABCDEF"
+	return append(line, digits[value>>4], digits[value&0xF])
+}
@@ -0,0 +1,127 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseFrameRange(t *testing.T) {
+	for _, c := range []struct {
+		text       string
+		start, end int
+	}{
+		{"0", 0, NoEndFrame},
+		{"0-0", 0, 0},
+		{"10-20", 10, 20},
+		{"10-", 10, NoEndFrame},
+		{"5-5", 5, 5},
+	} {
+		start, end, err := ParseFrameRange(c.text)
+		if err != nil || start != c.start || end != c.end {
+			t.Errorf("ParseFrameRange(%q) = %d, %d, %v, want %d, %d", c.text, start, end, err, c.start, c.end)
+		}
+	}
+	for _, text := range []string{"", "-5", "a-b", "20-10", "1-x"} {
+		if _, _, err := ParseFrameRange(text); err == nil {
+			t.Errorf("ParseFrameRange(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestParsePCRange(t *testing.T) {
+	start, end, err := ParsePCRange("4000-7FFF")
+	if err != nil || start != 0x4000 || end != 0x7FFF {
+		t.Errorf("ParsePCRange(\"4000-7FFF\") = %04X, %04X, %v, want 4000, 7FFF", start, end, err)
+	}
+	if _, _, err := ParsePCRange("zz"); err == nil {
+		t.Error("ParsePCRange(\"zz\") succeeded, want an error")
+	}
+}
+
+// Set up a core at the state of the first line of the Gameboy Doctor logs
+func newTraceCore() *Core {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], []byte{0x00, 0xC3, 0x37, 0x06})
+	core := &Core{}
+	core.Cartridge.MBC = &MBCRom{rom: rom, CurrentROMBank: 1}
+	core.CPU.Registers = Registers{A: 0x01, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, HL: 0x014D, SP: 0xFFFE, PC: 0x0100}
+	core.CPU.Flags.Zero = true
+	core.CPU.Flags.HalfCarry = true
+	core.CPU.Flags.Carry = true
+	return core
+}
+
+func TestTrace(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	core := newTraceCore()
+	tracer.trace(core)
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,37,06\n"
+	if out.String() != want {
+		t.Errorf("trace = %q, want %q", out.String(), want)
+	}
+}
+
+func TestTraceFrames(t *testing.T) {
+	core := newTraceCore()
+	for _, c := range []struct {
+		start, end int
+		want       int
+	}{
+		// Frames 0 to 3 are traced, one line each
+		{0, NoEndFrame, 4},
+		{0, 0, 1},
+		{1, 2, 2},
+		{3, NoEndFrame, 1},
+	} {
+		var out bytes.Buffer
+		tracer := NewTracer(&out)
+		tracer.StartFrame, tracer.EndFrame = c.start, c.end
+		for frame := 0; frame < 4; frame++ {
+			tracer.trace(core)
+			tracer.nextFrame()
+		}
+		tracer.Flush()
+		if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != c.want {
+			t.Errorf("frames %d to %d: %d lines traced, want %d", c.start, c.end, lines, c.want)
+		}
+	}
+}
+
+func TestTracePC(t *testing.T) {
+	core := newTraceCore()
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	tracer.StartPC, tracer.EndPC = 0x4000, 0x7FFF
+	tracer.trace(core)
+	tracer.Flush()
+	if out.Len() != 0 {
+		t.Errorf("PC outside of the range traced: %q", out.String())
+	}
+}
+
+func TestTraceFlushWhileRunning(t *testing.T) {
+	core := newTraceCore()
+	var out bytes.Buffer
+	tracer := NewTracer(&out)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			tracer.trace(core)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := tracer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	tracer.Flush()
+	if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != 1000 {
+		t.Errorf("%d lines traced, want 1000", lines)
+	}
+}
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/HFO4/gbc-in-cloud/conformance"
 	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/HFO4/gbc-in-cloud/fyne"
 	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/remote"
 	"github.com/HFO4/gbc-in-cloud/static"
 	"github.com/HFO4/gbc-in-cloud/stream"
+	"image/png"
+	"io/ioutil"
 	"log"
 	"os"
 )
@@ -20,13 +25,31 @@ var (
 	FyneMode         bool
 	StreamServerMode bool
 	StaticServerMode bool
+	HeadlessMode     bool
 
 	ConfigPath string
 	ListenPort int
 	ROMPath    string
+	BootPath   string
+	CameraPath string
+	PatchPath  string
 	SoundOn    bool
 	FPS        int
 	Debug      bool
+	DebugPort  int
+
+	RewindLength   int
+	RewindInterval int
+
+	Frames     int
+	InputPath  string
+	OutputPath string
+	WAVPath    string
+
+	TracePath   string
+	TracePC     string
+	TraceFrames string
+	TraceLY     bool
 )
 
 func init() {
@@ -35,12 +58,27 @@ func init() {
 	flag.BoolVar(&FyneMode, "G", false, "Play specific game in Fyne GUI mode")
 	flag.BoolVar(&StreamServerMode, "s", false, "Start a cloud-gaming server")
 	flag.BoolVar(&StaticServerMode, "S", false, "Start a static image cloud-gaming server")
+	flag.BoolVar(&HeadlessMode, "headless", false, "Run specific game without display and save the last frame")
 	flag.BoolVar(&SoundOn, "m", true, "Turn on sound in GUI mode")
 	flag.BoolVar(&Debug, "d", false, "Use Debugger in GUI mode")
+	flag.IntVar(&DebugPort, "debug-port", 0, "Serve the remote debug protocol on `port` in GUI and server modes")
+	flag.IntVar(&RewindLength, "rewind", 300, "Keep `n` states for rewinding, 0 turns rewind off, server modes only rewind when it is set")
+	flag.IntVar(&RewindInterval, "rewind-interval", 10, "Keep a state for rewinding every `n` frames")
 	flag.IntVar(&ListenPort, "p", 1989, "Set the `port` for the cloud-gaming server")
 	flag.IntVar(&FPS, "f", 60, "Set the `FPS` in GUI mode")
 	flag.StringVar(&ConfigPath, "c", "", "Set the game option list `config` file path")
 	flag.StringVar(&ROMPath, "r", "", "Set `ROM` file path to be played in GUI mode")
+	flag.StringVar(&BootPath, "boot", "", "Run the DMG or CGB boot ROM `file` before the game in GUI and headless mode")
+	flag.StringVar(&CameraPath, "camera", "", "Show a PNG `file`, or a directory of PNG files, to the Pocket Camera in GUI and headless mode")
+	flag.StringVar(&PatchPath, "patch", "", "Apply an IPS, UPS or BPS patch `file` to the ROM, a patch named after the ROM is used by default")
+	flag.IntVar(&Frames, "frames", 600, "Set the number of `frames` to run in headless mode")
+	flag.StringVar(&InputPath, "input", "", "Set the input `script` file path for headless mode")
+	flag.StringVar(&OutputPath, "o", "screen.png", "Set the PNG `file` path of the last frame in headless mode")
+	flag.StringVar(&WAVPath, "wav", "", "Record the game audio into a WAV `file` instead of playing it")
+	flag.StringVar(&TracePath, "trace", "", "Log every instruction into a `file` in Gameboy Doctor format in GUI and headless mode")
+	flag.StringVar(&TracePC, "trace-pc", "", "Only log instructions at addresses in `START-END`, hexadecimal")
+	flag.StringVar(&TraceFrames, "trace-frames", "", "Only log instructions of frames in `START-END`, END may be omitted")
+	flag.BoolVar(&TraceLY, "trace-ly", false, "Make LY always read 90h while tracing, as in Gameboy Doctor logs")
 }
 
 func startGUI(screen driver.DisplayDriver, control driver.ControllerDriver) {
@@ -52,23 +90,168 @@ func startGUI(screen driver.DisplayDriver, control driver.ControllerDriver) {
 	core.Controller = control
 	core.DrawSignal = make(chan bool)
 	core.SpeedMultiple = 0
-	core.ToggleSound = SoundOn
-	core.Init(ROMPath)
+	core.AudioDriver = audioDriver(SoundOn)
+	core.BootROMPath = BootPath
+	core.Camera = cameraSource()
+	core.PatchPath = PatchPath
+	core.RewindLength = RewindLength
+	core.RewindInterval = RewindInterval
+	closeTrace := startTracer(core)
+	core.OnError = func(err error) {
+		core.SaveRAM()
+		core.AudioDriver.Close()
+		closeTrace()
+		log.Fatal("[Error] ", err)
+	}
+	if err := core.Init(ROMPath); err != nil {
+		log.Fatal("[Error] Failed to load ROM, ", err)
+	}
+	if DebugPort != 0 {
+		core.AttachDebugger()
+		go serveDebugger(core)
+	}
 
 	go core.Run()
 	screen.Run(core.DrawSignal, func() {
-		core.SaveRAM()
+		core.Close()
+		if err := core.AudioDriver.Close(); err != nil {
+			log.Println("[Error] Failed to close audio output,", err)
+		}
+		closeTrace()
 	})
 }
 
+func startTracer(core *gb.Core) func() {
+	if TracePath == "" {
+		return func() {}
+	}
+	file, err := os.Create(TracePath)
+	if err != nil {
+		log.Fatal("[Error] Failed to create trace file, ", err)
+	}
+	tracer := gb.NewTracer(file)
+	tracer.StubLY = TraceLY
+	if TracePC != "" {
+		if tracer.StartPC, tracer.EndPC, err = gb.ParsePCRange(TracePC); err != nil {
+			log.Fatal("[Error] ", err)
+		}
+	}
+	if TraceFrames != "" {
+		if tracer.StartFrame, tracer.EndFrame, err = gb.ParseFrameRange(TraceFrames); err != nil {
+			log.Fatal("[Error] ", err)
+		}
+	}
+	core.SetTracer(tracer)
+	return func() {
+		if err := tracer.Flush(); err != nil {
+			log.Println("[Error] Failed to write trace,", err)
+		}
+		file.Close()
+	}
+}
+
+func serveDebugger(core *gb.Core) {
+	server := &remote.Server{
+		Targets: func() map[string]*gb.Core {
+			return map[string]*gb.Core{"main": core}
+		},
+	}
+	if err := server.ListenAndServe(DebugPort); err != nil {
+		log.Fatal("[Error] Failed to start the debug server, ", err)
+	}
+}
+
+func audioDriver(speaker bool) driver.AudioDriver {
+	if WAVPath != "" {
+		return &driver.WAVWriter{Path: WAVPath}
+	}
+	if speaker {
+		return new(driver.Speaker)
+	}
+	return new(driver.NullAudio)
+}
+
+func cameraSource() driver.ImageSource {
+	if CameraPath == "" {
+		return nil
+	}
+	source, err := driver.NewImageSource(CameraPath)
+	if err != nil {
+		log.Fatal("[Error] Failed to open camera images, ", err)
+	}
+	return source
+}
+
+func runHeadless() {
+	screen := new(driver.Headless)
+	if InputPath != "" {
+		script, err := driver.LoadInputScript(InputPath)
+		if err != nil {
+			log.Fatal("[Error] Failed to read input script, ", err)
+		}
+		screen.Script = script
+	}
+
+	core := new(gb.Core)
+	core.FPS = FPS
+	core.Clock = 4194304
+	core.DisplayDriver = screen
+	core.Controller = screen
+	core.DrawSignal = make(chan bool)
+	core.AudioDriver = audioDriver(false)
+	core.BootROMPath = BootPath
+	core.Camera = cameraSource()
+	core.PatchPath = PatchPath
+	closeTrace := startTracer(core)
+	if err := core.Init(ROMPath); err != nil {
+		log.Fatal("[Error] Failed to load ROM, ", err)
+	}
+
+	err := core.RunFrames(Frames)
+	closeTrace()
+	if err != nil {
+		log.Fatal("[Error] ", err)
+	}
+	core.Close()
+	if err := core.AudioDriver.Close(); err != nil {
+		log.Fatal("[Error] Failed to close audio output, ", err)
+	}
+
+	output, err := os.Create(OutputPath)
+	if err != nil {
+		log.Fatal("[Error] Failed to create output file, ", err)
+	}
+	defer output.Close()
+	if err := png.Encode(output, screen.Image()); err != nil {
+		log.Fatal("[Error] Failed to write output file, ", err)
+	}
+	log.Printf("[Headless] %d frames emulated, last frame saved to %s\n", Frames, OutputPath)
+}
+
 func runStaticServer() {
 	server := static.StaticServer{
-		Port:     ListenPort,
-		GamePath: ROMPath,
+		Port:      ListenPort,
+		GamePath:  ROMPath,
+		PatchPath: PatchPath,
+		DebugPort: DebugPort,
+
+		RewindLength:   serverRewindLength(),
+		RewindInterval: RewindInterval,
 	}
 	server.Run()
 }
 
+func serverRewindLength() int {
+	// Every session of a server would keep states, only when asked for
+	length := 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "rewind" {
+			length = RewindLength
+		}
+	})
+	return length
+}
+
 func runServer() {
 	if ConfigPath == "" {
 		log.Fatal("[Error] Game list not specified")
@@ -91,6 +274,9 @@ func runServer() {
 
 	streamServer := new(stream.StreamServer)
 	streamServer.Port = ListenPort
+	streamServer.DebugPort = DebugPort
+	streamServer.RewindLength = serverRewindLength()
+	streamServer.RewindInterval = RewindInterval
 	var gameList []stream.GameInfo
 	err = json.Unmarshal(gameListStr, &gameList)
 	if err != nil {
@@ -100,7 +286,89 @@ func runServer() {
 	streamServer.Run()
 }
 
+func runDisasm(args []string) {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	output := flags.String("o", "", "Write the assembly to `file` instead of the standard output")
+	patch := flags.String("patch", "", "Apply an IPS, UPS or BPS patch `file` to the ROM, a patch named after the ROM is used by default")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gbdotlive disasm [-o file] [-patch file] ROM")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := gb.LoadROM(flags.Arg(0), *patch)
+	if err != nil {
+		log.Fatal("[Error] Failed to read ROM, ", err)
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal("[Error] Failed to create output file, ", err)
+		}
+		defer out.Close()
+	}
+	if err := gb.DisassembleROM(data, out); err != nil {
+		log.Fatal("[Error] Failed to disassemble ROM, ", err)
+	}
+}
+
+func runConformance(args []string) {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	frames := flags.Int("frames", 0, "Fail the tests which report no result after `n` frames, 0 for a default by kind of test")
+	verbose := flags.Bool("v", false, "Show the emulator logs and the serial output of the failed tests")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gbdotlive conformance [-frames n] [-v] DIR")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tests, err := conformance.Discover(flags.Arg(0))
+	if err != nil {
+		log.Fatal("[Error] Failed to find test ROMs, ", err)
+	}
+	if len(tests) == 0 {
+		log.Fatal("[Error] No test ROMs in ", flags.Arg(0))
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	var results []conformance.Result
+	failed := false
+	for _, test := range tests {
+		result := test.Run(*frames)
+		results = append(results, result)
+		if !result.Passed {
+			failed = true
+			if *verbose && result.Output != "" {
+				fmt.Printf("%s:\n%s\n", test.Name, result.Output)
+			}
+		}
+	}
+	conformance.WriteSummary(os.Stdout, results)
+	if failed {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	// Subcommands come before the flags
+	if len(os.Args) > 1 && os.Args[1] == "disasm" {
+		runDisasm(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		runConformance(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	if h {
 		flag.Usage()
@@ -117,6 +385,11 @@ func main() {
 		return
 	}
 
+	if HeadlessMode {
+		runHeadless()
+		return
+	}
+
 	if FyneMode {
 		driver := new(fyne.LCD)
 		startGUI(driver, driver)
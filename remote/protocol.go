@@ -0,0 +1,381 @@
+package remote
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/HFO4/gbc-in-cloud/gb"
+)
+
+/*
+Request sent by a client, the fields used depend on the command:
+
+	targets                       List the emulators
+	attach    target              Attach to an emulator
+	detach                        Detach, the emulation resumes
+	state                         Whether the emulation is stopped, and the registers
+	pause                         Stop the emulation before the next instruction
+	continue                      Resume the emulation
+	step      [count]             Execute one or count instructions
+	next                          Execute one instruction, running calls until they return
+	finish                        Run until the current function returns
+	break     address             Stop before executing the instruction at address
+	delete    [address]           Remove the breakpoint at address, or all breakpoints
+	breakpoints                   List the breakpoints
+	registers                     Read the registers
+	set       register, value     Set A, B, C, D, E, F, H, L, AF, BC, DE, HL, SP or PC
+	read      [region, bank,] address, [count]
+	                              Read count bytes (default 1), data is hexadecimal
+	write     [region, bank,] address, data
+	                              Write bytes
+	command   line                Run a command of the terminal debugger, but
+	                              dump and quit
+
+Without region, memory is accessed as the CPU sees it. Otherwise region is
+one of "rom", "sram", "vram" or "wram" and bank tells which bank is
+accessed, whether it is mapped or not.
+*/
+type Request struct {
+	// Copied to the response
+	ID       int     `json:"id"`
+	Command  string  `json:"command"`
+	Target   string  `json:"target,omitempty"`
+	Address  *uint16 `json:"address,omitempty"`
+	Count    int     `json:"count,omitempty"`
+	Region   string  `json:"region,omitempty"`
+	Bank     int     `json:"bank,omitempty"`
+	Register string  `json:"register,omitempty"`
+	Value    uint16  `json:"value,omitempty"`
+	Data     string  `json:"data,omitempty"`
+	Line     string  `json:"line,omitempty"`
+}
+
+/*
+Response to a request, Error is set if it failed.
+*/
+type Response struct {
+	ID     int         `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+/*
+Event sent when the emulation stops, "stopped", or resumes, "resumed".
+*/
+type Event struct {
+	Event     string     `json:"event"`
+	Reason    string     `json:"reason,omitempty"`
+	Registers *Registers `json:"registers,omitempty"`
+}
+
+type Registers struct {
+	AF   uint16 `json:"af"`
+	BC   uint16 `json:"bc"`
+	DE   uint16 `json:"de"`
+	HL   uint16 `json:"hl"`
+	SP   uint16 `json:"sp"`
+	PC   uint16 `json:"pc"`
+	IME  bool   `json:"ime"`
+	Halt bool   `json:"halt"`
+}
+
+type Target struct {
+	Name string `json:"name"`
+	Game string `json:"game"`
+}
+
+type State struct {
+	Target    string    `json:"target"`
+	Stopped   bool      `json:"stopped"`
+	Registers Registers `json:"registers"`
+}
+
+type Memory struct {
+	Address uint16 `json:"address"`
+	Data    string `json:"data"`
+}
+
+// Pending events of a client, more are dropped
+const eventQueueSize = 64
+
+func registers(debugger *gb.Debugger) Registers {
+	state := debugger.Registers()
+	return Registers{
+		AF:   state.AF,
+		BC:   state.BC,
+		DE:   state.DE,
+		HL:   state.HL,
+		SP:   state.SP,
+		PC:   state.PC,
+		IME:  state.IME,
+		Halt: state.Halt,
+	}
+}
+
+func (session *session) execute(request Request) (interface{}, error) {
+	switch request.Command {
+	case "targets":
+		var targets []Target
+		for name, core := range session.server.Targets() {
+			targets = append(targets, Target{Name: name, Game: strings.TrimRight(core.GameTitle, "\x00")})
+		}
+		sort.Slice(targets, func(i, j int) bool {
+			return targets[i].Name < targets[j].Name
+		})
+		return targets, nil
+	case "attach":
+		if err := session.attach(request.Target); err != nil {
+			return nil, err
+		}
+		request.Command = "state"
+	case "detach":
+		session.detach()
+		return nil, nil
+	}
+
+	if session.debugger == nil {
+		if err := session.attach(""); err != nil {
+			return nil, err
+		}
+	}
+	var result interface{}
+	var err error
+	doErr := session.debugger.Do(func() {
+		result, err = session.run(session.debugger, request)
+	})
+	if doErr != nil {
+		return nil, doErr
+	}
+	return result, err
+}
+
+/*
+Terminal debugger commands clients can't run: they write files on the
+server or stop the emulator for every player.
+*/
+var localCommands = map[string]bool{
+	"dump": true,
+	"q":    true,
+	"quit": true,
+}
+
+/*
+Run a debugger command, on the emulation goroutine.
+*/
+func (session *session) run(debugger *gb.Debugger, request Request) (interface{}, error) {
+	switch request.Command {
+	case "break", "delete", "command":
+		defer session.track(debugger)()
+	}
+	switch request.Command {
+	case "state":
+		return State{
+			Target:    session.target,
+			Stopped:   debugger.Stopped(),
+			Registers: registers(debugger),
+		}, nil
+	case "pause":
+		debugger.Pause()
+	case "continue":
+		debugger.Continue()
+	case "step":
+		count := request.Count
+		if count < 1 {
+			count = 1
+		}
+		debugger.Step(count)
+	case "next":
+		debugger.Next()
+	case "finish":
+		debugger.Finish()
+	case "break":
+		if request.Address == nil {
+			return nil, errors.New("missing address")
+		}
+		debugger.Breakpoints[*request.Address] = true
+	case "delete":
+		if request.Address == nil {
+			debugger.Breakpoints = map[uint16]bool{}
+		} else if debugger.Breakpoints[*request.Address] {
+			delete(debugger.Breakpoints, *request.Address)
+		} else {
+			return nil, fmt.Errorf("no breakpoint at $%04X", *request.Address)
+		}
+	case "breakpoints":
+		breakpoints := []int{}
+		for address := range debugger.Breakpoints {
+			breakpoints = append(breakpoints, int(address))
+		}
+		sort.Ints(breakpoints)
+		return breakpoints, nil
+	case "registers":
+		return registers(debugger), nil
+	case "set":
+		if err := debugger.SetRegister(strings.ToUpper(request.Register), request.Value); err != nil {
+			return nil, err
+		}
+		return registers(debugger), nil
+	case "read":
+		if request.Address == nil {
+			return nil, errors.New("missing address")
+		}
+		count := request.Count
+		if count == 0 {
+			count = 1
+		}
+		data, err := debugger.ReadBank(request.Region, request.Bank, *request.Address, count)
+		if err != nil {
+			return nil, err
+		}
+		return Memory{Address: *request.Address, Data: strings.ToUpper(hex.EncodeToString(data))}, nil
+	case "write":
+		if request.Address == nil {
+			return nil, errors.New("missing address")
+		}
+		data, err := hex.DecodeString(request.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data: %s", request.Data)
+		}
+		return nil, debugger.WriteBank(request.Region, request.Bank, *request.Address, data)
+	case "command":
+		if args := strings.Fields(request.Line); len(args) > 0 && localCommands[args[0]] {
+			return nil, fmt.Errorf("%s can only be used in the terminal debugger", args[0])
+		}
+		return debugger.Execute(request.Line), nil
+	default:
+		return nil, fmt.Errorf("unknown command: %s", request.Command)
+	}
+	return nil, nil
+}
+
+/*
+Remember the breakpoints and watchpoints added by the session, between
+the call and the call of the returned function, so that detaching removes
+those only. Those it removes are forgotten.
+*/
+func (session *session) track(debugger *gb.Debugger) func() {
+	breakpoints := map[uint16]bool{}
+	for address := range debugger.Breakpoints {
+		breakpoints[address] = true
+	}
+	watchpoints := append([]gb.Watchpoint{}, debugger.Watchpoints...)
+	return func() {
+		for address := range debugger.Breakpoints {
+			if !breakpoints[address] {
+				session.breakpoints[address] = true
+			}
+		}
+		for address := range session.breakpoints {
+			if !debugger.Breakpoints[address] {
+				delete(session.breakpoints, address)
+			}
+		}
+		for _, watchpoint := range debugger.Watchpoints {
+			if !hasWatchpoint(watchpoints, watchpoint) {
+				session.watchpoints = append(session.watchpoints, watchpoint)
+			}
+		}
+		var kept []gb.Watchpoint
+		for _, watchpoint := range session.watchpoints {
+			if hasWatchpoint(debugger.Watchpoints, watchpoint) {
+				kept = append(kept, watchpoint)
+			}
+		}
+		session.watchpoints = kept
+	}
+}
+
+func hasWatchpoint(watchpoints []gb.Watchpoint, watchpoint gb.Watchpoint) bool {
+	for _, other := range watchpoints {
+		if other == watchpoint {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Attach to an emulator, the only one if no name is given, and start
+forwarding its events.
+*/
+func (session *session) attach(name string) error {
+	targets := session.server.Targets()
+	if name == "" {
+		if len(targets) != 1 {
+			return errors.New("not attached, list the targets and attach to one of them")
+		}
+		for only := range targets {
+			name = only
+		}
+	}
+	core, ok := targets[name]
+	if !ok {
+		return fmt.Errorf("no such target: %s", name)
+	}
+	debugger := core.Debugger()
+	if debugger == nil {
+		return fmt.Errorf("debugging is not enabled for %s", name)
+	}
+	session.detach()
+
+	session.target = name
+	session.debugger = debugger
+	session.breakpoints = map[uint16]bool{}
+	session.watchpoints = nil
+	session.events = make(chan Event, eventQueueSize)
+	events := session.events
+	session.stopListener = debugger.Listen(func(event gb.DebugEvent) {
+		message := Event{Event: "resumed"}
+		if event.Stopped {
+			state := registers(debugger)
+			message = Event{Event: "stopped", Reason: event.Reason, Registers: &state}
+		}
+		select {
+		case events <- message:
+		default:
+		}
+	})
+	go func() {
+		for event := range events {
+			session.send(event)
+		}
+	}()
+	return nil
+}
+
+/*
+Stop forwarding events. The breakpoints and watchpoints added by the
+session are removed, those of the other clients and of the terminal are
+kept. The emulation resumes when no one else is debugging it, so that it
+doesn't stay stopped with no one to resume it.
+*/
+func (session *session) detach() {
+	if session.debugger == nil {
+		return
+	}
+	session.stopListener()
+	close(session.events)
+	debugger := session.debugger
+	debugger.Do(func() {
+		for address := range session.breakpoints {
+			delete(debugger.Breakpoints, address)
+		}
+		var kept []gb.Watchpoint
+		for _, watchpoint := range debugger.Watchpoints {
+			if !hasWatchpoint(session.watchpoints, watchpoint) {
+				kept = append(kept, watchpoint)
+			}
+		}
+		debugger.Watchpoints = kept
+		if !debugger.Debugging() {
+			debugger.Continue()
+		}
+	})
+	session.debugger = nil
+	session.target = ""
+	session.breakpoints = nil
+	session.watchpoints = nil
+}
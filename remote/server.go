@@ -0,0 +1,160 @@
+package remote
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/gorilla/websocket"
+)
+
+/*
+Server lets external tools attach to running emulators and debug them with
+a JSON protocol, see Request, Response and Event. Over TCP each message is
+a JSON object on its own line, over WebSocket each message is a text frame.
+
+A client lists the emulators with "targets" and attaches to one of them
+with "attach". When there is a single target, it is attached to by the
+first command which needs one. Events are sent to the attached clients
+whenever the emulation stops or resumes.
+
+Only emulators with a debugger attached, see gb.Core.AttachDebugger, can be
+debugged.
+*/
+type Server struct {
+	// Return the emulators which can be debugged, by name
+	Targets func() map[string]*gb.Core
+
+	upgrader websocket.Upgrader
+}
+
+/*
+Connection to a client, a WebSocket or a TCP connection.
+*/
+type connection interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+type tcpConnection struct {
+	conn    net.Conn
+	decoder *json.Decoder
+	encoder *json.Encoder
+}
+
+func (conn *tcpConnection) ReadJSON(v interface{}) error {
+	return conn.decoder.Decode(v)
+}
+
+func (conn *tcpConnection) WriteJSON(v interface{}) error {
+	return conn.encoder.Encode(v)
+}
+
+func (conn *tcpConnection) Close() error {
+	return conn.conn.Close()
+}
+
+// ListenAndServe Accept TCP clients on the given port
+func (server *Server) ListenAndServe(port int) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	log.Println("[Remote] Debug server listening on port", port)
+	return server.Serve(listener)
+}
+
+// Serve Accept TCP clients from the listener
+func (server *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.handle(&tcpConnection{
+			conn:    conn,
+			decoder: json.NewDecoder(conn),
+			encoder: json.NewEncoder(conn),
+		})
+	}
+}
+
+/*
+ServeHTTP Accept a WebSocket client. Browsers may only connect from pages
+of the same host, so that other sites can't debug the emulator of their
+visitors.
+*/
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := server.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("[Remote] Upgrade error:", err)
+		return
+	}
+	server.handle(conn)
+}
+
+/*
+Answer the requests of a client until it disconnects.
+*/
+func (server *Server) handle(conn connection) {
+	session := &session{
+		server: server,
+		conn:   conn,
+	}
+	defer session.close()
+	for {
+		var request Request
+		if err := conn.ReadJSON(&request); err != nil {
+			if err != io.EOF && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				// The stream can't be read any further after a malformed message
+				session.send(Response{Error: "invalid request: " + err.Error()})
+			}
+			return
+		}
+		result, err := session.execute(request)
+		response := Response{ID: request.ID, Result: result}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		if session.send(response) != nil {
+			return
+		}
+	}
+}
+
+/*
+A connected client and the emulator it is attached to.
+*/
+type session struct {
+	server *Server
+	conn   connection
+	// Messages are written by the request and the event goroutines
+	writeLock sync.Mutex
+
+	target   string
+	debugger *gb.Debugger
+	// Breakpoints and watchpoints added by the client
+	breakpoints map[uint16]bool
+	watchpoints []gb.Watchpoint
+	// Events waiting to be sent, and the function removing their listener
+	events       chan Event
+	stopListener func()
+}
+
+func (session *session) send(message interface{}) error {
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	return session.conn.WriteJSON(message)
+}
+
+func (session *session) close() {
+	session.detach()
+	session.conn.Close()
+}
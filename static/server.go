@@ -6,29 +6,46 @@ import (
 	"fmt"
 	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/remote"
 	"github.com/gorilla/websocket"
 	"image/png"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type StaticServer struct {
 	Port     int
 	GamePath string
+	// Patch applied to the game, a patch named after the game is used if empty
+	PatchPath string
+	// Port of the remote debug server, also served over WebSocket at /debug, 0 if none
+	DebugPort int
+	// States kept for rewinding and frames between them, see gb.Core
+	RewindLength   int
+	RewindInterval int
 
+	core     *gb.Core
 	driver   *driver.StaticImage
+	camera   *driver.ImageUpload
 	upgrader websocket.Upgrader
+
+	// Error which stopped the emulator, shown to every client instead of the screen
+	err     error
+	errLock sync.RWMutex
 }
 
 // Run Running the static-image gaming server
 func (server *StaticServer) Run() {
 	// startup the emulator
 	server.driver = &driver.StaticImage{}
+	server.camera = &driver.ImageUpload{}
 	server.upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
 		return true
 	}}
@@ -40,20 +57,70 @@ func (server *StaticServer) Run() {
 		Controller:    server.driver,
 		DrawSignal:    make(chan bool),
 		SpeedMultiple: 0,
-		ToggleSound:   false,
+		Camera:        server.camera,
+		PatchPath:     server.PatchPath,
+		OnError:       server.setError,
+
+		RewindLength:   server.RewindLength,
+		RewindInterval: server.RewindInterval,
 	}
+	server.core = core
 	go core.DisplayDriver.Run(core.DrawSignal, func() {})
-	core.Init(server.GamePath)
-	go core.Run()
+	if err := core.Init(server.GamePath); err != nil {
+		// Keep serving, so that clients see why there is no game
+		log.Println("Failed to load game:", err)
+		server.setError(err)
+	} else {
+		if server.DebugPort != 0 {
+			core.AttachDebugger()
+		}
+		go core.Run()
+	}
+	if server.DebugPort != 0 {
+		debugServer := &remote.Server{
+			Targets: func() map[string]*gb.Core {
+				return map[string]*gb.Core{"main": core}
+			},
+		}
+		go func() {
+			if err := debugServer.ListenAndServe(server.DebugPort); err != nil {
+				log.Println("Failed to start the debug server:", err)
+			}
+		}()
+		http.Handle("/debug", debugServer)
+	}
 
 	// image and control server
 	http.HandleFunc("/image", showImage(server))
 	http.HandleFunc("/stream", streamImages(server))
 	http.HandleFunc("/svg", showSVG(server))
 	http.HandleFunc("/control", newInput(server))
+	http.HandleFunc("/camera", uploadCamera(server))
 	http.ListenAndServe(fmt.Sprintf(":%d", server.Port), nil)
 }
 
+func (server *StaticServer) setError(err error) {
+	server.errLock.Lock()
+	server.err = err
+	server.errLock.Unlock()
+}
+
+func (server *StaticServer) emulatorError() error {
+	server.errLock.RLock()
+	defer server.errLock.RUnlock()
+	return server.err
+}
+
+// Respond with the emulator error if there is one, return whether it did so
+func showError(server *StaticServer, w http.ResponseWriter) bool {
+	err := server.emulatorError()
+	if err == nil {
+		return false
+	}
+	http.Error(w, "The emulator stopped: "+err.Error(), http.StatusInternalServerError)
+	return true
+}
+
 func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		c, err := server.upgrader.Upgrade(w, req, nil)
@@ -62,7 +129,11 @@ func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request)
 			return
 		}
 		defer c.Close()
+		// Speed errors are replied while images are sent
+		var writeLock sync.Mutex
 		go func() {
+			// A client leaving while rewinding must not rewind forever
+			defer server.driver.SetRewinding(false)
 			for {
 				_, msg, err2 := c.ReadMessage()
 				stringMsg := string(msg)
@@ -70,6 +141,29 @@ func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request)
 					log.Println(err2)
 					break
 				}
+				if stringMsg == "rewind start" || stringMsg == "rewind stop" {
+					// Held rewind button
+					server.driver.SetRewinding(stringMsg == "rewind start")
+					continue
+				}
+				if ok, err3 := speedCommand(server.core, stringMsg); ok {
+					if err3 != nil {
+						writeLock.Lock()
+						c.WriteMessage(websocket.TextMessage, []byte(err3.Error()))
+						writeLock.Unlock()
+					}
+					continue
+				}
+				if strings.HasPrefix(stringMsg, "tilt ") {
+					// Device orientation, "tilt <x> <y>" in g
+					var x, y float64
+					if _, err3 := fmt.Sscanf(stringMsg, "tilt %g %g", &x, &y); err3 != nil {
+						log.Println(err3)
+						continue
+					}
+					server.driver.SetTilt(x, y)
+					continue
+				}
 				buttonByte, err3 := strconv.ParseUint(stringMsg, 10, 32)
 				if err3 != nil {
 					log.Println(err3)
@@ -83,6 +177,12 @@ func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request)
 			}
 		}()
 		for {
+			if emulatorErr := server.emulatorError(); emulatorErr != nil {
+				writeLock.Lock()
+				c.WriteMessage(websocket.TextMessage, []byte("The emulator stopped: "+emulatorErr.Error()))
+				writeLock.Unlock()
+				break
+			}
 			img := server.driver.Render()
 			buf := new(bytes.Buffer)
 			err = png.Encode(buf, img)
@@ -90,7 +190,9 @@ func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request)
 				log.Println(err)
 				continue
 			}
+			writeLock.Lock()
 			err = c.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+			writeLock.Unlock()
 			if err != nil {
 				log.Println("write error:", err)
 				break
@@ -103,6 +205,9 @@ func showSVG(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 	svg, _ := ioutil.ReadFile("gb.svg")
 
 	return func(w http.ResponseWriter, req *http.Request) {
+		if showError(server, w) {
+			return
+		}
 		callback, _ := req.URL.Query()["callback"]
 
 		w.Header().Set("Cache-control", "no-cache,max-age=0")
@@ -128,6 +233,9 @@ func showSVG(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 func showImage(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 	lastSave := time.Now().Add(time.Duration(-1) * time.Hour)
 	return func(w http.ResponseWriter, req *http.Request) {
+		if showError(server, w) {
+			return
+		}
 		w.Header().Set("Cache-control", "no-cache,max-age=0")
 		w.Header().Set("Content-type", "image/png")
 		w.Header().Set("Expires", time.Now().Add(time.Duration(-1)*time.Hour).UTC().Format(http.TimeFormat))
@@ -149,6 +257,9 @@ func showImage(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 
 func newInput(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if showError(server, w) {
+			return
+		}
 		keys, ok := req.URL.Query()["button"]
 		callback, _ := req.URL.Query()["callback"]
 
@@ -166,3 +277,50 @@ func newInput(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 		http.Redirect(w, req, callback[0], http.StatusSeeOther)
 	}
 }
+
+// Largest camera image accepted by the server
+const maxCameraUploadSize = 4 << 20
+
+// Show the PNG image posted in the request body to the Pocket Camera
+func uploadCamera(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Camera images must be posted", http.StatusMethodNotAllowed)
+			return
+		}
+		body := http.MaxBytesReader(w, req.Body, maxCameraUploadSize)
+		if err := server.camera.Upload(body); err != nil {
+			http.Error(w, "Invalid PNG image: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/*
+Apply a speed control message: "pause", "resume", "advance" for a single
+frame while paused, or "speed <multiple>", "speed uncapped". Return false
+if the message is something else, and an error to reply for an invalid
+speed.
+*/
+func speedCommand(core *gb.Core, msg string) (bool, error) {
+	switch {
+	case msg == "pause":
+		core.Pause()
+	case msg == "resume":
+		core.Resume()
+	case msg == "advance":
+		core.AdvanceFrame()
+	case msg == "speed uncapped":
+		core.SetSpeed(gb.SpeedUncapped)
+	case strings.HasPrefix(msg, "speed "):
+		speed, err := strconv.ParseFloat(strings.TrimPrefix(msg, "speed "), 64)
+		if err != nil || speed <= 0 || math.IsInf(speed, 0) || math.IsNaN(speed) {
+			return true, fmt.Errorf("invalid speed: %s", strings.TrimPrefix(msg, "speed "))
+		}
+		core.SetSpeed(speed)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/HFO4/gbc-in-cloud/gb"
@@ -21,6 +23,21 @@ type Player struct {
 
 	SelectedPlayer   int
 	SelectedPlayerID string
+
+	// Whether remote debuggers can attach to the emulator
+	RemoteDebug bool
+	// States kept for rewinding and frames between them, see gb.Core
+	RewindLength   int
+	RewindInterval int
+	// Set once the game is loaded and the emulator runs
+	running int32
+}
+
+/*
+Whether the game of the player is loaded and running.
+*/
+func (player *Player) Running() bool {
+	return atomic.LoadInt32(&player.running) != 0
 }
 
 // Send TELNET options
@@ -53,9 +70,14 @@ func (player *Player) Init() bool {
 			Controller:    new(driver.TelnetController),
 			DrawSignal:    make(chan bool),
 			SpeedMultiple: 0,
-			ToggleSound:   false,
+
+			RewindLength:   player.RewindLength,
+			RewindInterval: player.RewindInterval,
 		}
 
+		if player.RemoteDebug {
+			core.AttachDebugger()
+		}
 		player.Emulator = core
 
 		log.Println("New Player:", player.ID)
@@ -133,10 +155,11 @@ func (player *Player) Welcome() int {
 			_, err = player.Conn.Write([]byte("\033[2J\033[H"))
 
 			// If choose each other, connect their serial driver
-			if player.SelectedPlayerID != "" && PlayerList[player.SelectedPlayer].SelectedPlayerID == player.ID {
-				PlayerList[player.SelectedPlayer].Emulator.Serial.SetTarget(&player.Emulator.Serial)
-				player.Emulator.Serial.SetTarget(&PlayerList[player.SelectedPlayer].Emulator.Serial)
-				log.Printf("[Serial] Player %s connect with Player %s", player.SelectedPlayerID, PlayerList[player.SelectedPlayer].SelectedPlayerID)
+			partner := findPlayer(player.SelectedPlayerID)
+			if partner != nil && partner.SelectedPlayerID == player.ID {
+				partner.Emulator.Serial.SetTarget(&player.Emulator.Serial)
+				player.Emulator.Serial.SetTarget(&partner.Emulator.Serial)
+				log.Printf("[Serial] Player %s connect with Player %s", player.SelectedPlayerID, partner.SelectedPlayerID)
 			}
 		}
 
@@ -153,7 +176,7 @@ func (player *Player) RenderSelectPlayer() []byte {
 	res += "Your player ID: " + fmt.Stringer(aurora.Gray(1-1, player.ID).BgGray(24-1)).String() + "\r\n"
 	res += "Player list (Press R to refresh):\r\n\r\n"
 
-	for k, v := range PlayerList {
+	for k, v := range players() {
 
 		if player.SelectedPlayer == k {
 			res += "    " + fmt.Stringer(aurora.Gray(1-1, v.ID+"\r\n").BgGray(24-1)).String()
@@ -183,17 +206,22 @@ func (player *Player) SelectPlayer() int {
 			return -1
 		}
 
+		// Players may have left since the list was shown
+		list := players()
+		if player.SelectedPlayer >= len(list) {
+			player.SelectedPlayer = 0
+		}
 		switch inputKey[len(inputKey)-1] {
 		// Up key pressed
 		case 65:
 			if player.SelectedPlayer == 0 {
-				player.SelectedPlayer = len(PlayerList) - 1
+				player.SelectedPlayer = len(list) - 1
 			} else {
 				player.SelectedPlayer--
 			}
 		// Down key pressed
 		case 66:
-			if player.SelectedPlayer == len(PlayerList)-1 {
+			if player.SelectedPlayer == len(list)-1 {
 				player.SelectedPlayer = 0
 			} else {
 				player.SelectedPlayer++
@@ -201,7 +229,7 @@ func (player *Player) SelectPlayer() int {
 		// Enter key pressed
 		case 10, 0:
 			// Cannot choose yourself
-			if PlayerList[player.SelectedPlayer].ID == player.ID {
+			if list[player.SelectedPlayer].ID == player.ID {
 				continue
 			}
 
@@ -211,7 +239,7 @@ func (player *Player) SelectPlayer() int {
 				return 0
 			}
 
-			player.SelectedPlayerID = PlayerList[player.SelectedPlayer].ID
+			player.SelectedPlayerID = list[player.SelectedPlayer].ID
 			return 0
 		// R key pressed
 		case 114:
@@ -229,7 +257,7 @@ func (player *Player) SelectPlayer() int {
 */
 
 func (player *Player) Instruction() int {
-	ret := "Here's the key instruction, press " + fmt.Stringer(aurora.Gray(1-1, "Enter").BgGray(24-1)).String() + " key to enter the game, " + fmt.Stringer(aurora.Gray(1-1, " Q ").BgGray(24-1)).String() + " to quit the game.\r\n\r\n"
+	ret := "Here's the key instruction, press " + fmt.Stringer(aurora.Gray(1-1, "Enter").BgGray(24-1)).String() + " key to enter the game, " + fmt.Stringer(aurora.Gray(1-1, " Q ").BgGray(24-1)).String() + " to quit the game, " + fmt.Stringer(aurora.Gray(1-1, " C ").BgGray(24-1)).String() + " to enter a cheat code, hold " + fmt.Stringer(aurora.Gray(1-1, " R ").BgGray(24-1)).String() + " to rewind, " + fmt.Stringer(aurora.Gray(1-1, " P ").BgGray(24-1)).String() + " to pause, " + fmt.Stringer(aurora.Gray(1-1, " N ").BgGray(24-1)).String() + " to advance a frame while paused, " + fmt.Stringer(aurora.Gray(1-1, " F ").BgGray(24-1)).String() + " and " + fmt.Stringer(aurora.Gray(1-1, " S ").BgGray(24-1)).String() + " to speed up and slow down, " + fmt.Stringer(aurora.Gray(1-1, " 0 ").BgGray(24-1)).String() + " for the normal speed.\r\n\r\n"
 	ret += "                      __________________________\r\n" + "                     |OFFo oON                  |\r\n" + "                     | .----------------------. |\r\n" + "                     | |  .----------------.  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |))|                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  '----------------'  | |\r\n" + "                     | |__GAME BOY____________/ |\r\n" + "    Keyboard:Up↑ <--------+     ________        |\r\n" + "                     |    +    (Nintendo)       |\r\n" + "                     |  _| |_   \"\"\"\"\"\"\"\"   .-.  |\r\n" + "  Keyboard:Left← <----+[_   _]---+    .-. ( +---------> Keyboard:X\r\n" + "                     |   |_|     |   (   ) '-'  |\r\n" + "                     |    +      |    '-+   A   |\r\n" + "  Keyboard:Down↓ <--------+ +----+     B+-------------> Keyboard:Z\r\n" + "                     |      |   ___   ___       |\r\n" + "                     |      |  (___) (___)  ,., |\r\n" + "Keyboard:Right→ <-----------+ select st+rt ;:;: |\r\n" + "                     |           +     |  ,;:;' /\r\n" + "                  jgs|           |     | ,:;:'.'\r\n" + "                     '-----------------------`\r\n" + "                                 |     |\r\n" + "           Keyboard:Backspace <--+     +-> Keyboard:Enter\r\n"
 	// Clean screen
 	_, err := player.Conn.Write([]byte("\033[2J\033[H" + ret))
@@ -257,6 +285,8 @@ func (player *Player) Logout() {
 		player.Emulator.Serial.Target.Target = nil
 	}
 
+	playerLock.Lock()
+	defer playerLock.Unlock()
 	playerIndex := 0
 	for k, v := range PlayerList {
 		if v.ID == player.ID {
@@ -270,6 +300,88 @@ func (player *Player) Logout() {
 	}
 }
 
+/*
+	Find an online player by ID, nil if there is none.
+*/
+func findPlayer(id string) *Player {
+	for _, v := range players() {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+/*
+	Tell the player that the emulator failed.
+*/
+func (player *Player) ShowError(err error) {
+	msg := "\033[2J\033[H" + fmt.Stringer(aurora.Red("The emulator stopped: "+err.Error())).String() + "\r\n"
+	_, writeErr := player.Conn.Write([]byte(msg))
+	if writeErr != nil {
+		log.Println("Failed to send error to player")
+	}
+}
+
+/*
+	Read a cheat command below the game screen:
+	a code enables it, "-code" disables it and "clear" disables all codes.
+*/
+func (player *Player) CheatPrompt() int {
+	// The game screen is 36 lines high
+	const promptLine = "\033[38;1H\033[K"
+	prompt := "Cheat code (\"-code\" to remove, \"clear\" to remove all, Enter to cancel): "
+	input := ""
+	for {
+		_, err := player.Conn.Write([]byte(promptLine + prompt + input))
+		if err != nil {
+			return -1
+		}
+		buf := make([]byte, 512)
+		n, err := player.Conn.Read(buf)
+		if err != nil {
+			return -1
+		}
+		key := buf[n-1]
+		if key == 0 || key == 10 || key == 13 {
+			break
+		}
+		if key == 8 || key == 127 {
+			if len(input) > 0 {
+				input = input[:len(input)-1]
+			}
+		} else if key >= 32 && key < 127 && n == 1 {
+			input += string(key)
+		}
+	}
+
+	var msg string
+	var err error
+	input = strings.TrimSpace(input)
+	switch {
+	case input == "":
+	case input == "clear":
+		player.Emulator.ClearCheats()
+		msg = "All cheat codes removed"
+	case strings.HasPrefix(input, "-"):
+		if err = player.Emulator.RemoveCheat(input[1:]); err == nil {
+			msg = "Cheat code removed: " + input[1:]
+		}
+	default:
+		if err = player.Emulator.AddCheat(input); err == nil {
+			msg = "Cheat code added: " + input
+		}
+	}
+	if err != nil {
+		msg = fmt.Stringer(aurora.Red(err.Error())).String()
+	}
+	_, err = player.Conn.Write([]byte(promptLine + msg))
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
 func (player *Player) Serve() {
 
 	game := player.Welcome()
@@ -286,10 +398,29 @@ func (player *Player) Serve() {
 		return
 	}
 
+	// Report failures to this player only, other sessions keep running
+	player.Emulator.OnError = func(err error) {
+		player.ShowError(err)
+	}
+	gameInfo := (*player.GameList)[player.Selected]
+	player.Emulator.PatchPath = gameInfo.Patch
+	if err := player.Emulator.Init(gameInfo.Path); err != nil {
+		log.Println("Failed to load game:", err)
+		player.ShowError(err)
+		player.Conn.Close()
+		player.Logout()
+		return
+	}
+	for _, code := range gameInfo.Cheats {
+		if err := player.Emulator.AddCheat(code); err != nil {
+			log.Println("Invalid cheat in game list:", err)
+		}
+	}
+
 	// Set the display driver to TELNET
 	go player.Emulator.DisplayDriver.Run(player.Emulator.DrawSignal, func() {})
-	player.Emulator.Init((*player.GameList)[player.Selected].Path)
 	go player.Emulator.Run()
+	atomic.StoreInt32(&player.running, 1)
 
 	for {
 		buf := make([]byte, 512)
@@ -311,6 +442,15 @@ func (player *Player) Serve() {
 			player.Logout()
 			return
 		}
+		// If "C" was pressed, read a cheat command
+		if buf[n-1] == 99 {
+			if player.CheatPrompt() < 0 {
+				player.Emulator.Exit = true
+				player.Logout()
+				return
+			}
+			continue
+		}
 		// Handle user input
 		player.Emulator.Controller.NewInput(buf[:n])
 	}
@@ -1,24 +1,48 @@
 package stream
 
 import (
+	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/remote"
 	"github.com/satori/go.uuid"
 	"log"
 	"net"
 	"strconv"
+	"sync"
 )
 
 type StreamServer struct {
 	Port     int
 	GameList []GameInfo
+	// Port of the remote debug server, players can be debugged by ID, 0 if none
+	DebugPort int
+	// States kept for rewinding and frames between them, see gb.Core
+	RewindLength   int
+	RewindInterval int
 }
 
 type GameInfo struct {
 	Title string
 	Path  string
+	// Optional IPS, UPS or BPS patch, a patch named after the ROM is used otherwise
+	Patch string
+	// Game Genie and GameShark codes enabled when the game starts
+	Cheats []string
 }
 
 var PlayerList []*Player
 
+// Guards PlayerList, players are added and removed by their own goroutines
+var playerLock sync.RWMutex
+
+/*
+Copy of PlayerList, safe to range over while players come and go.
+*/
+func players() []*Player {
+	playerLock.RLock()
+	defer playerLock.RUnlock()
+	return append([]*Player(nil), PlayerList...)
+}
+
 // Run Running the cloud gaming server
 func (server *StreamServer) Run() {
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(server.Port))
@@ -31,7 +55,13 @@ func (server *StreamServer) Run() {
 
 	NonePlayer := new(Player)
 	NonePlayer.ID = "None"
+	playerLock.Lock()
 	PlayerList = append(PlayerList, NonePlayer)
+	playerLock.Unlock()
+
+	if server.DebugPort != 0 {
+		go server.serveDebugger()
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -46,12 +76,40 @@ func (server *StreamServer) Run() {
 			Conn:     conn,
 			ID:       PlayerID.String(),
 			GameList: &server.GameList,
+			// Debuggers attach to the emulator of the player
+			RemoteDebug: server.DebugPort != 0,
+
+			RewindLength:   server.RewindLength,
+			RewindInterval: server.RewindInterval,
 		}
 
+		playerLock.Lock()
 		PlayerList = append(PlayerList, player)
+		playerLock.Unlock()
 
 		if player.InitTelnet() {
 			go player.Serve()
 		}
 	}
 }
+
+/*
+Serve the remote debug protocol, every player with a running game is a
+target named after its ID.
+*/
+func (server *StreamServer) serveDebugger() {
+	debugServer := &remote.Server{
+		Targets: func() map[string]*gb.Core {
+			targets := map[string]*gb.Core{}
+			for _, player := range players() {
+				if player.Running() && player.Emulator.Debugger() != nil {
+					targets[player.ID] = player.Emulator
+				}
+			}
+			return targets
+		},
+	}
+	if err := debugServer.ListenAndServe(server.DebugPort); err != nil {
+		log.Println("Error starting the debug server", err.Error())
+	}
+}